@@ -1,12 +1,84 @@
 package gantry // import "github.com/ad-freiburg/gantry"
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
 	"github.com/ad-freiburg/gantry/types"
 )
 
 // BuildInfo represents the build-keyword in a docker-compse.yml.
 type BuildInfo struct {
-	Context    string          `json:"context"`
-	Dockerfile string          `json:"dockerfile"`
-	Args       types.StringMap `json:"args"`
+	Context    string                    `json:"context"`
+	Dockerfile string                    `json:"dockerfile"`
+	Args       types.StringMap           `json:"args"`
+	Target     string                    `json:"target"`
+	CacheFrom  types.StringOrStringSlice `json:"cache_from"`
+	Labels     types.StringMap           `json:"labels"`
+	Network    string                    `json:"network"`
+	ShmSize    types.StringOrNumber      `json:"shm_size"`
+	ExtraHosts types.StringOrStringSlice `json:"extra_hosts"`
+	Secrets    []BuildSecret             `json:"secrets"`
+	SSH        types.StringOrStringSlice `json:"ssh"`
+}
+
+type buildInfoJSON BuildInfo
+
+// UnmarshalJSON loads BuildInfo from json, a single string is used as context.
+func (b *BuildInfo) UnmarshalJSON(data []byte) error {
+	var context string
+	if err := json.Unmarshal(data, &context); err == nil {
+		*b = BuildInfo{Context: context}
+		return nil
+	}
+	parsedJSON := buildInfoJSON{}
+	if err := json.Unmarshal(data, &parsedJSON); err != nil {
+		return err
+	}
+	*b = BuildInfo(parsedJSON)
+	return nil
+}
+
+// NeedsBuildKit returns whether or not features only supported by BuildKit are
+// requested.
+func (b BuildInfo) NeedsBuildKit() bool {
+	return len(b.Secrets) > 0 || len(b.SSH) > 0
+}
+
+// BuildSecret represents a secret available during the build.
+type BuildSecret struct {
+	Source      string `json:"source"`
+	File        string `json:"file"`
+	Environment string `json:"environment"`
+}
+
+type buildSecretJSON BuildSecret
+
+// UnmarshalJSON loads a BuildSecret from json, a single string is used as
+// source.
+func (s *BuildSecret) UnmarshalJSON(data []byte) error {
+	var source string
+	if err := json.Unmarshal(data, &source); err == nil {
+		*s = BuildSecret{Source: source}
+		return nil
+	}
+	parsedJSON := buildSecretJSON{}
+	if err := json.Unmarshal(data, &parsedJSON); err != nil {
+		return err
+	}
+	*s = BuildSecret(parsedJSON)
+	return nil
+}
+
+// Flag returns the value of the --secret flag for s.
+func (s BuildSecret) Flag() string {
+	parts := []string{fmt.Sprintf("id=%s", s.Source)}
+	if s.File != "" {
+		parts = append(parts, fmt.Sprintf("src=%s", s.File))
+	}
+	if s.Environment != "" {
+		parts = append(parts, fmt.Sprintf("env=%s", s.Environment))
+	}
+	return strings.Join(parts, ",")
 }
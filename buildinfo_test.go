@@ -0,0 +1,53 @@
+package gantry_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestBuildInfoUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		json   string
+		err    string
+		result gantry.BuildInfo
+	}{
+		{`"./dir"`, "", gantry.BuildInfo{Context: "./dir"}},
+		{`{"context": "./dir", "target": "prod"}`, "", gantry.BuildInfo{Context: "./dir", Target: "prod"}},
+		{`{"cache_from": "img", "shm_size": 1000000}`, "", gantry.BuildInfo{CacheFrom: types.StringOrStringSlice{"img"}, ShmSize: "1000000"}},
+		{`{"secrets": ["a", {"source": "b", "file": "./b.txt"}], "ssh": ["default"]}`, "", gantry.BuildInfo{Secrets: []gantry.BuildSecret{{Source: "a"}, {Source: "b", File: "./b.txt"}}, SSH: types.StringOrStringSlice{"default"}}},
+		{`[]`, "json: cannot unmarshal array into Go value of type gantry.buildInfoJSON", gantry.BuildInfo{}},
+	}
+
+	for _, c := range cases {
+		var r gantry.BuildInfo
+		err := json.Unmarshal([]byte(c.json), &r)
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Incorrect error for '%s', got: '%v', wanted: '%s'", c.json, err, c.err)
+		}
+		if !reflect.DeepEqual(r, c.result) {
+			t.Errorf("Incorrect result for '%s', got: '%#v', wanted: '%#v'", c.json, r, c.result)
+		}
+	}
+}
+
+func TestBuildInfoNeedsBuildKit(t *testing.T) {
+	cases := []struct {
+		info   gantry.BuildInfo
+		result bool
+	}{
+		{gantry.BuildInfo{}, false},
+		{gantry.BuildInfo{Target: "prod", CacheFrom: types.StringOrStringSlice{"img"}}, false},
+		{gantry.BuildInfo{Secrets: []gantry.BuildSecret{{Source: "a"}}}, true},
+		{gantry.BuildInfo{SSH: types.StringOrStringSlice{"default"}}, true},
+	}
+
+	for _, c := range cases {
+		if r := c.info.NeedsBuildKit(); r != c.result {
+			t.Errorf("Incorrect result for '%#v', got: '%t', wanted: '%t'", c.info, r, c.result)
+		}
+	}
+}
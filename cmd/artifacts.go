@@ -0,0 +1,46 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	artifactsCmd.AddCommand(artifactsCollectCmd)
+	rootCmd.AddCommand(artifactsCmd)
+}
+
+var artifactsCmd = &cobra.Command{
+	Use:   "artifacts",
+	Short: "Manages the declared outputs of steps",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+}
+
+var artifactsCollectCmd = &cobra.Command{
+	Use:   "collect [flags] DIR",
+	Short: "Hardlinks or copies the outputs of the last run into DIR",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		path := gantry.OutputsRecordPath(defFiles)
+		record, err := gantry.NewOutputRecord(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("no outputs recorded, %s not found", path)
+			}
+			return err
+		}
+		count, err := record.Collect(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Collected %d output(s) into %s\n", count, args[0])
+		return nil
+	},
+}
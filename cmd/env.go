@@ -0,0 +1,124 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/ad-freiburg/gantry/types"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(envCmd)
+	envCmd.AddCommand(envKeygenCmd)
+	envCmd.AddCommand(envEncryptCmd)
+	envCmd.AddCommand(envDecryptCmd)
+	envEncryptCmd.Flags().StringVar(&recipient, "recipient", "", fmt.Sprintf("Public key to encrypt for, defaults to the key of %s", gantry.GantryKeyFile))
+}
+
+var (
+	recipient string
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: fmt.Sprintf("Manage encrypted substitutions of %s, has subcommands", gantry.GantryEnv),
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fmt.Errorf("missing sub-command")
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+}
+
+var envKeygenCmd = &cobra.Command{
+	Use:   "keygen file",
+	Short: "Generates a new key file and prints its public key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		secretKey, publicKey, err := gantry.GenerateKey()
+		if err != nil {
+			return err
+		}
+		if err := gantry.WriteKeyFile(args[0], secretKey); err != nil {
+			return err
+		}
+		fmt.Println(publicKey)
+		return nil
+	},
+}
+
+var envEncryptCmd = &cobra.Command{
+	Use:   "encrypt KEY",
+	Short: "Encrypts the value read from stdin and prints the substitution entry",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		publicKey := recipient
+		if publicKey == "" {
+			path := os.Getenv(gantry.GantryKeyFile)
+			if path == "" {
+				return fmt.Errorf("neither --recipient nor %s is set", gantry.GantryKeyFile)
+			}
+			secretKey, err := gantry.ReadKeyFile(path)
+			if err != nil {
+				return err
+			}
+			if publicKey, err = gantry.PublicKeyFromSecretKey(secretKey); err != nil {
+				return err
+			}
+		}
+		value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && value == "" {
+			return fmt.Errorf("no value given on stdin")
+		}
+		encrypted, err := gantry.EncryptValue(strings.TrimRight(value, "\r\n"), publicKey)
+		if err != nil {
+			return err
+		}
+		// Armored values span multiple lines, print them as yaml block
+		fmt.Printf("%s: |\n", args[0])
+		for _, line := range strings.Split(strings.TrimSpace(encrypted), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+		return nil
+	},
+}
+
+var envDecryptCmd = &cobra.Command{
+	Use:   "decrypt [KEY...]",
+	Short: fmt.Sprintf("Prints the decrypted substitutions of %s", gantry.GantryEnv),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		environment, err := gantry.NewPipelineEnvironment(envFiles, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		if err != nil {
+			if e, ok := err.(*os.PathError); !ok || e.Err != syscall.ENOENT {
+				return err
+			}
+		}
+		keys := args
+		if len(keys) == 0 {
+			for k := range environment.Substitutions {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+		}
+		for _, k := range keys {
+			v, found := environment.GetSubstitution(k)
+			if !found {
+				return fmt.Errorf("no such substitution '%s'", k)
+			}
+			if v == nil {
+				fmt.Printf("%s:\n", k)
+				continue
+			}
+			// Print unmasked to stdout only, values are never written to disk
+			fmt.Printf("%s: %s\n", k, *v)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,24 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"fmt"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+}
+
+var lockCmd = &cobra.Command{
+	Use:   "lock [flags]",
+	Short: fmt.Sprintf("Resolves all pullable images to their digests and writes %s", gantry.GantryLock),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if updateLock {
+			// Already updated before running this command
+			return nil
+		}
+		return pipeline.UpdateLock(pipeline.LockPath)
+	},
+}
@@ -2,7 +2,6 @@ package cmd // import "github.com/ad-freiburg/gantry/cmd"
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"strings"
 	"syscall"
@@ -26,7 +25,7 @@ var preprocessorApplyCmd = &cobra.Command{
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var err error
-		defFile = args[0]
+		defFile := args[0]
 		ignoredSteps := types.StringSet{}
 		for _, step := range stepsToIgnore {
 			ignoredSteps[step] = true
@@ -44,37 +43,28 @@ var preprocessorApplyCmd = &cobra.Command{
 				env[parts[0]] = &parts[1]
 			}
 		}
-		environment, err := gantry.NewPipelineEnvironment(envFile, env, ignoredSteps, selectedSteps)
+		environment, err := gantry.NewPipelineEnvironment(envFiles, env, ignoredSteps, selectedSteps)
 		if err != nil {
-			if e, ok := err.(*os.PathError); ok && e.Err != syscall.ENOENT {
+			if e, ok := err.(*os.PathError); !ok || e.Err != syscall.ENOENT {
 				return err
 			}
 		}
 
-		// Read file
-		file, err := os.Open(defFile)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		data, err := ioutil.ReadAll(file)
-		if err != nil {
-			return err
-		}
-
 		// Run preprocessor
 		preproc, err := preprocessor.NewPreprocessor()
-		preproc.DryRun = true
 		if err != nil {
 			return err
 		}
-		data, err = preproc.Process(data, environment)
+		preproc.DryRun = true
+		preproc.Strict = environment.StrictSubstitution
+		preproc.DisableCommands = environment.DisableCommands
+		data, err := preproc.ProcessFile(defFile, environment)
 		if err != nil {
 			return err
 		}
 
-		// Print result
-		fmt.Printf("%s\n", data)
+		// Print result, decrypted substitutions are masked
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n", data)
 		return nil
 	},
 	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
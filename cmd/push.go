@@ -0,0 +1,17 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(pushCmd)
+}
+
+var pushCmd = &cobra.Command{
+	Use:   "push [flags] [Service/Step...]",
+	Short: "Pushes images of buildable services/steps",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pipeline.PushImages()
+	},
+}
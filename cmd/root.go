@@ -32,6 +32,14 @@ var rootCmd = &cobra.Command{
 		for _, step := range args {
 			selectedSteps[step] = true
 		}
+		if len(profiles) == 0 {
+			if v := os.Getenv(gantry.GantryProfiles); v != "" {
+				profiles = strings.Split(v, ",")
+			}
+		}
+		for _, profile := range profiles {
+			gantry.ActiveProfiles[strings.TrimSpace(profile)] = true
+		}
 		env := types.StringMap{}
 		for _, v := range environment {
 			parts := strings.SplitN(v, "=", 2)
@@ -41,7 +49,7 @@ var rootCmd = &cobra.Command{
 				env[parts[0]] = &parts[1]
 			}
 		}
-		pipeline, err = gantry.NewPipeline(defFile, envFile, env, ignoredSteps, selectedSteps)
+		pipeline, err = gantry.NewPipeline(defFiles, envFiles, env, ignoredSteps, selectedSteps)
 		if err != nil {
 			return err
 		}
@@ -60,13 +68,12 @@ var rootCmd = &cobra.Command{
 			if gantry.Verbose {
 				log.Print("Calculate project-name\n")
 			}
-			cwd, err := os.Getwd()
+			gantry.ProjectName, err = defaultProjectName(defFiles)
 			if err != nil {
 				return err
 			}
-			gantry.ProjectName = filepath.Base(cwd)
 		}
-		gantry.ProjectName = strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(gantry.ProjectName), " ", "_"), ".", "")
+		gantry.ProjectName = gantry.NormalizeProjectName(gantry.ProjectName)
 		pipeline.Network = gantry.Network(fmt.Sprintf("%s_gantry", gantry.ProjectName))
 		// We have valid data, silence generic usage information now.
 		cmd.SilenceUsage = true
@@ -76,6 +83,9 @@ var rootCmd = &cobra.Command{
 				return err
 			}
 		}
+		if updateLock {
+			return pipeline.UpdateLock(pipeline.LockPath)
+		}
 		return nil
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -109,22 +119,42 @@ const (
 )
 
 var (
-	defFile       string
-	envFile       string
+	defFiles      []string
+	envFiles      []string
 	pipeline      *gantry.Pipeline
 	stepsToIgnore []string
 	environment   []string
+	profiles      []string
+	updateLock    bool
 )
 
+// defaultProjectName returns the name of the directory containing the first
+// definition file, as used for PROJECT in image tags.
+func defaultProjectName(defFiles []string) (string, error) {
+	path := gantry.GantryDef
+	if len(defFiles) > 0 {
+		path = defFiles[0]
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(filepath.Dir(abs)), nil
+}
+
 func init() {
-	rootCmd.PersistentFlags().StringVarP(&defFile, "file", "f", "", fmt.Sprintf("Explicit %s to use", gantry.GantryDef))
-	rootCmd.PersistentFlags().StringVarP(&envFile, "global-environment", "g", "", fmt.Sprintf("Explicit %s to use", gantry.GantryEnv))
+	rootCmd.PersistentFlags().StringArrayVarP(&defFiles, "file", "f", []string{}, fmt.Sprintf("Explicit %s to use, later files are merged into earlier ones", gantry.GantryDef))
+	rootCmd.PersistentFlags().StringArrayVarP(&envFiles, "global-environment", "g", []string{}, fmt.Sprintf("Explicit %s to use, later files are merged into earlier ones", gantry.GantryEnv))
+	rootCmd.PersistentFlags().StringVar(&gantry.EnvironmentProfile, "env-profile", "", fmt.Sprintf("Apply this profile of %s", gantry.GantryEnv))
 	rootCmd.PersistentFlags().StringVarP(&gantry.ProjectName, "project-name", "p", "", "Spefify an alternate project name")
 	rootCmd.PersistentFlags().BoolVar(&gantry.Verbose, "verbose", false, "Verbose output")
+	rootCmd.PersistentFlags().BoolVar(&gantry.IgnoreSchemaProblems, "ignore-schema-problems", false, "Only warn about values not matching the schemas of definitions and environments")
 	rootCmd.PersistentFlags().BoolVar(&gantry.ShowContainerCommands, "show-container-commands", false, "Print commands used to interact with containers")
 	rootCmd.PersistentFlags().BoolVar(&gantry.ForceWharfer, "force-wharfer", false, "Force usage of wharfer")
 	rootCmd.PersistentFlags().StringArrayVarP(&stepsToIgnore, "ignore", "i", []string{}, "Ignore step/service with this name")
 	rootCmd.PersistentFlags().StringArrayVarP(&environment, "env", "e", []string{}, "Set environment variables")
+	rootCmd.PersistentFlags().StringArrayVar(&profiles, "profile", []string{}, fmt.Sprintf("Enable services and steps of this profile, defaults to %s", gantry.GantryProfiles))
+	rootCmd.PersistentFlags().BoolVar(&updateLock, "update-lock", false, fmt.Sprintf("Resolve images to their current digests and update %s before running", gantry.GantryLock))
 	if err := rootCmd.PersistentFlags().SetAnnotation("file", cobra.BashCompFilenameExt, []string{".yaml", ".yml"}); err != nil {
 		log.Printf("Error setting file annotation: %s", err)
 	}
@@ -161,6 +191,10 @@ func signalHandler() {
 
 // Execute is the main entrypoint for using gantry commands.
 func Execute() {
+	// Mask secrets in everything printed
+	log.SetOutput(gantry.NewMaskedWriter(os.Stderr))
+	rootCmd.SetOut(gantry.NewMaskedWriter(os.Stdout))
+	rootCmd.SetErr(gantry.NewMaskedWriter(os.Stderr))
 	if err := rootCmd.Execute(); err != nil {
 		log.Println(err)
 		if e, ok := err.(gantry.ExecutionError); ok {
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ad-freiburg/gantry"
+)
+
+func TestDefaultProjectName(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		defFiles []string
+		name     string
+	}{
+		{[]string{}, filepath.Base(cwd)},
+		{[]string{gantry.GantryDef}, filepath.Base(cwd)},
+		{[]string{filepath.Join("project", "gantry.yml")}, "project"},
+		{[]string{filepath.Join(os.TempDir(), "other", "gantry.yml"), "override.yml"}, "other"},
+	}
+	for _, c := range cases {
+		name, err := defaultProjectName(c.defFiles)
+		if err != nil {
+			t.Fatalf("unexpected error: '%s'", err)
+		}
+		if name != c.name {
+			t.Errorf("Incorrect project name for '%v', got: '%s', wanted: '%s'", c.defFiles, name, c.name)
+		}
+	}
+}
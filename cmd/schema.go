@@ -0,0 +1,55 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+	schemaCmd.Flags().StringVarP(&schemaOutput, "output", "o", "", "Write the schema to this file instead of stdout")
+}
+
+var (
+	schemaOutput string
+)
+
+var schemaCmd = &cobra.Command{
+	Use:       "schema [definition|environment]",
+	Short:     fmt.Sprintf("Prints the JSON Schema of %s or %s for editor integration", gantry.GantryDef, gantry.GantryEnv),
+	Args:      cobra.MaximumNArgs(1),
+	ValidArgs: []string{"definition", "environment"},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kind := "definition"
+		if len(args) > 0 {
+			kind = args[0]
+		}
+		var schema gantry.Schema
+		switch kind {
+		case "definition":
+			schema = gantry.DefinitionSchema()
+		case "environment":
+			schema = gantry.EnvironmentSchema()
+		default:
+			return fmt.Errorf("unknown schema '%s', use 'definition' or 'environment'", kind)
+		}
+		data, err := json.MarshalIndent(schema, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if schemaOutput != "" {
+			return ioutil.WriteFile(schemaOutput, data, 0644)
+		}
+		_, err = cmd.OutOrStdout().Write(data)
+		return err
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+}
@@ -0,0 +1,74 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/ad-freiburg/gantry/types"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [flags]",
+	Short: fmt.Sprintf("Validates %s and %s against their schemas", gantry.GantryDef, gantry.GantryEnv),
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		env := types.StringMap{}
+		for _, v := range environment {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) == 1 {
+				env[parts[0]] = nil
+			} else {
+				env[parts[0]] = &parts[1]
+			}
+		}
+		environment, err := gantry.NewPipelineEnvironment(envFiles, env, types.StringSet{}, types.StringSet{})
+		problems := environment.Problems
+		if err != nil {
+			if e, ok := err.(*os.PathError); !ok || e.Err != syscall.ENOENT {
+				printProblems(cmd, problems)
+				return err
+			}
+		}
+		paths := defFiles
+		if len(paths) == 0 {
+			for _, path := range []string{gantry.GantryDef, gantry.DockerCompose} {
+				if _, err := os.Stat(path); err == nil {
+					paths = []string{path}
+					break
+				}
+			}
+		}
+		if len(paths) == 0 {
+			return fmt.Errorf("neither %s nor %s found", gantry.GantryDef, gantry.DockerCompose)
+		}
+		for _, path := range paths {
+			definitionProblems, err := gantry.ValidateDefinition(path, environment)
+			if err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			problems = append(problems, definitionProblems...)
+		}
+		printProblems(cmd, problems)
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problem(s)", len(problems))
+		}
+		return nil
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+}
+
+func printProblems(cmd *cobra.Command, problems []gantry.ValidationError) {
+	for _, problem := range problems {
+		fmt.Fprintln(cmd.OutOrStdout(), problem)
+	}
+}
@@ -0,0 +1,66 @@
+package cmd // import "github.com/ad-freiburg/gantry/cmd"
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/spf13/cobra"
+)
+
+var cleanAllWorkspaces bool
+
+func init() {
+	workspacesCleanCmd.Flags().BoolVar(&cleanAllWorkspaces, "all", false, "Clean persistent workspaces as well")
+	workspacesCmd.AddCommand(workspacesLsCmd)
+	workspacesCmd.AddCommand(workspacesCleanCmd)
+	rootCmd.AddCommand(workspacesCmd)
+}
+
+var workspacesCmd = &cobra.Command{
+	Use:   "workspaces",
+	Short: "Manages the workspaces of the pipeline",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Arguments are workspaces, not steps to select
+		return rootCmd.PersistentPreRunE(cmd, []string{})
+	},
+}
+
+var workspacesLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "Lists all workspaces and their directories",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names := make([]string, 0, len(pipeline.Definition.Workspaces))
+		for name := range pipeline.Definition.Workspaces {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			lifecycle := pipeline.Definition.Workspaces[name].Lifecycle
+			if lifecycle == "" {
+				lifecycle = "run"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s (%s)\n", name, lifecycle)
+			dirs, err := pipeline.WorkspaceDirs(name)
+			if err != nil {
+				return err
+			}
+			for _, dir := range dirs {
+				fmt.Fprintf(cmd.OutOrStdout(), "  %s\n", dir)
+			}
+		}
+		return nil
+	},
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+}
+
+var workspacesCleanCmd = &cobra.Command{
+	Use:   "clean [flags] [Workspace...]",
+	Short: "Removes the directories of workspaces, all but persistent ones by default",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := pipeline.CreateNetwork(); err != nil {
+			log.Printf("Error creating network: %s", err)
+		}
+		return pipeline.CleanWorkspaces(args, cleanAllWorkspaces)
+	},
+}
@@ -0,0 +1,467 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ad-freiburg/gantry/preprocessor"
+	"github.com/ghodss/yaml"
+)
+
+// definitionSections lists all top level keys storing steps or services.
+var definitionSections = []string{"services", "steps"}
+
+// extendsNotInherited lists all keys never copied from an extended definition.
+var extendsNotInherited = []string{"after", "depends_on", "extends"}
+
+// mergeReplacedKeys lists all keys for which values are replaced instead of
+// merged.
+var mergeReplacedKeys = []string{"command", "entrypoint"}
+
+// mergeMappingKeys lists all keys which can be given as mapping or as list of
+// key=value pairs.
+var mergeMappingKeys = []string{"args", "environment", "labels"}
+
+// definitionLoader reads and preprocesses definition files and resolves
+// references between them.
+type definitionLoader struct {
+	env      *PipelineEnvironment
+	preproc  preprocessor.Preprocessor
+	files    map[string]map[string]interface{}
+	resolved map[string]map[string]interface{}
+	visiting map[string]bool
+	problems []ValidationError
+	// fileEnv preprocesses all files of the loaded pipeline, prefix is its
+	// namespace if it is included. including stores the files currently
+	// including others and is shared with the loaders of included pipelines.
+	fileEnv   preprocessor.Environment
+	prefix    string
+	including map[string]bool
+	// instances stores the instances of matrix steps of all pipelines
+	// included by a file, named relative to that file.
+	instances map[string]map[string][]string
+	// dirs stores the directories of the files defining included steps and
+	// services.
+	dirs map[string]string
+}
+
+// newDefinitionLoader returns a definitionLoader using env for preprocessing.
+func newDefinitionLoader(env *PipelineEnvironment) (*definitionLoader, error) {
+	preproc, err := preprocessor.NewPreprocessor()
+	if err != nil {
+		return nil, err
+	}
+	preproc.Strict = env.StrictSubstitution
+	preproc.DisableCommands = env.DisableCommands
+	return &definitionLoader{
+		env:       env,
+		preproc:   preproc,
+		files:     map[string]map[string]interface{}{},
+		resolved:  map[string]map[string]interface{}{},
+		visiting:  map[string]bool{},
+		fileEnv:   env,
+		including: map[string]bool{},
+		instances: map[string]map[string][]string{},
+		dirs:      map[string]string{},
+	}, nil
+}
+
+// Load returns the preprocessed definition stored at path with all extends
+// resolved.
+func (l *definitionLoader) Load(path string) (map[string]interface{}, error) {
+	doc, err := l.read(path)
+	if err != nil {
+		return nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]interface{}{}
+	for key, value := range doc {
+		result[key] = value
+	}
+	for _, section := range definitionSections {
+		definitions, ok := doc[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resolved := map[string]interface{}{}
+		for name := range definitions {
+			definition, err := l.definition(abs, name)
+			if err != nil {
+				return nil, err
+			}
+			resolved[name] = definition
+		}
+		result[section] = resolved
+	}
+	if err := l.include(abs, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// read returns the raw preprocessed definition stored at path. Each file is
+// only read and preprocessed once.
+func (l *definitionLoader) read(path string) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if doc, ok := l.files[abs]; ok {
+		return doc, nil
+	}
+	// Apply environment to yaml
+	data, lines, err := l.preproc.ProcessFileLines(abs, l.fileEnv)
+	if err != nil {
+		if os.IsNotExist(err) {
+			pipelineLogger.Println("Could not open pipeline definition.")
+		}
+		return nil, err
+	}
+	problems, err := validateYAML(data, lines, path, DefinitionSchema())
+	if err != nil {
+		return nil, err
+	}
+	l.problems = append(l.problems, problems...)
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = map[string]interface{}{}
+	}
+	resolveSecretFiles(doc, filepath.Dir(abs))
+	l.files[abs] = doc
+	return doc, nil
+}
+
+// definition returns the definition of the step or service name stored in the
+// file at path with all extends resolved.
+func (l *definitionLoader) definition(path string, name string) (map[string]interface{}, error) {
+	key := fmt.Sprintf("%s:%s", path, name)
+	if definition, ok := l.resolved[key]; ok {
+		return definition, nil
+	}
+	if l.visiting[key] {
+		return nil, fmt.Errorf("cyclic extends found for '%s' in '%s'", name, path)
+	}
+	l.visiting[key] = true
+	defer delete(l.visiting, key)
+
+	doc, err := l.read(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	found := false
+	for _, section := range definitionSections {
+		definitions, ok := doc[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if raw, found = definitions[name]; found {
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no such service or step '%s' in '%s'", name, path)
+	}
+	definition := map[string]interface{}{}
+	if raw != nil {
+		if definition, found = raw.(map[string]interface{}); !found {
+			return nil, fmt.Errorf("invalid definition of '%s' in '%s'", name, path)
+		}
+	}
+	extends, ok := definition["extends"]
+	if !ok {
+		l.resolved[key] = definition
+		return definition, nil
+	}
+
+	// Determine extended definition
+	parentName, parentPath, err := parseExtends(extends, path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extends for '%s' in '%s': %s", name, path, err)
+	}
+	parent, err := l.definition(parentPath, parentName)
+	if err != nil {
+		return nil, err
+	}
+	base := map[string]interface{}{}
+	for k, v := range parent {
+		base[k] = v
+	}
+	for _, k := range extendsNotInherited {
+		delete(base, k)
+	}
+	override := map[string]interface{}{}
+	for k, v := range definition {
+		if k != "extends" {
+			override[k] = v
+		}
+	}
+	merged, err := mergeDefinitionValues(nil, base, override)
+	if err != nil {
+		return nil, fmt.Errorf("could not extend '%s' in '%s': %s", name, path, err)
+	}
+	result := merged.(map[string]interface{})
+	l.resolved[key] = result
+	return result, nil
+}
+
+// parseExtends returns the name and the absolute file path of the definition
+// referenced by an extends value. Relative files are resolved from the
+// directory of path.
+func parseExtends(extends interface{}, path string) (string, string, error) {
+	switch v := extends.(type) {
+	case string:
+		return v, path, nil
+	case map[string]interface{}:
+		name, ok := v["service"].(string)
+		if !ok || name == "" {
+			return "", "", fmt.Errorf("missing 'service'")
+		}
+		file, ok := v["file"].(string)
+		if !ok || file == "" {
+			return name, path, nil
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		return name, file, nil
+	}
+	return "", "", fmt.Errorf("expected string or mapping")
+}
+
+// mergeDefinitionValues merges override into base using the compose merge
+// rules: mappings are merged recursively, sequences are concatenated and
+// scalars are replaced. The path of the values is used to select the rules and
+// to report errors. Neither base nor override are modified.
+func mergeDefinitionValues(path []string, base interface{}, override interface{}) (interface{}, error) {
+	key := ""
+	if len(path) > 0 {
+		key = path[len(path)-1]
+	}
+	if override == nil {
+		return base, nil
+	}
+	if base == nil || containsString(mergeReplacedKeys, key) {
+		return override, nil
+	}
+	isMapping := containsString(mergeMappingKeys, key)
+	if isMapping {
+		base = mappingFromKeyValueList(base)
+		override = mappingFromKeyValueList(override)
+	}
+	switch o := override.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return nil, &mergeError{path: path, base: valueKind(base), override: valueKind(override)}
+		}
+		result := map[string]interface{}{}
+		for k, v := range b {
+			result[k] = v
+		}
+		for k, v := range o {
+			// Entries without value like 'FOO:' or '- FOO' replace
+			// inherited values
+			if isMapping && v == nil {
+				result[k] = nil
+				continue
+			}
+			merged, err := mergeDefinitionValues(append(path[:len(path):len(path)], k), result[k], v)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = merged
+		}
+		return result, nil
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok {
+			return nil, &mergeError{path: path, base: valueKind(base), override: valueKind(override)}
+		}
+		result := make([]interface{}, 0, len(b)+len(o))
+		index := map[string]int{}
+		for _, list := range [][]interface{}{b, o} {
+			for _, v := range list {
+				entryKey := sequenceEntryKey(key, v)
+				if i, found := index[entryKey]; found {
+					result[i] = v
+					continue
+				}
+				index[entryKey] = len(result)
+				result = append(result, v)
+			}
+		}
+		return result, nil
+	}
+	switch base.(type) {
+	case map[string]interface{}, []interface{}:
+		return nil, &mergeError{path: path, base: valueKind(base), override: valueKind(override)}
+	}
+	return override, nil
+}
+
+// mergeDefinitions merges the definitions docs loaded from files in order.
+// Later files override scalars and extend sequences and mappings of earlier
+// ones. The file each value was last defined in is returned by its dotted
+// path.
+func mergeDefinitions(docs []map[string]interface{}, files []string) (map[string]interface{}, map[string]string, error) {
+	result := map[string]interface{}{}
+	origins := map[string]string{}
+	for i, doc := range docs {
+		for key, value := range doc {
+			var merged interface{}
+			var err error
+			if containsString(definitionSections, key) {
+				merged, err = mergeDefinitionSection(key, result[key], value)
+			} else {
+				merged, err = mergeDefinitionValues([]string{key}, result[key], value)
+			}
+			if err != nil {
+				if e, ok := err.(*mergeError); ok {
+					e.baseFile = origins[strings.Join(e.path, ".")]
+					e.overrideFile = files[i]
+				}
+				return nil, nil, err
+			}
+			result[key] = merged
+		}
+		recordDefinitionOrigins(origins, nil, doc, files[i])
+	}
+	// Names must be unique across steps and services
+	steps, _ := result["steps"].(map[string]interface{})
+	services, _ := result["services"].(map[string]interface{})
+	for name := range steps {
+		if _, found := services[name]; found {
+			return nil, nil, fmt.Errorf("duplicate step/service '%s': service in '%s', step in '%s'", name, origins["services."+name], origins["steps."+name])
+		}
+	}
+	return result, origins, nil
+}
+
+// mergeDefinitionSection merges the steps or services stored in override
+// into base. Each definition is merged separately as names of steps and
+// services are not subject to merge rules.
+func mergeDefinitionSection(section string, base interface{}, override interface{}) (interface{}, error) {
+	if base == nil || override == nil {
+		return mergeDefinitionValues([]string{section}, base, override)
+	}
+	b, okBase := base.(map[string]interface{})
+	o, okOverride := override.(map[string]interface{})
+	if !okBase || !okOverride {
+		return nil, &mergeError{path: []string{section}, base: valueKind(base), override: valueKind(override)}
+	}
+	result := map[string]interface{}{}
+	for name, definition := range b {
+		result[name] = definition
+	}
+	for name, definition := range o {
+		merged, err := mergeDefinitionValues(nil, result[name], definition)
+		if err != nil {
+			if e, ok := err.(*mergeError); ok {
+				e.path = append([]string{section, name}, e.path...)
+			}
+			return nil, err
+		}
+		result[name] = merged
+	}
+	return result, nil
+}
+
+// recordDefinitionOrigins stores file as origin for all keys of value.
+func recordDefinitionOrigins(origins map[string]string, path []string, value interface{}, file string) {
+	mapping, ok := value.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for k, v := range mapping {
+		p := append(path[:len(path):len(path)], k)
+		origins[strings.Join(p, ".")] = file
+		recordDefinitionOrigins(origins, p, v, file)
+	}
+}
+
+// mergeError is returned if values of different kinds are merged.
+type mergeError struct {
+	path         []string
+	base         string
+	override     string
+	baseFile     string
+	overrideFile string
+}
+
+// Error returns the string representation of the error.
+func (e *mergeError) Error() string {
+	base := e.base
+	if e.baseFile != "" {
+		base = fmt.Sprintf("%s in '%s'", e.base, e.baseFile)
+	}
+	override := e.override
+	if e.overrideFile != "" {
+		override = fmt.Sprintf("%s in '%s'", e.override, e.overrideFile)
+	}
+	return fmt.Sprintf("incompatible values for '%s': %s and %s", strings.Join(e.path, "."), base, override)
+}
+
+// sequenceEntryKey returns the identity of a sequence entry, entries with the
+// same identity replace each other when merged. Volumes are identified by
+// their mount point inside the container.
+func sequenceEntryKey(key string, value interface{}) string {
+	if s, ok := value.(string); ok && key == "volumes" {
+		parts := strings.Split(s, ":")
+		if len(parts) > 1 {
+			return parts[1]
+		}
+	}
+	return fmt.Sprintf("%#v", value)
+}
+
+// mappingFromKeyValueList converts a list of key=value strings into a
+// mapping, all other values are returned as is.
+func mappingFromKeyValueList(value interface{}) interface{} {
+	list, ok := value.([]interface{})
+	if !ok {
+		return value
+	}
+	result := map[string]interface{}{}
+	for _, entry := range list {
+		s, ok := entry.(string)
+		if !ok {
+			return value
+		}
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) == 1 {
+			result[parts[0]] = nil
+		} else {
+			result[parts[0]] = parts[1]
+		}
+	}
+	return result
+}
+
+// valueKind returns a human readable kind of a parsed yaml value.
+func valueKind(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "mapping"
+	case []interface{}:
+		return "sequence"
+	}
+	return "scalar"
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
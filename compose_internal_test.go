@@ -0,0 +1,285 @@
+package gantry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestMergeDefinitionValues(t *testing.T) {
+	cases := []struct {
+		key      string
+		base     interface{}
+		override interface{}
+		result   interface{}
+		err      string
+	}{
+		{"image", "alpine", "debian", "debian", ""},
+		{"image", "alpine", nil, "alpine", ""},
+		{"image", nil, "debian", "debian", ""},
+		{"command", []interface{}{"ls"}, []interface{}{"pwd"}, []interface{}{"pwd"}, ""},
+		{"ports", []interface{}{"80:80"}, []interface{}{"81:81", "80:80"}, []interface{}{"80:80", "81:81"}, ""},
+		{"volumes", []interface{}{"/a:/data", "/b:/b"}, []interface{}{"/c:/data:ro"}, []interface{}{"/c:/data:ro", "/b:/b"}, ""},
+		{"environment", []interface{}{"A=a", "B=b"}, map[string]interface{}{"B": "c"}, map[string]interface{}{"A": "a", "B": "c"}, ""},
+		{"build", map[string]interface{}{"context": ".", "args": map[string]interface{}{"A": "a"}}, map[string]interface{}{"args": []interface{}{"B=b"}}, map[string]interface{}{"context": ".", "args": map[string]interface{}{"A": "a", "B": "b"}}, ""},
+		{"environment", map[string]interface{}{"A": "a", "B": "b"}, map[string]interface{}{"A": nil}, map[string]interface{}{"A": nil, "B": "b"}, ""},
+		{"environment", []interface{}{"A=a", "B=b"}, []interface{}{"B"}, map[string]interface{}{"A": "a", "B": nil}, ""},
+		{"build", map[string]interface{}{"args": map[string]interface{}{"A": "a"}}, map[string]interface{}{"args": []interface{}{"A"}}, map[string]interface{}{"args": map[string]interface{}{"A": nil}}, ""},
+		{"build", map[string]interface{}{"context": "."}, map[string]interface{}{"context": nil}, map[string]interface{}{"context": "."}, ""},
+		{"ports", []interface{}{"80:80"}, "80:80", nil, "incompatible values for 'ports': sequence and scalar"},
+		{"build", ".", map[string]interface{}{"context": "."}, nil, "incompatible values for 'build': scalar and mapping"},
+	}
+
+	for _, c := range cases {
+		r, err := mergeDefinitionValues([]string{c.key}, c.base, c.override)
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Incorrect error for '%s', got: '%v', wanted: '%s'", c.key, err, c.err)
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(r, c.result) {
+			t.Errorf("Incorrect result for '%s', got: '%#v', wanted: '%#v'", c.key, r, c.result)
+		}
+	}
+}
+
+func TestNewPipelineDefinitionExtends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extends")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "common.yml"), []byte(`services:
+  base:
+    image: alpine
+    environment:
+      A: a
+    volumes:
+      - /tmp:/data
+`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, GantryDef), []byte(`version: "2.0"
+x-common: &common
+  image: debian
+  environment:
+    C: c
+steps:
+  a:
+    extends:
+      service: base
+      file: common.yml
+    environment:
+      B: b
+  b:
+    extends: a
+    after:
+      - a
+    x-gantry:
+      ignore_failure: true
+      exit_code_override: 3
+  c:
+    <<: *common
+    after:
+      - b
+`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	env := &PipelineEnvironment{
+		Substitutions: types.StringMap{},
+		Steps:         ServiceMetaList{},
+		tempPaths:     map[string]string{},
+	}
+	d, err := NewPipelineDefinition([]string{filepath.Join(dir, GantryDef)}, env)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%s'", err)
+	}
+	a, b := "a", "b"
+	cases := []struct {
+		name        string
+		image       string
+		environment types.StringMap
+		volumes     []string
+		after       types.StringSet
+	}{
+		{"a", "alpine", types.StringMap{"A": &a, "B": &b}, []string{"/tmp:/data"}, nil},
+		{"b", "alpine", types.StringMap{"A": &a, "B": &b}, []string{"/tmp:/data"}, types.StringSet{"a": true}},
+	}
+	for _, c := range cases {
+		step := d.Steps[c.name]
+		if step.Image != c.image {
+			t.Errorf("Incorrect image for '%s', got: '%s', wanted: '%s'", c.name, step.Image, c.image)
+		}
+		if !reflect.DeepEqual(step.Environment, c.environment) {
+			t.Errorf("Incorrect environment for '%s', got: '%#v', wanted: '%#v'", c.name, step.Environment, c.environment)
+		}
+		if !reflect.DeepEqual(step.Volumes, c.volumes) {
+			t.Errorf("Incorrect volumes for '%s', got: '%#v', wanted: '%#v'", c.name, step.Volumes, c.volumes)
+		}
+		if !reflect.DeepEqual(step.After, c.after) {
+			t.Errorf("Incorrect after for '%s', got: '%#v', wanted: '%#v'", c.name, step.After, c.after)
+		}
+	}
+	if d.Steps["c"].Image != "debian" {
+		t.Errorf("Incorrect image for 'c', got: '%s', wanted: 'debian'", d.Steps["c"].Image)
+	}
+	if !d.Steps["b"].Meta.IgnoreFailure || d.Steps["b"].Meta.ExitCodeOverride != 3 {
+		t.Errorf("Incorrect meta for 'b', got: '%#v'", d.Steps["b"].Meta)
+	}
+	if d.Steps["b"].Meta.KeepAlive != KeepAliveNo {
+		t.Errorf("Incorrect KeepAlive for 'b', got: '%d', wanted: '%d'", d.Steps["b"].Meta.KeepAlive, KeepAliveNo)
+	}
+}
+
+func TestNewPipelineDefinitionExtendsErrors(t *testing.T) {
+	cases := []struct {
+		def string
+		err string
+	}{
+		{`steps:
+  a:
+    extends: b
+  b:
+    extends: a
+`, "cyclic extends found for"},
+		{`steps:
+  a:
+    extends: c
+`, "no such service or step 'c'"},
+		{`steps:
+  a:
+    extends:
+      file: other.yml
+`, "invalid extends for 'a'"},
+	}
+
+	env := &PipelineEnvironment{
+		Substitutions: types.StringMap{},
+		Steps:         ServiceMetaList{},
+		tempPaths:     map[string]string{},
+	}
+	for _, c := range cases {
+		tmpDef, err := ioutil.TempFile("", "def")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(tmpDef.Name())
+		if err := ioutil.WriteFile(tmpDef.Name(), []byte(c.def), 0644); err != nil {
+			log.Fatal(err)
+		}
+		_, err = NewPipelineDefinition([]string{tmpDef.Name()}, env)
+		if err == nil {
+			t.Errorf("Missing error for '%s', wanted: '%s'", c.def, c.err)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), c.err) {
+			t.Errorf("Incorrect error for '%s', got: '%s', wanted: '%s'", c.def, err, c.err)
+		}
+	}
+}
+
+func TestMergeDefinitions(t *testing.T) {
+	cases := []struct {
+		docs   []string
+		result string
+		err    string
+	}{
+		{
+			[]string{`{"version": "2.0", "steps": {"a": {"image": "alpine", "ports": ["80:80"]}}}`, `{"version": "2.1", "steps": {"a": {"ports": ["81:81"]}, "b": {"image": "debian"}}}`},
+			`{"version": "2.1", "steps": {"a": {"image": "alpine", "ports": ["80:80", "81:81"]}, "b": {"image": "debian"}}}`,
+			"",
+		},
+		{
+			[]string{`{"steps": {"command": {"command": "ls", "environment": ["A=a"]}}}`, `{"steps": {"command": {"command": "pwd", "environment": {"B": "b"}}}}`},
+			`{"steps": {"command": {"command": "pwd", "environment": {"A": "a", "B": "b"}}}}`,
+			"",
+		},
+		{
+			[]string{`{"steps": {"a": {"ports": ["80:80"]}}}`, `{"steps": {"b": {}}}`, `{"steps": {"a": {"ports": "81:81"}}}`},
+			"",
+			"incompatible values for 'steps.a.ports': sequence in 'base.yml' and scalar in 'ci.yml'",
+		},
+		{
+			[]string{`{"services": {"a": {}}}`, `{"steps": {"a": {}}}`, `{}`},
+			"",
+			"duplicate step/service 'a': service in 'base.yml', step in 'other.yml'",
+		},
+	}
+	files := []string{"base.yml", "other.yml", "ci.yml"}
+
+	for i, c := range cases {
+		docs := make([]map[string]interface{}, len(c.docs))
+		for j, d := range c.docs {
+			if err := json.Unmarshal([]byte(d), &docs[j]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		r, _, err := mergeDefinitions(docs, files[:len(docs)])
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Incorrect error@%d, got: '%v', wanted: '%s'", i, err, c.err)
+		}
+		if err != nil {
+			continue
+		}
+		var result map[string]interface{}
+		if err := json.Unmarshal([]byte(c.result), &result); err != nil {
+			log.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, result) {
+			t.Errorf("Incorrect result@%d, got: '%#v', wanted: '%#v'", i, r, result)
+		}
+	}
+}
+
+func TestNewPipelineDefinitionMultipleFiles(t *testing.T) {
+	tmpBase, tmpOverlay := setupDefAndEnv(`version: "2.0"
+steps:
+  a:
+    image: alpine
+    environment:
+      A: a
+  b:
+    image: alpine
+    after:
+      - a
+`, `steps:
+  a:
+    image: debian
+  b:
+    after:
+      - c
+  c:
+    image: alpine
+`)
+	defer os.Remove(tmpBase)
+	defer os.Remove(tmpOverlay)
+	env := &PipelineEnvironment{
+		Substitutions: types.StringMap{},
+		Steps:         ServiceMetaList{},
+		tempPaths:     map[string]string{},
+	}
+	d, err := NewPipelineDefinition([]string{tmpBase, tmpOverlay}, env)
+	if err != nil {
+		t.Fatalf("Unexpected error: '%s'", err)
+	}
+	if len(d.Steps) != 3 {
+		t.Errorf("Incorrect number of steps, got: '%d', wanted: '%d'", len(d.Steps), 3)
+	}
+	if d.Steps["a"].Image != "debian" {
+		t.Errorf("Incorrect image for 'a', got: '%s', wanted: 'debian'", d.Steps["a"].Image)
+	}
+	if a := d.Steps["a"].Environment["A"]; a == nil || *a != "a" {
+		t.Errorf("Incorrect environment for 'a', got: '%#v'", d.Steps["a"].Environment)
+	}
+	if after := (types.StringSet{"a": true, "c": true}); !reflect.DeepEqual(d.Steps["b"].After, after) {
+		t.Errorf("Incorrect after for 'b', got: '%#v', wanted: '%#v'", d.Steps["b"].After, after)
+	}
+}
@@ -0,0 +1,350 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/ad-freiburg/gantry/preprocessor"
+)
+
+// conditionTrue is the value of true conditions, false conditions are empty.
+const conditionTrue string = "true"
+
+// Condition is a parsed `when:` expression of a step. Expressions support
+// string literals in single or double quotes, references, tests, comparisons
+// and boolean operators:
+//
+//	sub.NAME, env.NAME    value of a substitution or host environment variable
+//	git.branch            current branch of the git repository of the
+//	                      definition
+//	exists(p), file(p),   whether path p exists, is a regular file or a
+//	dir(p)                directory, relative to the directory of the
+//	                      definition
+//	a == b, a != b        string comparison
+//	!a, a && b, a || b    boolean operators, empty values are false
+//	true, false, ( )      constants and grouping
+type Condition struct {
+	expression string
+	root       conditionNode
+}
+
+// conditionNode is a node of the syntax tree of a Condition.
+type conditionNode interface {
+	eval(c *conditionContext) (string, error)
+}
+
+// conditionContext provides the values of references. Relative paths are
+// resolved from dir.
+type conditionContext struct {
+	env    preprocessor.Environment
+	dir    string
+	branch *string
+}
+
+// conditionFunctions are the file tests usable in conditions.
+var conditionFunctions = map[string]func(os.FileInfo) bool{
+	"exists": func(fi os.FileInfo) bool { return true },
+	"file":   func(fi os.FileInfo) bool { return fi.Mode().IsRegular() },
+	"dir":    func(fi os.FileInfo) bool { return fi.IsDir() },
+}
+
+// ParseCondition parses expression into a Condition.
+func ParseCondition(expression string) (*Condition, error) {
+	tokens, err := tokenizeCondition(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition '%s': %s", expression, err)
+	}
+	p := &conditionParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected '%s'", p.tokens[p.pos].value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition '%s': %s", expression, err)
+	}
+	return &Condition{expression: expression, root: root}, nil
+}
+
+// Evaluate returns whether c is true using the substitutions of env, relative
+// paths are resolved from dir.
+func (c Condition) Evaluate(env preprocessor.Environment, dir string) (bool, error) {
+	value, err := c.root.eval(&conditionContext{env: env, dir: dir})
+	if err != nil {
+		return false, fmt.Errorf("could not evaluate condition '%s': %s", c.expression, err)
+	}
+	return value != "", nil
+}
+
+// String returns the expression of c.
+func (c Condition) String() string {
+	return c.expression
+}
+
+type conditionToken struct {
+	kind  byte // one of 'o'perator, 's'tring, 'i'dentifier
+	value string
+}
+
+// conditionOperators lists all operators, longer operators first.
+var conditionOperators = []string{"&&", "||", "==", "!=", "!", "(", ")"}
+
+func tokenizeCondition(s string) ([]conditionToken, error) {
+	tokens := []conditionToken{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			tokens = append(tokens, conditionToken{'s', s[i+1 : i+1+end]})
+			i += end + 2
+			continue
+		case isConditionIdentifierChar(c):
+			end := i
+			for end < len(s) && isConditionIdentifierChar(s[end]) {
+				end++
+			}
+			tokens = append(tokens, conditionToken{'i', s[i:end]})
+			i = end
+			continue
+		}
+		found := false
+		for _, op := range conditionOperators {
+			if strings.HasPrefix(s[i:], op) {
+				tokens = append(tokens, conditionToken{'o', op})
+				i += len(op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unexpected character '%c' at position %d", c, i+1)
+		}
+	}
+	return tokens, nil
+}
+
+func isConditionIdentifierChar(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+type conditionParser struct {
+	tokens []conditionToken
+	pos    int
+}
+
+// accept consumes the next token if it is the operator op.
+func (p *conditionParser) accept(op string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'o' && p.tokens[p.pos].value == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) expect(op string) error {
+	if !p.accept(op) {
+		if p.pos < len(p.tokens) {
+			return fmt.Errorf("expected '%s', got '%s'", op, p.tokens[p.pos].value)
+		}
+		return fmt.Errorf("expected '%s' at end of expression", op)
+	}
+	return nil
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right conditionNode
+		right, err = p.parseAnd()
+		left = conditionBinary{"||", left, right}
+	}
+	return left, err
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseComparison()
+	for err == nil && p.accept("&&") {
+		var right conditionNode
+		right, err = p.parseComparison()
+		left = conditionBinary{"&&", left, right}
+	}
+	return left, err
+}
+
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!="} {
+		if p.accept(op) {
+			right, err := p.parseUnary()
+			return conditionBinary{op, left, right}, err
+		}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		return conditionNot{operand}, err
+	}
+	if p.accept("(") {
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return node, p.expect(")")
+	}
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case 's':
+		return conditionLiteral(token.value), nil
+	case 'o':
+		return nil, fmt.Errorf("unexpected '%s'", token.value)
+	}
+	if test, found := conditionFunctions[token.value]; found {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		argument, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return conditionFileTest{test, argument}, p.expect(")")
+	}
+	switch token.value {
+	case "true":
+		return conditionLiteral(conditionTrue), nil
+	case "false":
+		return conditionLiteral(""), nil
+	case "git.branch":
+		return conditionBranch{}, nil
+	}
+	parts := strings.SplitN(token.value, ".", 2)
+	if len(parts) == 2 && parts[1] != "" && (parts[0] == "sub" || parts[0] == "env") {
+		return conditionReference{parts[0], parts[1]}, nil
+	}
+	return nil, fmt.Errorf("unknown identifier '%s'", token.value)
+}
+
+type conditionLiteral string
+
+func (n conditionLiteral) eval(c *conditionContext) (string, error) {
+	return string(n), nil
+}
+
+type conditionReference struct {
+	scope string
+	name  string
+}
+
+func (n conditionReference) eval(c *conditionContext) (string, error) {
+	if n.scope == "env" {
+		return os.Getenv(n.name), nil
+	}
+	if val, found := c.env.GetSubstitution(n.name); found && val != nil {
+		return *val, nil
+	}
+	return "", nil
+}
+
+type conditionBranch struct{}
+
+func (n conditionBranch) eval(c *conditionContext) (string, error) {
+	if c.branch == nil {
+		cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+		cmd.Dir = c.dir
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("could not determine git branch: %s", err)
+		}
+		branch := strings.TrimSpace(string(output))
+		c.branch = &branch
+	}
+	return *c.branch, nil
+}
+
+type conditionNot struct {
+	operand conditionNode
+}
+
+func (n conditionNot) eval(c *conditionContext) (string, error) {
+	value, err := n.operand.eval(c)
+	if err != nil || value != "" {
+		return "", err
+	}
+	return conditionTrue, nil
+}
+
+type conditionBinary struct {
+	operator string
+	left     conditionNode
+	right    conditionNode
+}
+
+func (n conditionBinary) eval(c *conditionContext) (string, error) {
+	left, err := n.left.eval(c)
+	if err != nil {
+		return "", err
+	}
+	// Short circuit boolean operators
+	if (n.operator == "&&" && left == "") || (n.operator == "||" && left != "") {
+		return left, nil
+	}
+	right, err := n.right.eval(c)
+	if err != nil {
+		return "", err
+	}
+	switch n.operator {
+	case "==":
+		return conditionBool(left == right), nil
+	case "!=":
+		return conditionBool(left != right), nil
+	}
+	return right, nil
+}
+
+type conditionFileTest struct {
+	test     func(os.FileInfo) bool
+	argument conditionNode
+}
+
+func (n conditionFileTest) eval(c *conditionContext) (string, error) {
+	path, err := n.argument.eval(c)
+	if err != nil {
+		return "", err
+	}
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(c.dir, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return conditionBool(n.test(fi)), nil
+}
+
+func conditionBool(b bool) string {
+	if b {
+		return conditionTrue
+	}
+	return ""
+}
@@ -0,0 +1,93 @@
+package gantry_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestConditionEvaluate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "condition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	main := "main"
+	empty := ""
+	env, err := gantry.NewPipelineEnvironment([]string{""}, types.StringMap{"BRANCH": &main, "EMPTY": &empty, "NIL": nil}, types.StringSet{}, types.StringSet{})
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	os.Setenv("GANTRY_CONDITION_TEST", "yes")
+	defer os.Unsetenv("GANTRY_CONDITION_TEST")
+
+	cases := []struct {
+		expression string
+		result     bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"sub.BRANCH", true},
+		{"sub.EMPTY", false},
+		{"sub.NIL", false},
+		{"sub.UNSET", false},
+		{"!sub.UNSET", true},
+		{"sub.BRANCH == 'main'", true},
+		{`sub.BRANCH != "main"`, false},
+		{"env.GANTRY_CONDITION_TEST == 'yes'", true},
+		{"env.GANTRY_CONDITION_UNSET", false},
+		{"exists('" + file + "')", true},
+		{"file('" + file + "')", true},
+		{"dir('" + file + "')", false},
+		{"dir('" + dir + "')", true},
+		{"!exists('" + filepath.Join(dir, "missing") + "')", true},
+		{"file('file')", true},
+		{"exists('missing')", false},
+		{"sub.EMPTY || sub.BRANCH == 'main' && !false", true},
+		{"(sub.EMPTY || sub.BRANCH) && false", false},
+		{"sub.UNSET == ''", true},
+	}
+	for _, c := range cases {
+		condition, err := gantry.ParseCondition(c.expression)
+		if err != nil {
+			t.Errorf("unexpected error for '%s': '%s'", c.expression, err)
+			continue
+		}
+		result, err := condition.Evaluate(env, dir)
+		if err != nil {
+			t.Errorf("unexpected error for '%s': '%s'", c.expression, err)
+		}
+		if result != c.result {
+			t.Errorf("incorrect result for '%s', got: '%t', wanted: '%t'", c.expression, result, c.result)
+		}
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	cases := []struct {
+		expression string
+		err        string
+	}{
+		{"", "invalid condition '': unexpected end of expression"},
+		{"sub.A ==", "invalid condition 'sub.A ==': unexpected end of expression"},
+		{"'open", "invalid condition ''open': unterminated string at position 1"},
+		{"branch == 'main'", "invalid condition 'branch == 'main'': unknown identifier 'branch'"},
+		{"(true", "invalid condition '(true': expected ')' at end of expression"},
+		{"true false", "invalid condition 'true false': unexpected 'false'"},
+		{"exists 'a'", "invalid condition 'exists 'a'': expected '(', got 'a'"},
+		{"sub.A = 'b'", "invalid condition 'sub.A = 'b'': unexpected character '=' at position 7"},
+	}
+	for _, c := range cases {
+		if _, err := gantry.ParseCondition(c.expression); err == nil || err.Error() != c.err {
+			t.Errorf("incorrect error for '%s', got: '%v', wanted: '%s'", c.expression, err, c.err)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package gantry // import "github.com/ad-freiburg/gantry"
 import (
 	"log"
 	"os"
+
+	"github.com/ad-freiburg/gantry/types"
 )
 
 // DockerCompose stores the default name of a docker compose file.
@@ -14,6 +16,21 @@ const GantryDef string = "gantry.yml"
 // GantryEnv stores the default name of a gantry environment.
 const GantryEnv string = "gantry.env.yml"
 
+// GantryLock stores the default name of the image lock file.
+const GantryLock string = "gantry.lock"
+
+// GantryOutputs stores the default name of the record of the outputs of the
+// last run.
+const GantryOutputs string = "gantry.outputs"
+
+// GantryKeyFile stores the name of the environment variable pointing to the
+// key file used to decrypt substitutions.
+const GantryKeyFile string = "GANTRY_KEY_FILE"
+
+// GantryProfiles stores the name of the environment variable listing the
+// active profiles.
+const GantryProfiles string = "GANTRY_PROFILES"
+
 var (
 	// Version of the program
 	Version = "no-version"
@@ -26,6 +43,15 @@ var (
 	// ForceWharfer is a global flag to force the usage of wharfer even
 	// if the user could use docker directly.
 	ForceWharfer = false
+	// ActiveProfiles stores the names of all enabled profiles. Steps and
+	// services in other profiles are ignored.
+	ActiveProfiles = types.StringSet{}
+	// EnvironmentProfile stores the name of the profile of the environment
+	// overriding its base values.
+	EnvironmentProfile = ""
+	// IgnoreSchemaProblems turns problems found by validating definitions and
+	// environments against their schemas into warnings.
+	IgnoreSchemaProblems = false
 )
 
 func init() {
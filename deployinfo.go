@@ -0,0 +1,95 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+// DeployInfo represents the deploy-keyword in a docker-compose.yml.
+type DeployInfo struct {
+	Resources DeployResources `json:"resources"`
+}
+
+// DeployResources represents the resources-keyword of the deploy-keyword.
+type DeployResources struct {
+	Limits       ResourceInfo `json:"limits"`
+	Reservations ResourceInfo `json:"reservations"`
+}
+
+// ResourceInfo stores limits or reservations of cpus, memory and processes.
+type ResourceInfo struct {
+	CPUs   types.StringOrNumber `json:"cpus"`
+	CPUSet string               `json:"cpuset"`
+	Memory types.StringOrNumber `json:"memory"`
+	Pids   int                  `json:"pids"`
+}
+
+// NumCPUs returns the number of cpus as float, 0 if not set.
+func (r ResourceInfo) NumCPUs() (float64, error) {
+	if r.CPUs == "" {
+		return 0, nil
+	}
+	cpus, err := strconv.ParseFloat(string(r.CPUs), 64)
+	if err != nil || cpus < 0 {
+		return 0, fmt.Errorf("invalid cpus value '%s'", r.CPUs)
+	}
+	return cpus, nil
+}
+
+// MemoryBytes returns the amount of memory in bytes, 0 if not set.
+func (r ResourceInfo) MemoryBytes() (int64, error) {
+	if r.Memory == "" {
+		return 0, nil
+	}
+	return parseByteSize(string(r.Memory))
+}
+
+// Check validates all values of r.
+func (r ResourceInfo) Check() error {
+	if _, err := r.NumCPUs(); err != nil {
+		return err
+	}
+	if _, err := r.MemoryBytes(); err != nil {
+		return err
+	}
+	if r.Pids < -1 {
+		return fmt.Errorf("invalid pids value '%d'", r.Pids)
+	}
+	return nil
+}
+
+// byteSizeUnits maps the suffixes of docker byte values to their multiplier.
+var byteSizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// parseByteSize parses docker byte values like 512m or 2gb.
+func parseByteSize(value string) (int64, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	if len(s) > 2 && strings.HasSuffix(s, "b") {
+		if _, found := byteSizeUnits[s[len(s)-2:len(s)-1]]; found {
+			s = s[:len(s)-1]
+		}
+	}
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+	multiplier, found := byteSizeUnits[s[i:]]
+	if !found || i == 0 {
+		return 0, fmt.Errorf("invalid memory value '%s'", value)
+	}
+	number, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid memory value '%s'", value)
+	}
+	return int64(number * float64(multiplier)), nil
+}
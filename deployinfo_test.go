@@ -0,0 +1,97 @@
+package gantry_test
+
+import (
+	"testing"
+
+	"github.com/ad-freiburg/gantry"
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestResourceInfoMemoryBytes(t *testing.T) {
+	cases := []struct {
+		memory types.StringOrNumber
+		result int64
+		err    string
+	}{
+		{"", 0, ""},
+		{"1024", 1024, ""},
+		{"100b", 100, ""},
+		{"1k", 1024, ""},
+		{"512m", 512 * 1024 * 1024, ""},
+		{"512M", 512 * 1024 * 1024, ""},
+		{"2g", 2 * 1024 * 1024 * 1024, ""},
+		{"2gb", 2 * 1024 * 1024 * 1024, ""},
+		{"1.5g", 3 * 512 * 1024 * 1024, ""},
+		{"g", 0, "invalid memory value 'g'"},
+		{"12x", 0, "invalid memory value '12x'"},
+		{"-1m", 0, "invalid memory value '-1m'"},
+	}
+
+	for _, c := range cases {
+		r, err := gantry.ResourceInfo{Memory: c.memory}.MemoryBytes()
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Incorrect error for '%s', got: '%v', wanted: '%s'", c.memory, err, c.err)
+		}
+		if r != c.result {
+			t.Errorf("Incorrect result for '%s', got: '%d', wanted: '%d'", c.memory, r, c.result)
+		}
+	}
+}
+
+func TestResourceInfoNumCPUs(t *testing.T) {
+	cases := []struct {
+		cpus   types.StringOrNumber
+		result float64
+		err    string
+	}{
+		{"", 0, ""},
+		{"1", 1, ""},
+		{"0.5", 0.5, ""},
+		{"half", 0, "invalid cpus value 'half'"},
+		{"-2", 0, "invalid cpus value '-2'"},
+	}
+
+	for _, c := range cases {
+		r, err := gantry.ResourceInfo{CPUs: c.cpus}.NumCPUs()
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Incorrect error for '%s', got: '%v', wanted: '%s'", c.cpus, err, c.err)
+		}
+		if r != c.result {
+			t.Errorf("Incorrect result for '%s', got: '%f', wanted: '%f'", c.cpus, r, c.result)
+		}
+	}
+}
+
+func TestServiceResourceLimits(t *testing.T) {
+	cases := []struct {
+		service      gantry.Service
+		limits       gantry.ResourceInfo
+		reservations gantry.ResourceInfo
+	}{
+		{gantry.Service{}, gantry.ResourceInfo{}, gantry.ResourceInfo{}},
+		{
+			gantry.Service{MemLimit: "1g", CPUs: "2", CPUSet: "0,1", PidsLimit: 100, MemReservation: "512m"},
+			gantry.ResourceInfo{Memory: "1g", CPUs: "2", CPUSet: "0,1", Pids: 100},
+			gantry.ResourceInfo{Memory: "512m"},
+		},
+		{
+			gantry.Service{Deploy: gantry.DeployInfo{Resources: gantry.DeployResources{Limits: gantry.ResourceInfo{Memory: "2g", CPUs: "0.5", Pids: 10}, Reservations: gantry.ResourceInfo{Memory: "1g", CPUs: "0.25"}}}},
+			gantry.ResourceInfo{Memory: "2g", CPUs: "0.5", Pids: 10},
+			gantry.ResourceInfo{Memory: "1g", CPUs: "0.25"},
+		},
+		{
+			gantry.Service{MemLimit: "1g", Deploy: gantry.DeployInfo{Resources: gantry.DeployResources{Limits: gantry.ResourceInfo{Memory: "2g", CPUs: "0.5"}}}},
+			gantry.ResourceInfo{Memory: "1g", CPUs: "0.5"},
+			gantry.ResourceInfo{},
+		},
+	}
+
+	for i, c := range cases {
+		if r := c.service.ResourceLimits(); r != c.limits {
+			t.Errorf("Incorrect limits@%d, got: '%#v', wanted: '%#v'", i, r, c.limits)
+		}
+		if r := c.service.ResourceReservations(); r != c.reservations {
+			t.Errorf("Incorrect reservations@%d, got: '%#v', wanted: '%#v'", i, r, c.reservations)
+		}
+	}
+}
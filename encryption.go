@@ -0,0 +1,128 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// Values are encrypted with age (https://age-encryption.org) for X25519
+// recipients. Encrypted values are stored as armored age files, key files use
+// the format of age-keygen.
+
+// GenerateKey returns a new encoded secret key (AGE-SECRET-KEY-1...) and its
+// public key (age1...).
+func GenerateKey() (string, string, error) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", "", err
+	}
+	return identity.String(), identity.Recipient().String(), nil
+}
+
+// PublicKeyFromSecretKey returns the encoded public key for the encoded
+// secret key.
+func PublicKeyFromSecretKey(secretKey string) (string, error) {
+	identity, err := age.ParseX25519Identity(secretKey)
+	if err != nil {
+		return "", err
+	}
+	return identity.Recipient().String(), nil
+}
+
+// ReadKeyFile returns the encoded secret key stored in the key file at path.
+// Empty lines and lines starting with # are ignored.
+func ReadKeyFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := age.ParseX25519Identity(line); err != nil {
+			return "", fmt.Errorf("invalid key file '%s': %s", path, err)
+		}
+		return line, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no secret key found in '%s'", path)
+}
+
+// WriteKeyFile stores the encoded secret key in a new file at path, readable
+// only by the current user. Existing files are not overwritten.
+func WriteKeyFile(path string, secretKey string) error {
+	publicKey, err := PublicKeyFromSecretKey(secretKey)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "# public key: %s\n%s\n", publicKey, secretKey)
+	return err
+}
+
+// IsEncryptedValue returns whether or not value is an encrypted value.
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), armor.Header)
+}
+
+// EncryptValue encrypts value for the encoded public key and returns the
+// armored result.
+func EncryptValue(value string, publicKey string) (string, error) {
+	recipient, err := age.ParseX25519Recipient(publicKey)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	armored := armor.NewWriter(&buffer)
+	w, err := age.Encrypt(armored, recipient)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(value)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	if err := armored.Close(); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// DecryptValue decrypts value, created by EncryptValue, with the encoded
+// secret key.
+func DecryptValue(value string, secretKey string) (string, error) {
+	if !IsEncryptedValue(value) {
+		return "", fmt.Errorf("not an encrypted value")
+	}
+	identity, err := age.ParseX25519Identity(secretKey)
+	if err != nil {
+		return "", err
+	}
+	r, err := age.Decrypt(armor.NewReader(strings.NewReader(strings.TrimSpace(value)+"\n")), identity)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %s", err)
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt value: %s", err)
+	}
+	return string(plain), nil
+}
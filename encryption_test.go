@@ -0,0 +1,94 @@
+package gantry_test
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age/armor"
+	"github.com/ad-freiburg/gantry"
+)
+
+func TestEncryptDecryptValue(t *testing.T) {
+	secretKey, publicKey, err := gantry.GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error generating key: '%s'", err)
+	}
+	if !strings.HasPrefix(secretKey, "AGE-SECRET-KEY-1") || !strings.HasPrefix(publicKey, "age1") {
+		t.Errorf("Incorrect key format, got: '%s', '%s'", secretKey, publicKey)
+	}
+	if derived, err := gantry.PublicKeyFromSecretKey(secretKey); err != nil || derived != publicKey {
+		t.Errorf("Incorrect public key, got: '%s', wanted: '%s'", derived, publicKey)
+	}
+	otherKey, _, err := gantry.GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error generating key: '%s'", err)
+	}
+
+	for _, value := range []string{"", "token", "multi\nline value"} {
+		encrypted, err := gantry.EncryptValue(value, publicKey)
+		if err != nil {
+			t.Errorf("unexpected error encrypting '%s': '%s'", value, err)
+			continue
+		}
+		if !gantry.IsEncryptedValue(encrypted) {
+			t.Errorf("Incorrect encrypted value for '%s', got: '%s'", value, encrypted)
+		}
+		if value != "" && strings.Contains(encrypted, value) {
+			t.Errorf("Value '%s' readable in '%s'", value, encrypted)
+		}
+		decrypted, err := gantry.DecryptValue(encrypted, secretKey)
+		if err != nil || decrypted != value {
+			t.Errorf("Incorrect decrypted value, got: '%s', wanted: '%s', error: '%v'", decrypted, value, err)
+		}
+		if _, err := gantry.DecryptValue(encrypted, otherKey); err == nil {
+			t.Errorf("Missing error decrypting '%s' with wrong key", value)
+		}
+		// Change a character of the armored body
+		pos := len(armor.Header) + 20
+		replacement := "A"
+		if encrypted[pos] == 'A' {
+			replacement = "B"
+		}
+		tampered := encrypted[:pos] + replacement + encrypted[pos+1:]
+		if _, err := gantry.DecryptValue(tampered, secretKey); err == nil {
+			t.Errorf("Missing error decrypting tampered value '%s'", tampered)
+		}
+	}
+
+	if _, err := gantry.EncryptValue("a", "invalid"); err == nil {
+		t.Errorf("Missing error for invalid public key")
+	}
+	if _, err := gantry.DecryptValue("plain", secretKey); err == nil {
+		t.Errorf("Missing error for unencrypted value")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyfile")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key.txt")
+	secretKey, _, err := gantry.GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error generating key: '%s'", err)
+	}
+	if err := gantry.WriteKeyFile(path, secretKey); err != nil {
+		t.Fatalf("unexpected error writing key file: '%s'", err)
+	}
+	if err := gantry.WriteKeyFile(path, secretKey); err == nil {
+		t.Errorf("Missing error overwriting key file")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Incorrect key file permissions, got: '%v', error: '%v'", info.Mode().Perm(), err)
+	}
+	read, err := gantry.ReadKeyFile(path)
+	if err != nil || read != secretKey {
+		t.Errorf("Incorrect key read, got: '%s', wanted: '%s', error: '%v'", read, secretKey, err)
+	}
+}
@@ -7,16 +7,28 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/ad-freiburg/gantry/preprocessor"
 	"github.com/ad-freiburg/gantry/types"
 	"github.com/ghodss/yaml"
 )
 
+// EnvironmentOriginCommandLine is the origin of values given as arguments.
+const EnvironmentOriginCommandLine string = "command line"
+
+// environmentProfileKeys are the keys a profile of an environment may override.
+var environmentProfileKeys = []string{"substitutions", "steps", "services"}
+
 type pipelineEnvironmentJSON struct {
 	Version            string          `json:"version"`
 	Substitutions      types.StringMap `json:"substitutions"`
 	TempDirPath        string          `json:"tempdir"`
 	TempDirNoAutoClean bool            `json:"tempdir_no_autoclean"`
+	StrictSubstitution bool            `json:"strict_substitution"`
+	ImageTagTemplate   string          `json:"image_tag_template"`
+	ChownOutputs       bool            `json:"chown_outputs"`
+	DisableCommands    bool            `json:"disable_commands"`
 	Services           ServiceMetaList `json:"services"`
 	Steps              ServiceMetaList `json:"steps"`
 	ProjectName        string          `json:"project_name"`
@@ -28,10 +40,20 @@ type PipelineEnvironment struct {
 	Substitutions      types.StringMap
 	TempDirPath        string
 	TempDirNoAutoClean bool
+	StrictSubstitution bool
+	ImageTagTemplate   string
+	ChownOutputs       bool
+	DisableCommands    bool
 	Steps              ServiceMetaList
-	ProjectName        string
-	tempFiles          []string
-	tempPaths          map[string]string
+	// Origins stores the layer, file or profile, each value came from by
+	// its dotted path.
+	Origins map[string]string
+	// Problems stores all values of the files not matching
+	// EnvironmentSchema.
+	Problems    []ValidationError
+	ProjectName string
+	tempFiles   []string
+	tempPaths   map[string]string
 }
 
 // UnmarshalJSON loads a PipelineDefinition from json using the pipelineJSON struct.
@@ -49,6 +71,10 @@ func (e *PipelineEnvironment) UnmarshalJSON(data []byte) error {
 	result.Substitutions = parsedJSON.Substitutions
 	result.TempDirPath = parsedJSON.TempDirPath
 	result.TempDirNoAutoClean = parsedJSON.TempDirNoAutoClean
+	result.StrictSubstitution = parsedJSON.StrictSubstitution
+	result.ImageTagTemplate = parsedJSON.ImageTagTemplate
+	result.ChownOutputs = parsedJSON.ChownOutputs
+	result.DisableCommands = parsedJSON.DisableCommands
 	result.ProjectName = parsedJSON.ProjectName
 	if result.Substitutions == nil {
 		result.Substitutions = types.StringMap{}
@@ -70,54 +96,230 @@ func (e *PipelineEnvironment) UnmarshalJSON(data []byte) error {
 }
 
 // NewPipelineEnvironment builds a new environment merging the current
-// environment, the environment given by path and the user provided steps to
-// ignore.
-func NewPipelineEnvironment(path string, substitutions types.StringMap, ignoredSteps types.StringSet, selectedSteps types.StringSet) (*PipelineEnvironment, error) {
+// environment, the environments given by paths and the user provided steps to
+// ignore. Later files are deep-merged into earlier ones, the profile selected
+// by EnvironmentProfile is applied last.
+func NewPipelineEnvironment(paths []string, substitutions types.StringMap, ignoredSteps types.StringSet, selectedSteps types.StringSet) (*PipelineEnvironment, error) {
 	// Set defaults
 	e := &PipelineEnvironment{
 		tempPaths:     make(map[string]string),
 		Substitutions: types.StringMap{},
 		Steps:         ServiceMetaList{},
+		Origins:       map[string]string{},
 	}
 	e.updateSubstitutions(substitutions)
 	e.updateStepsMeta(ignoredSteps, selectedSteps)
 
-	// Import settings from file
-	dir, err := os.Getwd()
-	if err != nil {
-		return e, err
+	// Import settings from files
+	files := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if path != "" {
+			files = append(files, path)
+		}
 	}
-	defaultPath := filepath.Join(dir, GantryEnv)
-	if _, err := os.Stat(defaultPath); path == "" && err == nil {
-		path = defaultPath
+	if len(files) == 0 {
+		dir, err := os.Getwd()
+		if err != nil {
+			return e, err
+		}
+		path := ""
+		defaultPath := filepath.Join(dir, GantryEnv)
+		if _, err := os.Stat(defaultPath); err == nil {
+			path = defaultPath
+		}
+		files = append(files, path)
 	}
-	file, err := os.Open(path)
-	if err != nil {
-		return e, err
+	doc := map[string]interface{}{}
+	origins := map[string]string{}
+	problems := []ValidationError{}
+	for _, path := range files {
+		layer, layerProblems, err := readEnvironmentLayer(path)
+		if err != nil {
+			// Explicitly given environment files are required
+			if path != "" {
+				return e, fmt.Errorf("could not read environment file: %s", err)
+			}
+			// The default environment file is optional, requested profiles
+			// are not
+			if EnvironmentProfile != "" && os.IsNotExist(err) {
+				return e, fmt.Errorf("no such environment profile '%s', no environment file found: %s", EnvironmentProfile, err)
+			}
+			return e, err
+		}
+		problems = append(problems, layerProblems...)
+		doc = mergeEnvironmentValues(nil, doc, layer, path, origins).(map[string]interface{})
 	}
-	defer file.Close()
-
-	data, err := ioutil.ReadAll(file)
+	profiles, _ := doc["profiles"].(map[string]interface{})
+	delete(doc, "profiles")
+	if EnvironmentProfile != "" {
+		profile, found := profiles[EnvironmentProfile].(map[string]interface{})
+		if !found {
+			return e, fmt.Errorf("no such environment profile '%s'", EnvironmentProfile)
+		}
+		for key, value := range profile {
+			if !containsString(environmentProfileKeys, key) {
+				return e, fmt.Errorf("unsupported key '%s' in environment profile '%s'", key, EnvironmentProfile)
+			}
+			doc[key] = mergeEnvironmentValues([]string{key}, doc[key], value, "", origins)
+		}
+		// Values of the profile originate from the file defining them
+		prefix := fmt.Sprintf("profiles.%s.", EnvironmentProfile)
+		for key, origin := range origins {
+			if strings.HasPrefix(key, prefix) {
+				origins[strings.TrimPrefix(key, prefix)] = fmt.Sprintf("profile '%s' in %s", EnvironmentProfile, origin)
+			}
+		}
+	}
+	for key := range origins {
+		if strings.HasPrefix(key, "profiles.") {
+			delete(origins, key)
+		}
+	}
+	data, err := json.Marshal(doc)
 	if err != nil {
 		return e, err
 	}
 	e.Steps = nil
 	err = yaml.Unmarshal(data, e)
+	e.Origins = origins
+	e.Problems = problems
 	if err != nil {
 		return e, err
 	}
+	if err := e.decryptSubstitutions(); err != nil {
+		return e, err
+	}
 	// Reimport defaults
 	e.updateSubstitutions(substitutions)
+	for k := range substitutions {
+		e.Origins["substitutions."+k] = EnvironmentOriginCommandLine
+	}
 	e.updateStepsMeta(ignoredSteps, selectedSteps)
 	return e, nil
 }
 
+// Origin returns the layer the value at the dotted path, e.g.
+// substitutions.NAME or steps.name.ignore, was defined in. Returns an empty
+// string for default values.
+func (e *PipelineEnvironment) Origin(path string) string {
+	for {
+		if origin, found := e.Origins[path]; found {
+			return origin
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			return ""
+		}
+		path = path[:i]
+	}
+}
+
+// readEnvironmentLayer reads the environment file at path into a generic map
+// and validates it against EnvironmentSchema.
+func readEnvironmentLayer(path string) (map[string]interface{}, []ValidationError, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	layer := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &layer); err != nil {
+		return nil, nil, fmt.Errorf("invalid environment '%s': %s", path, err)
+	}
+	problems, err := validateYAML(data, nil, path, EnvironmentSchema())
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid environment '%s': %s", path, err)
+	}
+	return layer, problems, nil
+}
+
+// mergeEnvironmentValues deep-merges override into base. Mappings are merged
+// recursively, all other values are replaced. The layer of each replaced value
+// is recorded in origins using its dotted path.
+func mergeEnvironmentValues(path []string, base interface{}, override interface{}, layer string, origins map[string]string) interface{} {
+	baseMap, baseIsMap := base.(map[string]interface{})
+	overrideMap, overrideIsMap := override.(map[string]interface{})
+	if baseIsMap && overrideIsMap {
+		result := make(map[string]interface{}, len(baseMap)+len(overrideMap))
+		for k, v := range baseMap {
+			result[k] = v
+		}
+		for k, v := range overrideMap {
+			result[k] = mergeEnvironmentValues(append(path[:len(path):len(path)], k), baseMap[k], v, layer, origins)
+		}
+		return result
+	}
+	key := strings.Join(path, ".")
+	for k := range origins {
+		if strings.HasPrefix(k, key+".") {
+			delete(origins, k)
+		}
+	}
+	if overrideIsMap {
+		for k, v := range overrideMap {
+			mergeEnvironmentValues(append(path[:len(path):len(path)], k), nil, v, layer, origins)
+		}
+		if len(overrideMap) > 0 {
+			return override
+		}
+	}
+	origins[key] = layer
+	return override
+}
+
 func (e *PipelineEnvironment) updateSubstitutions(substitutions types.StringMap) {
 	for k, v := range substitutions {
 		e.Substitutions[k] = v
 	}
 }
 
+// decryptSubstitutions replaces all encrypted substitutions, global and of
+// steps, with their values using the key file given by GantryKeyFile.
+// Decrypted values are only kept in memory and masked in all output.
+func (e *PipelineEnvironment) decryptSubstitutions() error {
+	secretKey := ""
+	if err := decryptStringMap(e.Substitutions, "", &secretKey); err != nil {
+		return err
+	}
+	for name, meta := range e.Steps {
+		if err := decryptStringMap(meta.Substitutions, fmt.Sprintf(" of '%s'", name), &secretKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptStringMap decrypts all encrypted values of m in place. The secret
+// key is read once, when the first encrypted value is found.
+func decryptStringMap(m types.StringMap, context string, secretKey *string) error {
+	for k, v := range m {
+		if v == nil || !IsEncryptedValue(*v) {
+			continue
+		}
+		if *secretKey == "" {
+			path := os.Getenv(GantryKeyFile)
+			if path == "" {
+				return fmt.Errorf("substitution '%s'%s is encrypted but %s is not set", k, context, GantryKeyFile)
+			}
+			var err error
+			if *secretKey, err = ReadKeyFile(path); err != nil {
+				return err
+			}
+		}
+		value, err := DecryptValue(*v, *secretKey)
+		if err != nil {
+			return fmt.Errorf("substitution '%s'%s: %s", k, context, err)
+		}
+		RegisterSecret(value)
+		m[k] = &value
+	}
+	return nil
+}
+
 // GetSubstitution returns a string-pointer and whether or not the key is found.
 func (e *PipelineEnvironment) GetSubstitution(key string) (*string, bool) {
 	value, ok := e.Substitutions[key]
@@ -129,6 +331,30 @@ func (e *PipelineEnvironment) SetSubstitution(key string, value *string) {
 	e.Substitutions[key] = value
 }
 
+// Scope returns the environment used inside the definition of the step or
+// service name. Its substitutions shadow the global ones.
+func (e *PipelineEnvironment) Scope(name string) preprocessor.Environment {
+	meta, found := e.Steps[name]
+	if !found || len(meta.Substitutions) == 0 {
+		return e
+	}
+	return &stepEnvironment{Environment: e, substitutions: meta.Substitutions}
+}
+
+// stepEnvironment is the environment of a single step.
+type stepEnvironment struct {
+	preprocessor.Environment
+	substitutions types.StringMap
+}
+
+// GetSubstitution returns the value of key, values of the step are preferred.
+func (e *stepEnvironment) GetSubstitution(key string) (*string, bool) {
+	if value, found := e.substitutions[key]; found {
+		return value, found
+	}
+	return e.Environment.GetSubstitution(key)
+}
+
 func (e *PipelineEnvironment) updateStepsMeta(ignoredSteps types.StringSet, selectedSteps types.StringSet) {
 	for name := range ignoredSteps {
 		if _, found := e.Steps[name]; !found {
@@ -178,6 +404,49 @@ func (e *PipelineEnvironment) GetOrCreateTempDir(prefix string) (string, error)
 	return e.tempDir(prefix)
 }
 
+// secretsTempDir returns the temporary directory storing the values of
+// secrets to be mounted. It is created in a memory backed file system if one
+// is available, so values are not written to disk. Like all temporary
+// directories it is removed by CleanUp.
+func (e *PipelineEnvironment) secretsTempDir() (string, error) {
+	if path, ok := e.tempPaths[secretsPrefix]; ok {
+		return path, nil
+	}
+	for _, base := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if base == "" {
+			continue
+		}
+		if path, err := ioutil.TempDir(base, secretsPrefix); err == nil {
+			e.tempPaths[secretsPrefix] = path
+			return path, os.Chmod(path, 0700)
+		}
+	}
+	path, err := e.tempDir(secretsPrefix)
+	if err != nil {
+		return path, err
+	}
+	// Only the mounted files need to be readable for containers
+	return path, os.Chmod(path, 0700)
+}
+
+// tempDirBase returns the directory containing all temporary directories.
+func (e *PipelineEnvironment) tempDirBase() string {
+	if e.TempDirPath == "" {
+		return os.TempDir()
+	}
+	return e.TempDirPath
+}
+
+// releaseTempDir hands the temporary directory path over to the caller, it
+// is no longer removed by CleanUp.
+func (e *PipelineEnvironment) releaseTempDir(path string) {
+	for prefix, p := range e.tempPaths {
+		if p == path {
+			delete(e.tempPaths, prefix)
+		}
+	}
+}
+
 func (e *PipelineEnvironment) tempDir(prefix string) (string, error) {
 	path, err := ioutil.TempDir(e.TempDirPath, prefix)
 	if err == nil {
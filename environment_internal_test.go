@@ -2,8 +2,11 @@ package gantry
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ad-freiburg/gantry/types"
@@ -22,7 +25,7 @@ func TestPipelineEnvironmentUpdateSubstitutions(t *testing.T) {
 	}
 	bar := "bar"
 	baz := "baz"
-	e, err := NewPipelineEnvironment("", types.StringMap{}, types.StringSet{}, types.StringSet{})
+	e, err := NewPipelineEnvironment([]string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
@@ -81,7 +84,7 @@ func TestPipelineEnvironmentUpdateStepsMeta(t *testing.T) {
 		}
 		return nil
 	}
-	e, err := NewPipelineEnvironment("", types.StringMap{}, types.StringSet{}, types.StringSet{})
+	e, err := NewPipelineEnvironment([]string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
@@ -159,3 +162,228 @@ func TestPipelineEnvironmentUpdateStepsMeta(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestNewPipelineEnvironmentEncryptedSubstitutions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretKey, publicKey, err := GenerateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key.txt")
+	if err := WriteKeyFile(keyFile, secretKey); err != nil {
+		log.Fatal(err)
+	}
+	encrypted, err := EncryptValue("api-t0ken", publicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	envFile := filepath.Join(dir, GantryEnv)
+	if err := ioutil.WriteFile(envFile, []byte("substitutions:\n  TOKEN: |\n    "+strings.Replace(strings.TrimSpace(encrypted), "\n", "\n    ", -1)+"\n  PLAIN: value\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	defer os.Setenv(GantryKeyFile, os.Getenv(GantryKeyFile))
+
+	os.Unsetenv(GantryKeyFile)
+	if _, err := NewPipelineEnvironment([]string{envFile}, types.StringMap{}, types.StringSet{}, types.StringSet{}); err == nil {
+		t.Errorf("Missing error without %s", GantryKeyFile)
+	}
+
+	os.Setenv(GantryKeyFile, keyFile)
+	e, err := NewPipelineEnvironment([]string{envFile}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	if v, _ := e.GetSubstitution("TOKEN"); v == nil || *v != "api-t0ken" {
+		t.Errorf("Incorrect decrypted substitution, got: '%v'", v)
+	}
+	if v, _ := e.GetSubstitution("PLAIN"); v == nil || *v != "value" {
+		t.Errorf("Incorrect plain substitution, got: '%v'", v)
+	}
+	if r := MaskSecrets("token: api-t0ken"); r != "token: "+SecretMask {
+		t.Errorf("Decrypted value not masked, got: '%s'", r)
+	}
+}
+
+func TestNewPipelineEnvironmentLayers(t *testing.T) {
+	_, base := setupDefAndEnv("", `substitutions:
+  A: base
+  B: base
+steps:
+  a:
+    ignore: true
+    stdout:
+      handler: discard
+profiles:
+  ci:
+    substitutions:
+      B: ci
+    steps:
+      b:
+        ignore_failure: true
+`)
+	_, overlay := setupDefAndEnv("", `substitutions:
+  A: overlay
+steps:
+  a:
+    stdout:
+      handler: both
+`)
+	defer os.Remove(base)
+	defer os.Remove(overlay)
+	defer func(profile string) { EnvironmentProfile = profile }(EnvironmentProfile)
+	c := "cli"
+
+	EnvironmentProfile = ""
+	e, err := NewPipelineEnvironment([]string{base, overlay}, types.StringMap{"C": &c}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	cases := []struct {
+		key    string
+		value  string
+		origin string
+	}{
+		{"A", "overlay", overlay},
+		{"B", "base", base},
+		{"C", "cli", EnvironmentOriginCommandLine},
+	}
+	for _, c := range cases {
+		if v, _ := e.GetSubstitution(c.key); v == nil || *v != c.value {
+			t.Errorf("Incorrect value for '%s', got: '%v', wanted: '%s'", c.key, v, c.value)
+		}
+		if r := e.Origin("substitutions." + c.key); r != c.origin {
+			t.Errorf("Incorrect origin for '%s', got: '%s', wanted: '%s'", c.key, r, c.origin)
+		}
+	}
+	if !e.Steps["a"].Ignore || e.Steps["a"].Stdout.Handler != LogHandlerBoth {
+		t.Errorf("Incorrect merged meta for 'a', got: '%#v'", e.Steps["a"])
+	}
+	if r := e.Origin("steps.a.ignore"); r != base {
+		t.Errorf("Incorrect origin for 'steps.a.ignore', got: '%s', wanted: '%s'", r, base)
+	}
+	if _, found := e.Steps["b"]; found {
+		t.Errorf("Unexpected meta for 'b' without profile")
+	}
+
+	EnvironmentProfile = "ci"
+	e, err = NewPipelineEnvironment([]string{base, overlay}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	if v, _ := e.GetSubstitution("B"); v == nil || *v != "ci" {
+		t.Errorf("Incorrect value for 'B', got: '%v', wanted: 'ci'", v)
+	}
+	if r, origin := e.Origin("substitutions.B"), "profile 'ci' in "+base; r != origin {
+		t.Errorf("Incorrect origin for 'B', got: '%s', wanted: '%s'", r, origin)
+	}
+	if !e.Steps["b"].IgnoreFailure || !e.Steps["a"].Ignore {
+		t.Errorf("Incorrect profile meta, got: '%#v'", e.Steps)
+	}
+
+	EnvironmentProfile = "missing"
+	if _, err := NewPipelineEnvironment([]string{base}, types.StringMap{}, types.StringSet{}, types.StringSet{}); err == nil || err.Error() != "no such environment profile 'missing'" {
+		t.Errorf("Incorrect error for missing profile, got: '%v'", err)
+	}
+	// Without environment file the requested profile can not be found
+	if _, err := NewPipeline([]string{}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{}); err == nil || !strings.HasPrefix(err.Error(), "no such environment profile 'missing', no environment file found") {
+		t.Errorf("Incorrect error for missing profile without environment file, got: '%v'", err)
+	}
+	EnvironmentProfile = ""
+	// Explicitly given environment files are required
+	missing := filepath.Join(filepath.Dir(base), "missing.env.yml")
+	for _, paths := range [][]string{{missing}, {base, missing}} {
+		if _, err := NewPipeline([]string{}, paths, types.StringMap{}, types.StringSet{}, types.StringSet{}); err == nil || !strings.HasPrefix(err.Error(), "could not read environment file: ") {
+			t.Errorf("Incorrect error for missing environment file in '%v', got: '%v'", paths, err)
+		}
+	}
+}
+
+func TestNewPipelineStepSubstitutions(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  a:
+    image: ${IMAGE}
+    command: ${ARGS}
+  b:
+    image: ${IMAGE}
+    command: ${ARGS}
+    depends_on:
+      - a
+`, `substitutions:
+  IMAGE: alpine
+  ARGS: global
+steps:
+  a:
+    substitutions:
+      ARGS: local
+`)
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	cases := []struct {
+		name    string
+		image   string
+		command string
+	}{
+		{"a", "alpine", "local"},
+		{"b", "alpine", "global"},
+	}
+	for _, c := range cases {
+		step := p.Definition.Steps[c.name]
+		if step.Image != c.image {
+			t.Errorf("Incorrect image for '%s', got: '%s', wanted: '%s'", c.name, step.Image, c.image)
+		}
+		if command := strings.Join(step.Command, " "); command != c.command {
+			t.Errorf("Incorrect command for '%s', got: '%s', wanted: '%s'", c.name, command, c.command)
+		}
+	}
+	// Global substitutions are not changed by the scope of a step
+	if v, _ := p.Environment.GetSubstitution("ARGS"); v == nil || *v != "global" {
+		t.Errorf("Incorrect global value for 'ARGS', got: '%v'", v)
+	}
+}
+
+func TestNewPipelineDisableCommands(t *testing.T) {
+	definition := `#! SET_FROM_COMMAND ${REVISION} echo abc123
+version: "2.0"
+steps:
+  a:
+    image: alpine
+    command: ${REVISION}
+`
+	cases := []struct {
+		env      string
+		revision string
+		err      string
+	}{
+		{"", "abc123", ""},
+		{"disable_commands: true\n", "", "line 1: SET_FROM_COMMAND is disabled by the environment"},
+	}
+	for _, c := range cases {
+		tmpDef, tmpEnv := setupDefAndEnv(definition, c.env)
+		defer os.Remove(tmpDef)
+		defer os.Remove(tmpEnv)
+
+		p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("Incorrect error for env '%s', got: '%v', wanted: '%s'", c.env, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: '%s'", err)
+		}
+		if command := strings.Join(p.Definition.Steps["a"].Command, " "); command != c.revision {
+			t.Errorf("Incorrect command, got: '%s', wanted: '%s'", command, c.revision)
+		}
+	}
+}
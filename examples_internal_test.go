@@ -288,7 +288,7 @@ func TestExamples(t *testing.T) {
 		if err := os.Chdir(filepath.Join(cwd, "examples", example.dir)); err != nil {
 			log.Fatal(err)
 		}
-		p, err := NewPipeline(example.def, example.env, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		p, err := NewPipeline([]string{example.def}, []string{example.env}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 		if err != nil {
 			t.Errorf("Unexpected error creating pipeline for '%s': '%#v'", example.dir, err)
 			continue
@@ -355,7 +355,7 @@ func TestExamplesAutodetectDefFiles(t *testing.T) {
 		if err := os.Chdir(filepath.Join(cwd, "examples", entry.Name())); err != nil {
 			log.Fatal(err)
 		}
-		if _, err := NewPipeline("", "", types.StringMap{}, types.StringSet{}, types.StringSet{}); err != nil {
+		if _, err := NewPipeline([]string{}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{}); err != nil {
 			t.Errorf("Unexpected error creating pipeline: '%s': '%#v'", entry.Name(), err)
 		}
 		if err := os.Chdir(cwd); err != nil {
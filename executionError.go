@@ -10,9 +10,9 @@ type ExecutionError struct {
 	exitCodeOverride int
 }
 
-// Error returns the string representation of the error.
+// Error returns the string representation of the error with secrets masked.
 func (e ExecutionError) Error() string {
-	return e.err.Error()
+	return MaskSecrets(e.err.Error())
 }
 
 // ExitCode returns the integer with which the programm shall exit.
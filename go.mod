@@ -1,11 +1,21 @@
 module github.com/ad-freiburg/gantry
 
 require (
+	filippo.io/age v1.2.1
 	github.com/ghodss/yaml v1.0.0
 	github.com/google/shlex v0.0.0-20181106134648-c34317bd91bf
-	github.com/kr/pretty v0.1.0 // indirect
 	github.com/spf13/cobra v1.4.0
+	golang.org/x/sys v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/kr/pretty v0.1.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
 
-go 1.13
+go 1.19
@@ -0,0 +1,76 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ImageTagGitSha is the template variable replaced by the abbreviated commit
+// hash of the current git HEAD, if not defined as substitution.
+const ImageTagGitSha string = "GIT_SHA"
+
+// imageTagBuiltins are template variables which are replaced for each step
+// when the name of its image is requested.
+var imageTagBuiltins = map[string]func(Service) string{
+	"PROJECT": func(s Service) string {
+		if ProjectName != "" {
+			return ProjectName
+		}
+		return s.imageProject
+	},
+	"STEP": func(s Service) string {
+		return s.RawContainerName()
+	},
+}
+
+// resolveImageTagTemplate replaces all variables of template which are not
+// builtins using the substitutions of env.
+func resolveImageTagTemplate(template string, env *PipelineEnvironment) (string, error) {
+	var err error
+	result := os.Expand(template, func(name string) string {
+		if _, builtin := imageTagBuiltins[name]; builtin {
+			return fmt.Sprintf("${%s}", name)
+		}
+		if val, found := env.GetSubstitution(name); found && val != nil {
+			return *val
+		}
+		if name == ImageTagGitSha {
+			sha, e := gitSha()
+			if e != nil {
+				err = fmt.Errorf("could not determine %s for image tags: %s", ImageTagGitSha, e)
+			}
+			return sha
+		}
+		if err == nil {
+			err = fmt.Errorf("unknown variable '%s' in image tag template '%s'", name, template)
+		}
+		return ""
+	})
+	return result, err
+}
+
+// expandImageTag replaces the builtin variables of template for s.
+func expandImageTag(template string, s Service) string {
+	return os.Expand(template, func(name string) string {
+		if f, found := imageTagBuiltins[name]; found {
+			return f(s)
+		}
+		return ""
+	})
+}
+
+// NormalizeProjectName returns name in the form used for project names.
+func NormalizeProjectName(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(name), " ", "_"), ".", "")
+}
+
+// gitSha returns the abbreviated commit hash of HEAD in the current directory.
+func gitSha() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "--short", "HEAD").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
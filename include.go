@@ -0,0 +1,307 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/ad-freiburg/gantry/preprocessor"
+	"github.com/ad-freiburg/gantry/types"
+)
+
+// includeKey is the top-level key storing included pipelines by namespace.
+const includeKey string = "include"
+
+// NamespaceSeparator separates the namespace of included steps from their
+// names.
+const NamespaceSeparator string = "."
+
+// includeEnvironment is the environment used to preprocess included files.
+// Substitutions set by directives of the file stay local, temporary
+// directories are shared with the including pipeline.
+type includeEnvironment struct {
+	preprocessor.Environment
+	root          *PipelineEnvironment
+	prefix        string
+	substitutions types.StringMap
+}
+
+// GetSubstitution returns the value of key, local values are preferred.
+func (e *includeEnvironment) GetSubstitution(key string) (*string, bool) {
+	if value, found := e.substitutions[key]; found {
+		return value, found
+	}
+	return e.Environment.GetSubstitution(key)
+}
+
+// SetSubstitution stores the value under the given key for this file only.
+func (e *includeEnvironment) SetSubstitution(key string, value *string) {
+	e.substitutions[key] = value
+}
+
+// Scope returns the environment of the included step name, which uses the
+// substitutions of its namespaced name.
+func (e *includeEnvironment) Scope(name string) preprocessor.Environment {
+	meta, found := e.root.Steps[e.prefix+name]
+	if !found || len(meta.Substitutions) == 0 {
+		return e
+	}
+	return &stepEnvironment{Environment: e, substitutions: meta.Substitutions}
+}
+
+// include loads all pipelines included by doc, stored in the file path, and
+// adds their steps and services prefixed by their namespace.
+func (l *definitionLoader) include(path string, doc map[string]interface{}) error {
+	raw, found := doc[includeKey]
+	if !found {
+		return nil
+	}
+	delete(doc, includeKey)
+	includes, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("'%s' must be a mapping of namespaces to files in '%s'", includeKey, path)
+	}
+	l.including[path] = true
+	defer delete(l.including, path)
+	instances := map[string][]string{}
+	for _, namespace := range sortedKeys(includes) {
+		file, ok := includes[namespace].(string)
+		if !ok || file == "" {
+			return fmt.Errorf("include '%s' in '%s' must be a file name", namespace, path)
+		}
+		if namespace == "" || strings.Contains(namespace, NamespaceSeparator) {
+			return fmt.Errorf("invalid namespace '%s' in '%s'", namespace, path)
+		}
+		if err := checkNamespaceCollisions(doc, namespace, path); err != nil {
+			return err
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(filepath.Dir(path), file)
+		}
+		file = filepath.Clean(file)
+		if l.including[file] {
+			return fmt.Errorf("cyclic include of '%s' in '%s'", file, path)
+		}
+		loader := l.child(namespace)
+		included, err := loader.Load(file)
+		l.problems = append(l.problems, loader.problems...)
+		if err != nil {
+			return err
+		}
+		added, err := addIncludedDefinitions(doc, included, namespace, file, loader.instances[file])
+		if err != nil {
+			return fmt.Errorf("could not include '%s' as '%s' in '%s': %s", file, namespace, path, err)
+		}
+		for name, names := range added {
+			instances[name] = names
+		}
+		for _, section := range definitionSections {
+			definitions, _ := included[section].(map[string]interface{})
+			for name := range definitions {
+				dir, found := loader.dirs[name]
+				if !found {
+					dir = filepath.Dir(file)
+				}
+				l.dirs[namespace+NamespaceSeparator+name] = dir
+			}
+		}
+	}
+	// Dependencies on included matrix steps wait for all instances
+	replaceAllMatrixDependencies(doc, instances)
+	l.instances[path] = instances
+	return nil
+}
+
+// checkNamespaceCollisions returns an error if doc defines names in the
+// namespace reserved for the pipeline included as namespace.
+func checkNamespaceCollisions(doc map[string]interface{}, namespace string, path string) error {
+	for _, section := range definitionSections {
+		definitions, _ := doc[section].(map[string]interface{})
+		for _, name := range sortedKeys(definitions) {
+			if strings.HasPrefix(name, namespace+NamespaceSeparator) {
+				return fmt.Errorf("invalid name '%s' in '%s', names must not start with the include namespace '%s%s'", name, path, namespace, NamespaceSeparator)
+			}
+		}
+	}
+	return nil
+}
+
+// child returns a loader for the pipeline included as namespace. Each
+// inclusion is preprocessed in its own environment, so files included more
+// than once are read again.
+func (l *definitionLoader) child(namespace string) *definitionLoader {
+	prefix := l.prefix + namespace + NamespaceSeparator
+	return &definitionLoader{
+		env:      l.env,
+		preproc:  l.preproc,
+		files:    map[string]map[string]interface{}{},
+		resolved: map[string]map[string]interface{}{},
+		visiting: map[string]bool{},
+		fileEnv: &includeEnvironment{
+			Environment:   l.fileEnv,
+			root:          l.env,
+			prefix:        prefix,
+			substitutions: types.StringMap{},
+		},
+		prefix:    prefix,
+		including: l.including,
+		instances: map[string]map[string][]string{},
+		dirs:      map[string]string{},
+	}
+}
+
+// addIncludedDefinitions adds all steps and services of included to doc. Their
+// names and dependencies are prefixed with namespace, relative paths are
+// resolved from the directory of file. nested are the instances of matrix
+// steps of pipelines included by file. The prefixed instances of all matrix
+// steps are returned.
+func addIncludedDefinitions(doc map[string]interface{}, included map[string]interface{}, namespace string, file string, nested map[string][]string) (map[string][]string, error) {
+	// Expand templates and matrices in the scope of the included file
+	included = copyMapping(included)
+	origins := map[string]string{}
+	recordDefinitionOrigins(origins, nil, included, file)
+	if err := expandTemplates(included, origins); err != nil {
+		return nil, err
+	}
+	instances, err := expandMatrices(included)
+	if err != nil {
+		return nil, err
+	}
+	for name, names := range nested {
+		instances[name] = names
+	}
+	names := types.StringSet{}
+	for _, section := range definitionSections {
+		definitions, _ := included[section].(map[string]interface{})
+		for name := range definitions {
+			names[name] = true
+		}
+	}
+	prefix := namespace + NamespaceSeparator
+	for _, section := range definitionSections {
+		definitions, ok := included[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		target, ok := doc[section].(map[string]interface{})
+		if !ok {
+			if doc[section] != nil {
+				return nil, fmt.Errorf("'%s' must be a mapping", section)
+			}
+			target = map[string]interface{}{}
+		} else {
+			target = copyMapping(target)
+		}
+		for name, raw := range definitions {
+			definition, _ := raw.(map[string]interface{})
+			definition = namespaceDefinition(definition, prefix, names, filepath.Dir(file))
+			if _, found := target[prefix+name]; found {
+				return nil, fmt.Errorf("duplicate step/service '%s'", prefix+name)
+			}
+			target[prefix+name] = definition
+		}
+		doc[section] = target
+	}
+	prefixed := make(map[string][]string, len(instances))
+	for name, names := range instances {
+		for _, instance := range names {
+			prefixed[prefix+name] = append(prefixed[prefix+name], prefix+instance)
+		}
+	}
+	return prefixed, nil
+}
+
+// namespaceDefinition returns a copy of definition with dependencies on and
+// references to values of the names of the included file prefixed and
+// relative build contexts and volumes resolved from dir.
+func namespaceDefinition(definition map[string]interface{}, prefix string, names types.StringSet, dir string) map[string]interface{} {
+	result := copyMapping(definition)
+	for _, key := range matrixDependencyKeys {
+		var deps []interface{}
+		switch v := result[key].(type) {
+		case string:
+			deps = []interface{}{v}
+		case []interface{}:
+			deps = v
+		default:
+			continue
+		}
+		prefixed := make([]interface{}, len(deps))
+		for i, dep := range deps {
+			prefixed[i] = dep
+			if name, ok := dep.(string); ok && names[name] {
+				prefixed[i] = prefix + name
+			}
+		}
+		result[key] = prefixed
+	}
+	for key, value := range result {
+		result[key] = prefixOutputReferences(value, prefix, names)
+	}
+	switch build := result["build"].(type) {
+	case string:
+		result["build"] = resolveIncludedPath(build, dir)
+	case map[string]interface{}:
+		if context, ok := build["context"].(string); ok {
+			build = copyMapping(build)
+			build["context"] = resolveIncludedPath(context, dir)
+			result["build"] = build
+		}
+	}
+	if volumes, ok := result["volumes"].([]interface{}); ok {
+		resolved := make([]interface{}, len(volumes))
+		for i, volume := range volumes {
+			resolved[i] = volume
+			if v, ok := volume.(string); ok && strings.HasPrefix(v, ".") {
+				resolved[i] = resolveIncludedPath(v, dir)
+			}
+		}
+		result["volumes"] = resolved
+	}
+	return result
+}
+
+// prefixOutputReferences returns a copy of value with all references to
+// values of names prefixed.
+func prefixOutputReferences(value interface{}, prefix string, names types.StringSet) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = prefixOutputReferences(item, prefix, names)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = prefixOutputReferences(item, prefix, names)
+		}
+		return result
+	case string:
+		return stepOutputReference.ReplaceAllStringFunc(v, func(match string) string {
+			name := stepOutputReference.FindStringSubmatch(match)[1]
+			if !names[name] {
+				return match
+			}
+			return strings.Replace(match, "steps."+name+".", "steps."+prefix+name+".", 1)
+		})
+	}
+	return value
+}
+
+// resolveIncludedPath resolves the relative path p from dir.
+func resolveIncludedPath(p string, dir string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// copyMapping returns a shallow copy of m.
+func copyMapping(m map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,245 @@
+package gantry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+// setupIncludeDir writes files into a new temporary directory and returns
+// its path.
+func setupIncludeDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestNewPipelineInclude(t *testing.T) {
+	dir := setupIncludeDir(t, map[string]string{
+		"gantry.yml": `version: "2.0"
+include:
+  prep: prep/gantry.yml
+steps:
+  query:
+    image: alpine
+    after:
+      - prep.build_index
+`,
+		"prep/gantry.yml": `#! SET_IF_EMPTY ${IMAGE} busybox
+#! TEMP_DIR_IF_EMPTY ${SCRATCH}
+version: "2.0"
+steps:
+  download:
+    image: ${IMAGE}
+    volumes:
+      - ./data:/data
+      - ${SCRATCH}:/scratch
+  build_index:
+    build: ./index
+    after:
+      - download
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := NewPipeline([]string{filepath.Join(dir, "gantry.yml")}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	defer p.Environment.CleanUp(nil)
+	for _, name := range []string{"query", "prep.download", "prep.build_index"} {
+		if _, found := p.Definition.Steps[name]; !found {
+			t.Errorf("missing step '%s'", name)
+		}
+	}
+	if _, found := p.Definition.Steps["download"]; found {
+		t.Errorf("included step 'download' is not namespaced")
+	}
+	if !p.Definition.Steps["query"].After["prep.build_index"] {
+		t.Errorf("Incorrect after for 'query', got: '%v'", p.Definition.Steps["query"].After)
+	}
+	index := p.Definition.Steps["prep.build_index"]
+	if !index.After["prep.download"] {
+		t.Errorf("Incorrect after for 'prep.build_index', got: '%v'", index.After)
+	}
+	if r := index.BuildInfo.Context; r != filepath.Join(dir, "prep", "index") {
+		t.Errorf("Incorrect build context, got: '%s'", r)
+	}
+	download := p.Definition.Steps["prep.download"]
+	if download.Image != "busybox" {
+		t.Errorf("Incorrect image, got: '%s', wanted: 'busybox'", download.Image)
+	}
+	if len(download.Volumes) != 2 || download.Volumes[0] != filepath.Join(dir, "prep", "data")+":/data" {
+		t.Errorf("Incorrect volumes, got: '%v'", download.Volumes)
+	}
+	if r := download.dir; r != filepath.Join(dir, "prep") {
+		t.Errorf("Incorrect directory of 'prep.download', got: '%s'", r)
+	}
+	if r := p.Definition.Steps["query"].dir; r != dir {
+		t.Errorf("Incorrect directory of 'query', got: '%s'", r)
+	}
+	if _, found := p.Environment.Substitutions["IMAGE"]; found {
+		t.Errorf("substitution of included file leaked into pipeline environment")
+	}
+	for _, path := range p.Environment.tempPaths {
+		if len(p.Environment.tempPaths) != 1 || download.Volumes[1] != path+":/scratch" {
+			t.Errorf("temporary directory not shared, got: '%v' and '%v'", p.Environment.tempPaths, download.Volumes)
+		}
+	}
+	if len(p.Environment.tempPaths) != 1 {
+		t.Errorf("Incorrect number of temporary directories, got: '%v'", p.Environment.tempPaths)
+	}
+	if _, err := p.Definition.Pipelines(); err != nil {
+		t.Errorf("unexpected error: '%s'", err)
+	}
+}
+
+func TestNewPipelineIncludeErrors(t *testing.T) {
+	cases := []struct {
+		files map[string]string
+		err   string
+	}{
+		{
+			map[string]string{
+				"gantry.yml": "include:\n  a: a.yml\nsteps:\n  x:\n    image: alpine\n",
+				"a.yml":      "include:\n  b: b.yml\n",
+				"b.yml":      "include:\n  a: a.yml\n",
+			},
+			"cyclic include of",
+		},
+		{
+			map[string]string{
+				"gantry.yml": "include:\n  a.b: a.yml\n",
+				"a.yml":      "steps:\n  x:\n    image: alpine\n",
+			},
+			"invalid namespace 'a.b'",
+		},
+		{
+			map[string]string{
+				"gantry.yml": "include:\n  a: missing.yml\n",
+			},
+			"missing.yml",
+		},
+	}
+	for i, c := range cases {
+		dir := setupIncludeDir(t, c.files)
+		_, err := NewPipeline([]string{filepath.Join(dir, "gantry.yml")}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		os.RemoveAll(dir)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("Incorrect error for case %d, got: '%v', wanted: '%s'", i, err, c.err)
+		}
+	}
+}
+
+func TestNewPipelineIncludeMatrixAndNamespaces(t *testing.T) {
+	dir := setupIncludeDir(t, map[string]string{
+		"gantry.yml": `version: "2.0"
+include:
+  a: lib/gantry.yml
+  b: lib/gantry.yml
+steps:
+  report:
+    image: alpine
+    after:
+      - a.test
+      - b.build
+`,
+		"lib/gantry.yml": `#! SET_IF_EMPTY ${IMAGE} busybox
+version: "2.0"
+steps:
+  build:
+    image: ${IMAGE}
+  test:
+    image: ${IMAGE}
+    matrix:
+      version: ["1.0", "2.0"]
+    after:
+      - build
+`,
+		"gantry.env.yml": `steps:
+  a.build:
+    substitutions:
+      IMAGE: alpine
+  b.build:
+    substitutions:
+      IMAGE: debian
+  a.test:
+    ignore_failure: true
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := NewPipeline([]string{filepath.Join(dir, "gantry.yml")}, []string{filepath.Join(dir, "gantry.env.yml")}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	defer p.Environment.CleanUp(nil)
+	report := p.Definition.Steps["report"]
+	for _, name := range []string{"a.test-1_0", "a.test-2_0", "b.build"} {
+		if !report.After[name] {
+			t.Errorf("Incorrect after for 'report', got: '%v', missing: '%s'", report.After, name)
+		}
+	}
+	if report.After["a.test"] {
+		t.Errorf("Incorrect after for 'report', got: '%v'", report.After)
+	}
+	for _, name := range []string{"a.test-1_0", "a.test-2_0"} {
+		if !p.Definition.Steps[name].Meta.IgnoreFailure {
+			t.Errorf("meta of 'a.test' not applied to instance '%s'", name)
+		}
+	}
+	if p.Definition.Steps["b.test-1_0"].Meta.IgnoreFailure {
+		t.Errorf("meta of 'a.test' applied to 'b.test-1_0'")
+	}
+	cases := map[string]string{"a.build": "alpine", "b.build": "debian", "a.test-1_0": "busybox"}
+	for name, image := range cases {
+		if r := p.Definition.Steps[name].Image; r != image {
+			t.Errorf("Incorrect image for '%s', got: '%s', wanted: '%s'", name, r, image)
+		}
+	}
+}
+
+func TestNewPipelineDottedNames(t *testing.T) {
+	for _, def := range []string{
+		"version: \"2.0\"\nsteps:\n  web.api:\n    image: alpine\n",
+		"version: \"2.0\"\nservices:\n  web.api:\n    image: alpine\n",
+	} {
+		dir := setupIncludeDir(t, map[string]string{"gantry.yml": def})
+		_, err := NewPipeline([]string{filepath.Join(dir, "gantry.yml")}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		os.RemoveAll(dir)
+		if err != nil {
+			t.Errorf("Unexpected error for '%s': '%s'", def, err)
+		}
+	}
+	for _, def := range []string{
+		"include:\n  lib: lib.yml\nsteps:\n  lib.a:\n    image: alpine\n",
+		"include:\n  lib: lib.yml\nservices:\n  lib.a:\n    image: alpine\n",
+	} {
+		dir := setupIncludeDir(t, map[string]string{
+			"gantry.yml": def,
+			"lib.yml":    "steps:\n  b:\n    image: alpine\n",
+		})
+		_, err := NewPipeline([]string{filepath.Join(dir, "gantry.yml")}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		os.RemoveAll(dir)
+		if err == nil || !strings.Contains(err.Error(), "invalid name 'lib.a'") {
+			t.Errorf("Incorrect error, got: '%v'", err)
+		}
+	}
+}
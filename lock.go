@@ -0,0 +1,99 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// ImageLock stores the digests the images of a pipeline are pinned to.
+type ImageLock struct {
+	Images map[string]string `json:"images"`
+}
+
+// NewImageLock loads the lock file at path, if the file does not exist an
+// empty lock is returned.
+func NewImageLock(path string) (*ImageLock, error) {
+	l := &ImageLock{Images: map[string]string{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return l, nil
+		}
+		return l, err
+	}
+	if err := yaml.Unmarshal(data, l); err != nil {
+		return l, fmt.Errorf("invalid lock file '%s': %s", path, err)
+	}
+	if l.Images == nil {
+		l.Images = map[string]string{}
+	}
+	return l, nil
+}
+
+// Write stores l as yaml at path.
+func (l ImageLock) Write(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// IsEmpty returns whether or not l pins any image.
+func (l ImageLock) IsEmpty() bool {
+	return len(l.Images) == 0
+}
+
+// Pin sets the pinned references of all pullable steps in steps which images
+// are found in l. Returns warnings for images without entry and entries not
+// used by any step.
+func (l ImageLock) Pin(steps StepList) []string {
+	warnings := make([]string, 0)
+	used := make(map[string]bool)
+	for name, step := range steps {
+		step.pinnedImage = ""
+		if step.IsPullable() {
+			image := step.ImageName()
+			if ref, found := l.Images[image]; found {
+				step.pinnedImage = ref
+				used[image] = true
+			} else {
+				warnings = append(warnings, fmt.Sprintf("image '%s' of '%s' is not in lock file", image, name))
+			}
+		}
+		steps[name] = step
+	}
+	for image := range l.Images {
+		if !used[image] {
+			warnings = append(warnings, fmt.Sprintf("lock file entry '%s' is not used", image))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// digestFromRepoDigests selects the entry of repoDigests matching the
+// repository of image, falls back to the first entry.
+func digestFromRepoDigests(image string, repoDigests []string) string {
+	if len(repoDigests) == 0 {
+		return ""
+	}
+	repository := image
+	if i := strings.Index(repository, "@"); i >= 0 {
+		repository = repository[:i]
+	}
+	if i := strings.LastIndex(repository, ":"); i > strings.LastIndex(repository, "/") {
+		repository = repository[:i]
+	}
+	for _, digest := range repoDigests {
+		if strings.HasPrefix(digest, repository+"@") {
+			return digest
+		}
+	}
+	return repoDigests[0]
+}
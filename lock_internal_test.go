@@ -0,0 +1,170 @@
+package gantry
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+const lockedDigest string = "alpine@sha256:0123456789abcdef"
+
+func TestDigestFromRepoDigests(t *testing.T) {
+	cases := []struct {
+		image       string
+		repoDigests []string
+		result      string
+	}{
+		{"alpine", []string{}, ""},
+		{"alpine", []string{lockedDigest}, lockedDigest},
+		{"alpine:3.12", []string{lockedDigest}, lockedDigest},
+		{"localhost:5000/a:1", []string{"b@sha256:1", "localhost:5000/a@sha256:2"}, "localhost:5000/a@sha256:2"},
+		{"localhost:5000/a", []string{"b@sha256:1", "localhost:5000/a@sha256:2"}, "localhost:5000/a@sha256:2"},
+		{"c", []string{"b@sha256:1", "localhost:5000/a@sha256:2"}, "b@sha256:1"},
+	}
+
+	for _, c := range cases {
+		if r := digestFromRepoDigests(c.image, c.repoDigests); r != c.result {
+			t.Errorf("Incorrect result for '%s', got: '%s', wanted: '%s'", c.image, r, c.result)
+		}
+	}
+}
+
+func TestImageLockPin(t *testing.T) {
+	steps := StepList{
+		"a": Step{Service: Service{Name: "a", Image: "alpine"}},
+		"b": Step{Service: Service{Name: "b", Image: "debian"}},
+		"c": Step{Service: Service{Name: "c", Image: "alpine", BuildInfo: BuildInfo{Context: "."}}},
+	}
+	lock := ImageLock{Images: map[string]string{
+		"alpine": lockedDigest,
+		"ubuntu": "ubuntu@sha256:fedcba9876543210",
+	}}
+
+	warnings := lock.Pin(steps)
+	expected := []string{
+		"image 'debian' of 'b' is not in lock file",
+		"lock file entry 'ubuntu' is not used",
+	}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("Incorrect warnings, got: '%#v', wanted: '%#v'", warnings, expected)
+	}
+	cases := []struct {
+		name      string
+		reference string
+	}{
+		{"a", lockedDigest},
+		{"b", "debian"},
+		{"c", "alpine"},
+	}
+	for _, c := range cases {
+		if r := steps[c.name].ImageReference(); r != c.reference {
+			t.Errorf("Incorrect reference for '%s', got: '%s', wanted: '%s'", c.name, r, c.reference)
+		}
+	}
+	if r := steps["a"].PullCommand(); !reflect.DeepEqual(r, []string{"pull", lockedDigest}) {
+		t.Errorf("Incorrect pull command, got: '%#v'", r)
+	}
+}
+
+func TestPipelineLock(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := os.Chdir(cwd); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	if err := ioutil.WriteFile(GantryDef, []byte(`version: "2.0"
+steps:
+  a:
+    image: alpine
+  b:
+    image: debian
+`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(GantryLock, []byte("images:\n  alpine: "+lockedDigest+"\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	p, err := NewPipeline([]string{GantryDef}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	run := p.Definition.Steps["a"].RunCommand(Network("net"))
+	if r := run[len(run)-1]; r != lockedDigest {
+		t.Errorf("Incorrect image in run command, got: '%s', wanted: '%s'", r, lockedDigest)
+	}
+	localRunner := NewNoopRunner(true)
+	p.localRunner = localRunner
+
+	lockPath := filepath.Join(dir, "updated.lock")
+	if err := p.UpdateLock(lockPath); err != nil {
+		t.Fatalf("unexpected error updating lock: '%#v'", err)
+	}
+	checkCallsAndCalled(t, localRunner, "ImagePuller(a)", 1, 1)
+	checkCallsAndCalled(t, localRunner, "ImageDigestResolver(b)", 1, 1)
+	// Digests are not resolved by the NoopRunner, existing entries are kept
+	lock, err := NewImageLock(lockPath)
+	if err != nil {
+		t.Fatalf("unexpected error reading lock: '%#v'", err)
+	}
+	if expected := map[string]string{"alpine": lockedDigest}; !reflect.DeepEqual(lock.Images, expected) {
+		t.Errorf("Incorrect lock, got: '%#v', wanted: '%#v'", lock.Images, expected)
+	}
+}
+
+func TestPipelineLockNextToDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	def := filepath.Join(dir, GantryDef)
+	if err := ioutil.WriteFile(def, []byte(`version: "2.0"
+steps:
+  a:
+    image: alpine
+  b:
+    image: debian
+`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, GantryLock), []byte("images:\n  alpine: "+lockedDigest+"\n"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	p, err := NewPipeline([]string{def}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{"a": true})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	if p.LockPath != filepath.Join(dir, GantryLock) {
+		t.Errorf("Incorrect lock path, got: '%s', wanted: '%s'", p.LockPath, filepath.Join(dir, GantryLock))
+	}
+	if r := p.Definition.Steps["a"].RunCommand(Network("net")); r[len(r)-1] != lockedDigest {
+		t.Errorf("Incorrect image in run command, got: '%s', wanted: '%s'", r[len(r)-1], lockedDigest)
+	}
+	localRunner := NewNoopRunner(true)
+	p.localRunner = localRunner
+	if err := p.UpdateLock(p.LockPath); err != nil {
+		t.Fatalf("unexpected error updating lock: '%#v'", err)
+	}
+	// Images of not selected steps are resolved as well
+	checkCallsAndCalled(t, localRunner, "ImagePuller(b)", 1, 1)
+	checkCallsAndCalled(t, localRunner, "ImageDigestResolver(b)", 1, 1)
+}
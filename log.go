@@ -164,13 +164,13 @@ func (p *PrefixedWriter) Output() error {
 	for {
 		line, err := p.buf.ReadString('\n')
 		if err == io.EOF {
-			fmt.Fprintf(p.target, PrefixedWriterFormat, p.prefix, line)
+			fmt.Fprintf(p.target, PrefixedWriterFormat, p.prefix, MaskSecrets(line))
 			break
 		}
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(p.target, PrefixedWriterFormat, p.prefix, line)
+		fmt.Fprintf(p.target, PrefixedWriterFormat, p.prefix, MaskSecrets(line))
 	}
 	return nil
 }
@@ -191,14 +191,14 @@ func NewPrefixedLogger(prefix string, logger *log.Logger) *PrefixedLogger {
 
 // Printf format prints to the logger.
 func (p *PrefixedLogger) Printf(format string, v ...interface{}) {
-	if err := p.logger.Output(2, fmt.Sprintf(PrefixedWriterFormat, p.prefix, fmt.Sprintf(format, v...))); err != nil {
+	if err := p.logger.Output(2, fmt.Sprintf(PrefixedWriterFormat, p.prefix, MaskSecrets(fmt.Sprintf(format, v...)))); err != nil {
 		log.Printf("Error in PrefixedLogger.Printf: %s", err)
 	}
 }
 
 // Println prints a line to the logger.
 func (p *PrefixedLogger) Println(v ...interface{}) {
-	if err := p.logger.Output(2, fmt.Sprintf(PrefixedWriterFormat, p.prefix, fmt.Sprintln(v...))); err != nil {
+	if err := p.logger.Output(2, fmt.Sprintf(PrefixedWriterFormat, p.prefix, MaskSecrets(fmt.Sprintln(v...)))); err != nil {
 		log.Printf("Error in PrefixedLogger.Println: %s", err)
 	}
 }
@@ -210,7 +210,7 @@ func (p *PrefixedLogger) Write(b []byte) (int, error) {
 		b = b[:n-1]
 	}
 	for _, s := range strings.Split(string(b), "\n") {
-		if err := p.logger.Output(2, fmt.Sprintf(PrefixedWriterFormat, p.prefix, s)); err != nil {
+		if err := p.logger.Output(2, fmt.Sprintf(PrefixedWriterFormat, p.prefix, MaskSecrets(s))); err != nil {
 			return n, err
 		}
 	}
@@ -0,0 +1,237 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// matrixKey is the key of steps defining a matrix.
+const matrixKey string = "matrix"
+
+// matrixReference matches references to matrix values in step definitions.
+var matrixReference = regexp.MustCompile(`\$\{matrix\.([^}]*)\}`)
+
+// matrixNameInvalidChars matches all characters replaced in derived names.
+var matrixNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// matrixDependencyKeys lists all keys referencing other steps or services.
+var matrixDependencyKeys = []string{"after", "depends_on"}
+
+// expandMatrices replaces each step of doc defining a matrix by one step per
+// combination of the matrix values. Dependencies on a matrix step are replaced
+// by dependencies on all of its instances. The instance names of all matrix
+// steps are returned.
+func expandMatrices(doc map[string]interface{}) (map[string][]string, error) {
+	instances := map[string][]string{}
+	steps, ok := doc["steps"].(map[string]interface{})
+	if !ok {
+		return instances, nil
+	}
+	expanded := map[string]interface{}{}
+	for name, raw := range steps {
+		definition, ok := raw.(map[string]interface{})
+		if !ok || definition[matrixKey] == nil {
+			expanded[name] = raw
+			continue
+		}
+		combinations, err := matrixCombinations(name, definition[matrixKey])
+		if err != nil {
+			return nil, err
+		}
+		names := map[string]bool{}
+		for _, combination := range combinations {
+			instanceName := name + "-" + combination.suffix
+			if names[instanceName] {
+				return nil, fmt.Errorf("matrix step '%s' has more than one instance named '%s'", name, instanceName)
+			}
+			instance, err := substituteReferences(definition, matrixReference, combination.values, "matrix key", matrixKey)
+			if err != nil {
+				return nil, fmt.Errorf("invalid matrix step '%s': %s", name, err)
+			}
+			delete(instance.(map[string]interface{}), matrixKey)
+			names[instanceName] = true
+			expanded[instanceName] = instance
+			instances[name] = append(instances[name], instanceName)
+		}
+	}
+	for name, names := range instances {
+		for _, instanceName := range names {
+			if _, found := steps[instanceName]; found {
+				return nil, fmt.Errorf("instance '%s' of matrix step '%s' is already defined", instanceName, name)
+			}
+		}
+	}
+	doc["steps"] = expanded
+	replaceAllMatrixDependencies(doc, instances)
+	return instances, nil
+}
+
+// replaceAllMatrixDependencies lets all steps and services of doc depending on
+// a matrix step of instances wait for all of its instances.
+func replaceAllMatrixDependencies(doc map[string]interface{}, instances map[string][]string) {
+	if len(instances) == 0 {
+		return
+	}
+	for _, section := range definitionSections {
+		definitions, ok := doc[section].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		replaced := make(map[string]interface{}, len(definitions))
+		for name, raw := range definitions {
+			replaced[name] = raw
+			if definition, ok := raw.(map[string]interface{}); ok {
+				replaced[name] = replaceMatrixDependencies(definition, instances)
+			}
+		}
+		doc[section] = replaced
+	}
+}
+
+// matrixCombination stores the values of one instance of a matrix step.
+type matrixCombination struct {
+	values map[string]string
+	suffix string
+}
+
+// matrixCombinations returns all combinations of the values of matrix. Keys
+// are combined in alphabetical order, values in the given order.
+func matrixCombinations(name string, matrix interface{}) ([]matrixCombination, error) {
+	m, ok := matrix.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return nil, fmt.Errorf("matrix of '%s' must be a mapping of keys to lists of values", name)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := []matrixCombination{{values: map[string]string{}}}
+	for _, k := range keys {
+		list, ok := m[k].([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fmt.Errorf("matrix key '%s' of '%s' must be a non-empty list of values", k, name)
+		}
+		next := make([]matrixCombination, 0, len(result)*len(list))
+		for _, combination := range result {
+			for _, raw := range list {
+				switch raw.(type) {
+				case map[string]interface{}, []interface{}, nil:
+					return nil, fmt.Errorf("matrix key '%s' of '%s' must only contain scalar values", k, name)
+				}
+				value := scalarString(raw)
+				values := map[string]string{k: value}
+				for ck, cv := range combination.values {
+					values[ck] = cv
+				}
+				part := matrixNameInvalidChars.ReplaceAllString(value, "_")
+				suffix := part
+				if combination.suffix != "" {
+					suffix = combination.suffix + "-" + part
+				}
+				next = append(next, matrixCombination{values: values, suffix: suffix})
+			}
+		}
+		result = next
+	}
+	return result, nil
+}
+
+// scalarString returns the string representation of the scalar value, floats
+// are never formatted using an exponent.
+func scalarString(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// substituteReferences returns a copy of value with all references matched
+// by reference replaced by the value of their key. Values of skipKey are
+// copied as is. Unknown keys are reported using kind.
+func substituteReferences(value interface{}, reference *regexp.Regexp, values map[string]string, kind string, skipKey string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			if k == skipKey {
+				result[k] = item
+				continue
+			}
+			substituted, err := substituteReferences(item, reference, values, kind, skipKey)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = substituted
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			substituted, err := substituteReferences(item, reference, values, kind, skipKey)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = substituted
+		}
+		return result, nil
+	case string:
+		var err error
+		result := reference.ReplaceAllStringFunc(v, func(match string) string {
+			key := reference.FindStringSubmatch(match)[1]
+			value, found := values[key]
+			if !found && err == nil {
+				err = fmt.Errorf("unknown %s '%s'", kind, key)
+			}
+			return value
+		})
+		return result, err
+	}
+	return value, nil
+}
+
+// replaceMatrixDependencies returns definition with all dependencies on
+// matrix steps replaced by their instances.
+func replaceMatrixDependencies(definition map[string]interface{}, instances map[string][]string) map[string]interface{} {
+	result := definition
+	copied := false
+	for _, key := range matrixDependencyKeys {
+		var deps []interface{}
+		switch v := definition[key].(type) {
+		case string:
+			deps = []interface{}{v}
+		case []interface{}:
+			deps = v
+		default:
+			continue
+		}
+		replaced := make([]interface{}, 0, len(deps))
+		changed := false
+		for _, dep := range deps {
+			name, ok := dep.(string)
+			if names, found := instances[strings.TrimSpace(name)]; ok && found {
+				for _, instanceName := range names {
+					replaced = append(replaced, instanceName)
+				}
+				changed = true
+				continue
+			}
+			replaced = append(replaced, dep)
+		}
+		if !changed {
+			continue
+		}
+		if !copied {
+			result = make(map[string]interface{}, len(definition))
+			for k, v := range definition {
+				result[k] = v
+			}
+			copied = true
+		}
+		result[key] = replaced
+	}
+	return result
+}
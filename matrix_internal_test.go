@@ -0,0 +1,154 @@
+package gantry
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+	combinations, err := matrixCombinations("eval", map[string]interface{}{
+		"model":   []interface{}{"x", "y"},
+		"dataset": []interface{}{"a", "b/c", 3},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	suffixes := make([]string, len(combinations))
+	for i, c := range combinations {
+		suffixes[i] = c.suffix
+	}
+	expected := []string{"a-x", "a-y", "b_c-x", "b_c-y", "3-x", "3-y"}
+	if !reflect.DeepEqual(suffixes, expected) {
+		t.Errorf("Incorrect suffixes, got: '%#v', wanted: '%#v'", suffixes, expected)
+	}
+	if values := combinations[2].values; !reflect.DeepEqual(values, map[string]string{"dataset": "b/c", "model": "x"}) {
+		t.Errorf("Incorrect values, got: '%#v'", values)
+	}
+
+	combinations, err = matrixCombinations("eval", map[string]interface{}{
+		"rate": []interface{}{float64(1000000), 0.5},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	if r := combinations[0].values["rate"]; r != "1000000" {
+		t.Errorf("Incorrect value, got: '%s', wanted: '1000000'", r)
+	}
+	if r := combinations[1].suffix; r != "0_5" {
+		t.Errorf("Incorrect suffix, got: '%s', wanted: '0_5'", r)
+	}
+
+	cases := []struct {
+		matrix interface{}
+		err    string
+	}{
+		{[]interface{}{"a"}, "matrix of 'eval' must be a mapping of keys to lists of values"},
+		{map[string]interface{}{"a": "b"}, "matrix key 'a' of 'eval' must be a non-empty list of values"},
+		{map[string]interface{}{"a": []interface{}{}}, "matrix key 'a' of 'eval' must be a non-empty list of values"},
+		{map[string]interface{}{"a": []interface{}{[]interface{}{"b"}}}, "matrix key 'a' of 'eval' must only contain scalar values"},
+	}
+	for _, c := range cases {
+		if _, err := matrixCombinations("eval", c.matrix); err == nil || err.Error() != c.err {
+			t.Errorf("Incorrect error for '%#v', got: '%v', wanted: '%s'", c.matrix, err, c.err)
+		}
+	}
+}
+
+func TestNewPipelineMatrix(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  eval:
+    image: alpine
+    command: ["evaluate", "${matrix.dataset}", "${matrix.model}"]
+    matrix:
+      dataset: [a, b, c]
+      model: [x, z]
+  report:
+    image: alpine
+    depends_on:
+      - eval
+`, `steps:
+  eval:
+    ignore_failure: true
+`)
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	names := []string{}
+	for name := range p.Definition.Steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	expected := []string{"eval-a-x", "eval-a-z", "eval-b-x", "eval-b-z", "eval-c-x", "eval-c-z", "report"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Incorrect steps, got: '%#v', wanted: '%#v'", names, expected)
+	}
+	step := p.Definition.Steps["eval-b-z"]
+	if command := strings.Join(step.Command, " "); command != "evaluate b z" {
+		t.Errorf("Incorrect command, got: '%s'", command)
+	}
+	if !step.Meta.IgnoreFailure {
+		t.Errorf("Meta of matrix step not applied to instance")
+	}
+	deps := p.Definition.Steps["report"].Dependencies()
+	if len(deps) != 6 || !deps["eval-a-x"] || !deps["eval-c-z"] {
+		t.Errorf("Incorrect dependencies of 'report', got: '%#v'", deps)
+	}
+	pipelines, err := p.Definition.Pipelines()
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	all := pipelines.AllSteps()
+	if last := all[len(all)-1]; last.Name != "report" {
+		t.Errorf("Incorrect order, 'report' must run last, got: '%s'", last.Name)
+	}
+}
+
+func TestNewPipelineMatrixErrors(t *testing.T) {
+	cases := []struct {
+		def string
+		err string
+	}{
+		{`version: "2.0"
+steps:
+  eval:
+    image: ${matrix.unknown}
+    matrix:
+      dataset: [a]
+`, "invalid matrix step 'eval': unknown matrix key 'unknown'"},
+		{`version: "2.0"
+steps:
+  eval:
+    image: alpine
+    matrix:
+      dataset: [a]
+  eval-a:
+    image: alpine
+`, "instance 'eval-a' of matrix step 'eval' is already defined"},
+		{`version: "2.0"
+steps:
+  eval:
+    image: alpine
+    matrix:
+      dataset: [a/b, "a:b"]
+`, "matrix step 'eval' has more than one instance named 'eval-a_b'"},
+	}
+	for _, c := range cases {
+		tmpDef, tmpEnv := setupDefAndEnv(c.def, "")
+		_, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		if err == nil || err.Error() != c.err {
+			t.Errorf("Incorrect error, got: '%v', wanted: '%s'", err, c.err)
+		}
+		os.Remove(tmpDef)
+		os.Remove(tmpEnv)
+	}
+}
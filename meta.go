@@ -6,6 +6,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/ad-freiburg/gantry/types"
 )
 
 const (
@@ -45,7 +47,35 @@ type ServiceMeta struct {
 	ExitCodeOverride int  `json:"exit_code_override"`
 	Ignore           bool `json:"ignore"`
 	IgnoreFailure    bool `json:"ignore_failure"`
-	Selected         bool
+	// ChownOutputs changes the owner of the writable mounted host paths to
+	// the user running gantry after the step finished.
+	ChownOutputs bool `json:"chown_outputs"`
+	// Substitutions shadow the global substitutions inside the definition of
+	// the step.
+	Substitutions types.StringMap `json:"substitutions"`
+	Selected      bool
+	// present stores the keys given when m was unmarshalled, their values
+	// override others in Update even if they are zero values.
+	present types.StringSet
+}
+
+// UnmarshalJSON loads m from json and records the keys present.
+func (m *ServiceMeta) UnmarshalJSON(b []byte) error {
+	type serviceMeta ServiceMeta
+	meta := serviceMeta(*m)
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return err
+	}
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	*m = ServiceMeta(meta)
+	m.present = types.StringSet{}
+	for key := range keys {
+		m.present[key] = true
+	}
+	return nil
 }
 
 // Open handles output initialisation by setting defaults.
@@ -59,6 +89,58 @@ func (m *ServiceMeta) Open() error {
 	return nil
 }
 
+// Update returns a copy of m with all values set in o applied. The type of m is
+// kept. Flags set in either m or o stay set, unless o was unmarshalled from a
+// value setting them explicitly.
+func (m ServiceMeta) Update(o ServiceMeta) ServiceMeta {
+	if o.KeepAlive != KeepAliveYes || o.present["keep_alive"] {
+		m.KeepAlive = o.KeepAlive
+	}
+	if o.Stdout.Handler != LogHandlerStdout || o.Stdout.Path != "" || o.present["stdout"] {
+		m.Stdout = o.Stdout
+	}
+	if o.Stderr.Handler != LogHandlerStdout || o.Stderr.Path != "" || o.present["stderr"] {
+		m.Stderr = o.Stderr
+	}
+	if o.ExitCodeOverride != 0 || o.present["exit_code_override"] {
+		m.ExitCodeOverride = o.ExitCodeOverride
+	}
+	m.Ignore = updateFlag(m.Ignore, o.Ignore, o.present["ignore"])
+	m.IgnoreFailure = updateFlag(m.IgnoreFailure, o.IgnoreFailure, o.present["ignore_failure"])
+	m.ChownOutputs = updateFlag(m.ChownOutputs, o.ChownOutputs, o.present["chown_outputs"])
+	m.Selected = m.Selected || o.Selected
+	if len(o.present) > 0 {
+		present := types.StringSet{}
+		for key := range m.present {
+			present[key] = true
+		}
+		for key := range o.present {
+			present[key] = true
+		}
+		m.present = present
+	}
+	if len(o.Substitutions) > 0 {
+		substitutions := types.StringMap{}
+		for k, v := range m.Substitutions {
+			substitutions[k] = v
+		}
+		for k, v := range o.Substitutions {
+			substitutions[k] = v
+		}
+		m.Substitutions = substitutions
+	}
+	return m
+}
+
+// updateFlag returns the value of a flag set to value before and to override
+// by an update. Explicit overrides replace value, others are combined.
+func updateFlag(value bool, override bool, explicit bool) bool {
+	if explicit {
+		return override
+	}
+	return value || override
+}
+
 // Close closes stderr and stdout writers.
 func (m *ServiceMeta) Close() {
 	m.Stdout.Close()
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/ad-freiburg/gantry"
@@ -209,3 +210,51 @@ func TestServiceLogWrite(t *testing.T) {
 	}
 
 }
+
+func TestMetaServiceMetaUpdate(t *testing.T) {
+	cases := []struct {
+		meta     gantry.ServiceMeta
+		override gantry.ServiceMeta
+		result   gantry.ServiceMeta
+	}{
+		{gantry.ServiceMeta{}, gantry.ServiceMeta{}, gantry.ServiceMeta{}},
+		{gantry.ServiceMeta{Type: gantry.ServiceTypeStep}, gantry.ServiceMeta{Type: gantry.ServiceTypeService}, gantry.ServiceMeta{Type: gantry.ServiceTypeStep}},
+		{gantry.ServiceMeta{KeepAlive: gantry.KeepAliveReplace}, gantry.ServiceMeta{}, gantry.ServiceMeta{KeepAlive: gantry.KeepAliveReplace}},
+		{gantry.ServiceMeta{KeepAlive: gantry.KeepAliveReplace}, gantry.ServiceMeta{KeepAlive: gantry.KeepAliveNo}, gantry.ServiceMeta{KeepAlive: gantry.KeepAliveNo}},
+		{gantry.ServiceMeta{ExitCodeOverride: 2, IgnoreFailure: true}, gantry.ServiceMeta{Ignore: true}, gantry.ServiceMeta{ExitCodeOverride: 2, IgnoreFailure: true, Ignore: true}},
+		{gantry.ServiceMeta{ExitCodeOverride: 2}, gantry.ServiceMeta{ExitCodeOverride: 3, Selected: true}, gantry.ServiceMeta{ExitCodeOverride: 3, Selected: true}},
+		{gantry.ServiceMeta{Stdout: gantry.ServiceLog{Handler: gantry.LogHandlerDiscard}}, gantry.ServiceMeta{Stderr: gantry.ServiceLog{Handler: gantry.LogHandlerDiscard}}, gantry.ServiceMeta{Stdout: gantry.ServiceLog{Handler: gantry.LogHandlerDiscard}, Stderr: gantry.ServiceLog{Handler: gantry.LogHandlerDiscard}}},
+	}
+
+	for i, c := range cases {
+		if r := c.meta.Update(c.override); !reflect.DeepEqual(r, c.result) {
+			t.Errorf("Incorrect ServiceMeta@%d, got: '%#v', wanted: '%#v'", i, r, c.result)
+		}
+	}
+}
+
+func TestMetaServiceMetaUpdateExplicit(t *testing.T) {
+	cases := []struct {
+		meta     string
+		override string
+		result   gantry.ServiceMeta
+	}{
+		{`{"ignore": true, "ignore_failure": true, "keep_alive": "no"}`, `{}`, gantry.ServiceMeta{Ignore: true, IgnoreFailure: true, KeepAlive: gantry.KeepAliveNo}},
+		{`{"ignore": true, "ignore_failure": true, "keep_alive": "no"}`, `{"ignore": false, "ignore_failure": false, "keep_alive": "yes"}`, gantry.ServiceMeta{KeepAlive: gantry.KeepAliveYes}},
+		{`{"chown_outputs": true, "exit_code_override": 2}`, `{"chown_outputs": false, "exit_code_override": 0}`, gantry.ServiceMeta{}},
+	}
+
+	for i, c := range cases {
+		var meta, override gantry.ServiceMeta
+		if err := json.Unmarshal([]byte(c.meta), &meta); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(c.override), &override); err != nil {
+			t.Fatal(err)
+		}
+		r := meta.Update(override)
+		if r.Ignore != c.result.Ignore || r.IgnoreFailure != c.result.IgnoreFailure || r.ChownOutputs != c.result.ChownOutputs || r.KeepAlive != c.result.KeepAlive || r.ExitCodeOverride != c.result.ExitCodeOverride {
+			t.Errorf("Incorrect ServiceMeta@%d, got: '%#v', wanted: '%#v'", i, r, c.result)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ghodss/yaml"
+)
+
+// OutputPaths returns the host paths of the outputs of s. Outputs inside the
+// container path of a volume are mapped to the host path of the volume,
+// relative outputs are resolved from the current working directory.
+func (s Step) OutputPaths() []string {
+	result := make([]string, 0, len(s.Outputs))
+	for _, output := range s.Outputs {
+		result = append(result, s.outputPath(output))
+	}
+	return result
+}
+
+func (s Step) outputPath(output string) string {
+	if filepath.IsAbs(output) {
+		output = filepath.Clean(output)
+		best := ""
+		host := ""
+		for _, volume := range s.Volumes {
+			parts := strings.SplitN(volume, ":", 3)
+			if len(parts) < 2 {
+				continue
+			}
+			target := filepath.Clean(parts[1])
+			if (output == target || strings.HasPrefix(output, target+string(filepath.Separator))) && len(target) > len(best) {
+				best, host = target, parts[0]
+			}
+		}
+		if best != "" {
+			host, _ = filepath.Abs(host)
+			return filepath.Join(host, strings.TrimPrefix(output, best))
+		}
+	}
+	path, _ := filepath.Abs(output)
+	return path
+}
+
+// VerifyOutputs checks that all outputs of s exist and are not empty. The
+// host paths of the outputs are returned.
+func (s Step) VerifyOutputs() ([]string, error) {
+	paths := s.OutputPaths()
+	for i, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("output '%s' (%s) was not created", s.Outputs[i], path)
+			}
+			return nil, err
+		}
+		empty := fi.Size() == 0
+		if fi.IsDir() {
+			entries, err := ioutil.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			empty = len(entries) == 0
+		}
+		if empty {
+			return nil, fmt.Errorf("output '%s' (%s) is empty", s.Outputs[i], path)
+		}
+	}
+	return paths, nil
+}
+
+// OutputRecord stores the verified outputs of the steps of a run.
+type OutputRecord struct {
+	Steps map[string][]string `json:"steps"`
+	mutex sync.Mutex
+}
+
+// NewOutputRecord loads the record stored at path.
+func NewOutputRecord(path string) (*OutputRecord, error) {
+	r := &OutputRecord{Steps: map[string][]string{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	if err := yaml.Unmarshal(data, r); err != nil {
+		return r, fmt.Errorf("invalid output record '%s': %s", path, err)
+	}
+	if r.Steps == nil {
+		r.Steps = map[string][]string{}
+	}
+	return r, nil
+}
+
+// Add stores paths as outputs of step.
+func (r *OutputRecord) Add(step string, paths []string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Steps[step] = paths
+}
+
+// Merge adds the outputs of all steps of previous for which keep returns true,
+// unless r stores outputs for them.
+func (r *OutputRecord) Merge(previous *OutputRecord, keep func(step string) bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for step, paths := range previous.Steps {
+		if _, found := r.Steps[step]; !found && keep(step) {
+			r.Steps[step] = paths
+		}
+	}
+}
+
+// Write stores r as yaml at path.
+func (r *OutputRecord) Write(path string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Collect hardlinks all recorded outputs into dir/<step>/, outputs are copied
+// if they can not be linked. Outputs keep their path relative to the deepest
+// directory containing all outputs of their step. The number of collected
+// outputs is returned.
+func (r *OutputRecord) Collect(dir string) (int, error) {
+	count := 0
+	steps := make([]string, 0, len(r.Steps))
+	for step := range r.Steps {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		root := commonDir(r.Steps[step])
+		for _, path := range r.Steps[step] {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return count, err
+			}
+			target := filepath.Join(dir, step, rel)
+			if err := collectPath(path, target); err != nil {
+				return count, fmt.Errorf("could not collect output '%s' of '%s': %s", path, step, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// commonDir returns the deepest directory containing all paths.
+func commonDir(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	root := filepath.Dir(paths[0])
+	for _, path := range paths[1:] {
+		for root != filepath.Dir(root) && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			root = filepath.Dir(root)
+		}
+	}
+	return root
+}
+
+// collectPath hardlinks or copies the file or directory src to dst.
+func collectPath(src string, dst string) error {
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target, fi.Mode())
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,266 @@
+package gantry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestStepOutputPaths(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Step{
+		Service: Service{Volumes: []string{"./data:/data", "/tmp/index:/data/index:ro"}},
+		Outputs: []string{"/data/a.txt", "/data/index/b", "/data", "out/c", "/other"},
+	}
+	wanted := []string{
+		filepath.Join(cwd, "data", "a.txt"),
+		"/tmp/index/b",
+		filepath.Join(cwd, "data"),
+		filepath.Join(cwd, "out", "c"),
+		"/other",
+	}
+	for i, r := range s.OutputPaths() {
+		if r != wanted[i] {
+			t.Errorf("Incorrect path for '%s', got: '%s', wanted: '%s'", s.Outputs[i], r, wanted[i])
+		}
+	}
+}
+
+func TestPipelineExecuteStepsOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join("data", "index"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for path, content := range map[string]string{"data/words.txt": "a b c", "data/index/part": "1", "data/empty": ""} {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(GantryDef, []byte(`version: "2.0"
+steps:
+  unzip:
+    image: alpine
+    volumes:
+      - ./data:/data
+    outputs:
+      - /data/words.txt
+      - /data/index
+  index:
+    image: alpine
+    outputs:
+      - data/empty
+    after:
+      - unzip
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPipeline([]string{GantryDef}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	localRunner := NewNoopRunner(false)
+	p.localRunner = localRunner
+	p.Network = Network("test")
+
+	err = p.ExecuteSteps()
+	if err == nil || !strings.Contains(err.Error(), "output 'data/empty'") {
+		t.Errorf("Incorrect error, got: '%v', wanted error about empty output", err)
+	}
+	checkCallsAndCalled(t, localRunner, "ContainerRunner(index,test)", 1, 1)
+
+	record, err := NewOutputRecord(GantryOutputs)
+	if err != nil {
+		t.Fatalf("unexpected error reading record: '%s'", err)
+	}
+	if _, found := record.Steps["index"]; found {
+		t.Errorf("outputs of failed step 'index' recorded")
+	}
+	if r := record.Steps["unzip"]; len(r) != 2 || r[0] != filepath.Join(dir, "data", "words.txt") {
+		t.Errorf("Incorrect outputs of 'unzip', got: '%v'", r)
+	}
+
+	count, err := record.Collect("archive")
+	if err != nil {
+		t.Fatalf("unexpected error collecting outputs: '%s'", err)
+	}
+	if count != 2 {
+		t.Errorf("Incorrect number of collected outputs, got: %d, wanted: 2", count)
+	}
+	for path, content := range map[string]string{"archive/unzip/words.txt": "a b c", "archive/unzip/index/part": "1"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil || string(data) != content {
+			t.Errorf("Incorrect content of '%s', got: '%s' (%v), wanted: '%s'", path, data, err, content)
+		}
+	}
+}
+
+func TestPipelineExecuteStepsOutputsPartialRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(GantryDef, []byte(`version: "2.0"
+steps:
+  a:
+    image: alpine
+    outputs:
+      - a.txt
+  b:
+    image: alpine
+    outputs:
+      - b.txt
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(GantryOutputs, []byte("steps:\n  a:\n  - /old/a.txt\n  removed:\n  - /old/removed.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPipeline([]string{GantryDef}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{"b": true})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	p.localRunner = NewNoopRunner(false)
+	p.Network = Network("test")
+	if err := p.ExecuteSteps(); err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+
+	record, err := NewOutputRecord(GantryOutputs)
+	if err != nil {
+		t.Fatalf("unexpected error reading record: '%s'", err)
+	}
+	if r := record.Steps["a"]; len(r) != 1 || r[0] != "/old/a.txt" {
+		t.Errorf("Incorrect outputs of not selected step 'a', got: '%v'", r)
+	}
+	if r := record.Steps["b"]; len(r) != 1 || r[0] != filepath.Join(dir, "b.txt") {
+		t.Errorf("Incorrect outputs of 'b', got: '%v'", r)
+	}
+	if _, found := record.Steps["removed"]; found {
+		t.Errorf("outputs of removed step kept")
+	}
+}
+
+func TestPipelineExecuteStepsOutputsPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	project := filepath.Join(dir, "project")
+	if err := os.MkdirAll(project, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(project, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	definition := filepath.Join(project, GantryDef)
+	if err := ioutil.WriteFile(definition, []byte(`version: "2.0"
+steps:
+  a:
+    image: alpine
+    volumes:
+      - `+project+`:/data
+    outputs:
+      - /data/a.txt
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPipeline([]string{definition}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	p.localRunner = NewNoopRunner(false)
+	p.Network = Network("test")
+	if err := p.ExecuteSteps(); err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+
+	// The record is stored next to the definition
+	if r := p.OutputsPath; r != filepath.Join(project, GantryOutputs) {
+		t.Errorf("Incorrect outputs path, got: '%s'", r)
+	}
+	if _, err := os.Stat(GantryOutputs); !os.IsNotExist(err) {
+		t.Errorf("record written to working directory, error: '%v'", err)
+	}
+	record, err := NewOutputRecord(OutputsRecordPath([]string{definition}))
+	if err != nil {
+		t.Fatalf("unexpected error reading record: '%s'", err)
+	}
+	if r := record.Steps["a"]; len(r) != 1 || r[0] != filepath.Join(project, "a.txt") {
+		t.Errorf("Incorrect outputs of 'a', got: '%v'", r)
+	}
+}
+
+func TestOutputRecordCollectSameNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"x", "y"} {
+		if err := os.MkdirAll(filepath.Join(dir, "out", name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "out", name, "data"), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record := &OutputRecord{Steps: map[string][]string{
+		"a": {filepath.Join(dir, "out", "x", "data"), filepath.Join(dir, "out", "y", "data")},
+	}}
+	archive := filepath.Join(dir, "archive")
+	count, err := record.Collect(archive)
+	if err != nil || count != 2 {
+		t.Fatalf("Incorrect result, got: %d, '%v', wanted: 2", count, err)
+	}
+	for _, name := range []string{"x", "y"} {
+		path := filepath.Join(archive, "a", name, "data")
+		if data, err := ioutil.ReadFile(path); err != nil || string(data) != name {
+			t.Errorf("Incorrect content of '%s', got: '%s' (%v), wanted: '%s'", path, data, err, name)
+		}
+	}
+}
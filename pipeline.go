@@ -3,7 +3,6 @@ package gantry // import "github.com/ad-freiburg/gantry"
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -13,7 +12,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/ad-freiburg/gantry/preprocessor"
 	"github.com/ad-freiburg/gantry/types"
 	"github.com/ghodss/yaml"
 )
@@ -40,17 +38,26 @@ type Pipeline struct {
 	Definition  *PipelineDefinition
 	Environment *PipelineEnvironment
 	Network     Network
+	Lock        *ImageLock
+	// LockPath is the lock file of the pipeline, it is stored next to the
+	// first definition file.
+	LockPath string
+	// OutputsPath is the record of the outputs of the last run, it is stored
+	// next to the first definition file as well.
+	OutputsPath string
+	workspaces  *workspaceManager
 	localRunner Runner
 	noopRunner  Runner
 }
 
 // NewPipeline creates a new Pipeline from given files which ignores the
 // existence of steps with names provided in ignoreSteps.
-func NewPipeline(definitionPath, environmentPath string, environment types.StringMap, ignoredSteps types.StringSet, selectedSteps types.StringSet) (*Pipeline, error) {
+func NewPipeline(definitionPaths []string, environmentPaths []string, environment types.StringMap, ignoredSteps types.StringSet, selectedSteps types.StringSet) (*Pipeline, error) {
 	p := &Pipeline{}
 	var err error
 	// Load environment
-	p.Environment, err = NewPipelineEnvironment(environmentPath, environment, ignoredSteps, selectedSteps)
+	p.Environment, err = NewPipelineEnvironment(environmentPaths, environment, ignoredSteps, selectedSteps)
+	problemsErr := reportProblems(p.Environment.Problems)
 	if err != nil {
 		// As environment files are optional, handle if non is accessible
 		if e, ok := err.(*os.PathError); ok && e.Err == syscall.ENOENT {
@@ -59,11 +66,42 @@ func NewPipeline(definitionPath, environmentPath string, environment types.Strin
 			return nil, err
 		}
 	}
+	if problemsErr != nil {
+		return nil, fmt.Errorf("invalid environment: %s", problemsErr)
+	}
 	// Load definition
-	p.Definition, err = NewPipelineDefinition(definitionPath, p.Environment)
+	p.Definition, err = NewPipelineDefinition(definitionPaths, p.Environment)
 	p.localRunner = NewLocalRunner("pipeline", os.Stdout, os.Stderr)
 	p.noopRunner = NewNoopRunner(false)
-	return p, err
+	if err != nil {
+		return p, err
+	}
+	p.workspaces = newWorkspaceManager(p.Definition, p.Environment)
+	// Pin images if a lock file exists
+	p.LockPath = GantryLock
+	if len(definitionPaths) > 0 {
+		p.LockPath = filepath.Join(filepath.Dir(definitionPaths[0]), GantryLock)
+	}
+	p.OutputsPath = OutputsRecordPath(definitionPaths)
+	p.Lock, err = NewImageLock(p.LockPath)
+	if err != nil {
+		return p, err
+	}
+	if !p.Lock.IsEmpty() {
+		for _, warning := range p.Lock.Pin(p.Definition.Steps) {
+			log.Printf("Warning: %s, run 'gantry lock' to update %s", warning, p.LockPath)
+		}
+	}
+	return p, nil
+}
+
+// OutputsRecordPath returns the path of the record of the outputs of the
+// pipeline defined by definitionPaths.
+func OutputsRecordPath(definitionPaths []string) string {
+	if len(definitionPaths) == 0 {
+		return GantryOutputs
+	}
+	return filepath.Join(filepath.Dir(definitionPaths[0]), GantryOutputs)
 }
 
 // CleanUp removes containers and temporary data.
@@ -96,6 +134,9 @@ func (p *Pipeline) CleanUp(signal os.Signal) error {
 			step.Meta.Close()
 		}
 	}
+	if err := p.workspaces.CleanUp(p.removeDirData); err != nil {
+		pipelineLogger.Printf("Error removing workspaces: %s", err)
+	}
 	// If we are allowed, start a cleanup container to delete all files in the
 	// temporary directories as deletion from outside will fail when
 	// user-namespaces are used.
@@ -119,14 +160,43 @@ func (p Pipeline) Check() error {
 	if err != nil {
 		return err
 	}
+	if err := p.Definition.Workspaces.Check(); err != nil {
+		return err
+	}
 	for _, step := range pipelines.AllSteps() {
 		if err := step.Check(); err != nil {
 			return err
 		}
+		for _, value := range step.outputReferenceFields() {
+			for _, match := range workspaceReference.FindAllStringSubmatch(value, -1) {
+				if _, found := p.Definition.Workspaces[match[1]]; !found {
+					return fmt.Errorf("unknown workspace '%s' used by '%s'", match[1], step.ColoredName())
+				}
+			}
+		}
 	}
 	return nil
 }
 
+// WorkspaceDirs returns all existing directories of the workspace name.
+func (p Pipeline) WorkspaceDirs(name string) ([]string, error) {
+	return p.workspaces.Dirs(name)
+}
+
+// CleanWorkspaces removes all directories of the workspaces names. Without
+// names all workspaces are cleaned, persistent workspaces only if all is
+// set.
+func (p Pipeline) CleanWorkspaces(names []string, all bool) error {
+	if len(names) == 0 {
+		for _, name := range sortedKeys(p.Definition.Workspaces) {
+			if all || p.Definition.Workspaces[name].lifecycle() != WorkspaceLifecyclePersistent {
+				names = append(names, name)
+			}
+		}
+	}
+	return p.workspaces.Clean(names, p.removeDirData)
+}
+
 // GetRunnerForMeta selects a suitable runner given a ServiceMeta instance.
 func (p Pipeline) GetRunnerForMeta(meta ServiceMeta) Runner {
 	if meta.Ignore {
@@ -188,16 +258,22 @@ func (p *Pipelines) Check() error {
 }
 
 type pipelineDefinitionJSON struct {
-	Version  string
-	Steps    StepList
-	Services ServiceList
+	Version    string
+	Steps      StepList
+	Services   ServiceList
+	Secrets    SecretDefinitions
+	Workspaces Workspaces
 }
 
 // PipelineDefinition stores docker-compose services and gantry steps.
 type PipelineDefinition struct {
-	Version   string
-	Steps     StepList
-	pipelines *Pipelines
+	Version    string
+	Steps      StepList
+	Secrets    SecretDefinitions
+	Workspaces Workspaces
+	pipelines  *Pipelines
+	// matrices stores the names of the instances of each matrix step.
+	matrices map[string][]string
 }
 
 // UnmarshalJSON loads a PipelineDefinition from json using the pipelineJSON struct.
@@ -210,60 +286,103 @@ func (p *PipelineDefinition) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	result.Version = parsedJSON.Version
+	result.Secrets = parsedJSON.Secrets
+	if result.Secrets == nil {
+		result.Secrets = SecretDefinitions{}
+	}
+	result.Workspaces = parsedJSON.Workspaces
+	if result.Workspaces == nil {
+		result.Workspaces = Workspaces{}
+	}
 	for name, service := range parsedJSON.Services {
-		service.Meta = ServiceMeta{
-			Type: ServiceTypeService,
+		service.Meta = ServiceMeta{}
+		if service.GantryMeta != nil {
+			service.Meta = *service.GantryMeta
 		}
+		service.Meta.Type = ServiceTypeService
 		result.Steps[name] = service
 	}
 	for name, step := range parsedJSON.Steps {
 		if _, found := result.Steps[name]; found {
 			return fmt.Errorf("duplicate step/service '%s'", name)
 		}
-		step.Meta = ServiceMeta{
-			Type:      ServiceTypeStep,
-			KeepAlive: KeepAliveNo,
+		step.Meta = ServiceMeta{}
+		if step.GantryMeta != nil {
+			step.Meta = *step.GantryMeta
 		}
+		step.Meta.Type = ServiceTypeStep
+		step.Meta.KeepAlive = KeepAliveNo
 		result.Steps[name] = step
 	}
 	*p = result
 	return nil
 }
 
-// NewPipelineDefinition generates a pipeline definition from a path and an environment.
-func NewPipelineDefinition(path string, env *PipelineEnvironment) (*PipelineDefinition, error) {
-	dir, err := os.Getwd()
+// NewPipelineDefinition generates a pipeline definition from a list of paths
+// and an environment. Each file is preprocessed separately, later files are
+// merged into earlier ones. If no path is given the default definition of the
+// current directory is used.
+func NewPipelineDefinition(paths []string, env *PipelineEnvironment) (*PipelineDefinition, error) {
+	if len(paths) == 0 {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		path := ""
+		defaultPath := filepath.Join(dir, GantryDef)
+		if _, err := os.Stat(defaultPath); path == "" && err == nil {
+			path = defaultPath
+		}
+		defaultPath = filepath.Join(dir, DockerCompose)
+		if _, err := os.Stat(defaultPath); path == "" && err == nil {
+			path = defaultPath
+		}
+		paths = []string{path}
+	}
+	// Load, preprocess and resolve definitions
+	loader, err := newDefinitionLoader(env)
 	if err != nil {
 		return nil, err
 	}
-	defaultPath := filepath.Join(dir, GantryDef)
-	if _, err := os.Stat(defaultPath); path == "" && err == nil {
-		path = defaultPath
+	docs := make([]map[string]interface{}, len(paths))
+	included := map[string][]string{}
+	for i, path := range paths {
+		docs[i], err = loader.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, names := range loader.instances[abs] {
+			included[name] = names
+		}
 	}
-	defaultPath = filepath.Join(dir, DockerCompose)
-	if _, err := os.Stat(defaultPath); path == "" && err == nil {
-		path = defaultPath
+	if err := reportProblems(loader.problems); err != nil {
+		return nil, fmt.Errorf("invalid definition: %s", err)
 	}
-	file, err := os.Open(path)
+	doc, origins, err := mergeDefinitions(docs, paths)
 	if err != nil {
-		pipelineLogger.Println("Could not open pipeline definition.")
 		return nil, err
 	}
-	defer file.Close()
-
-	data, err := ioutil.ReadAll(file)
-	if err != nil {
+	if err := expandTemplates(doc, origins); err != nil {
 		return nil, err
 	}
-	// Apply environment to yaml
-	preproc, err := preprocessor.NewPreprocessor()
+	matrices, err := expandMatrices(doc)
 	if err != nil {
 		return nil, err
 	}
-	data, err = preproc.Process(data, env)
+	// Matrix steps of included pipelines are already expanded
+	replaceAllMatrixDependencies(doc, included)
+	for name, names := range included {
+		matrices[name] = names
+	}
+	data, err := json.Marshal(doc)
 	if err != nil {
 		return nil, err
 	}
+	// JSON is valid YAML, use yaml.Unmarshal to keep its type conversions
 	d := &PipelineDefinition{}
 	if err := yaml.Unmarshal(data, d); err != nil {
 		return d, err
@@ -271,16 +390,35 @@ func NewPipelineDefinition(path string, env *PipelineEnvironment) (*PipelineDefi
 	if err := d.checkVersion(); err != nil {
 		return d, err
 	}
-	// Update with specific meta if defined
+	d.matrices = matrices
+	abs, err := filepath.Abs(paths[0])
+	if err != nil {
+		return d, err
+	}
+	// Included steps and services use the directory of their own definition
+	for name, step := range d.Steps {
+		step.dir = filepath.Dir(abs)
+		if dir, found := loader.dirs[name]; found {
+			step.dir = dir
+		}
+		d.Steps[name] = step
+	}
+	// Update with specific meta if defined, meta of matrix steps applies to
+	// all instances
 	for name, meta := range env.Steps {
-		s, ok := d.Steps[name]
-		if ok {
-			meta.Type = s.Meta.Type
-			s.Meta = meta
-			if meta.Type == ServiceTypeStep {
-				s.Meta.KeepAlive = KeepAliveNo
+		names := []string{name}
+		if instances, found := d.matrices[name]; found {
+			names = instances
+		}
+		if _, ok := d.Steps[names[0]]; ok {
+			for _, name := range names {
+				s := d.Steps[name]
+				s.Meta = s.Meta.Update(meta)
+				if s.Meta.Type == ServiceTypeStep {
+					s.Meta.KeepAlive = KeepAliveNo
+				}
+				d.Steps[name] = s
 			}
-			d.Steps[name] = s
 		} else {
 			if meta.Selected {
 				return d, fmt.Errorf("no such service or step: %s", name)
@@ -290,6 +428,23 @@ func NewPipelineDefinition(path string, env *PipelineEnvironment) (*PipelineDefi
 			}
 		}
 	}
+	if err := d.resolveSecrets(env); err != nil {
+		return d, err
+	}
+	// Name images of steps without explicit image using the tag template
+	if env.ImageTagTemplate != "" {
+		template, err := resolveImageTagTemplate(env.ImageTagTemplate, env)
+		if err != nil {
+			return d, err
+		}
+		// Without project name the directory of the definition is used
+		project := NormalizeProjectName(filepath.Base(filepath.Dir(abs)))
+		for n, step := range d.Steps {
+			step.imageTemplate = template
+			step.imageProject = project
+			d.Steps[n] = step
+		}
+	}
 	// Open output files for container logs
 	for n, step := range d.Steps {
 		if err = step.Meta.Open(); err != nil {
@@ -300,6 +455,34 @@ func NewPipelineDefinition(path string, env *PipelineEnvironment) (*PipelineDefi
 	return d, nil
 }
 
+// resolveSecrets reads all secrets of p and links them to the steps using
+// them. Build secrets without own source use the secret of the same name.
+func (p *PipelineDefinition) resolveSecrets(env *PipelineEnvironment) error {
+	if err := p.Secrets.resolve(env); err != nil {
+		return err
+	}
+	for name, step := range p.Steps {
+		for i, secret := range step.Secrets {
+			def, found := p.Secrets[secret.Source]
+			if !found {
+				return fmt.Errorf("unknown secret '%s' for '%s'", secret.Source, name)
+			}
+			step.Secrets[i].path = def.path
+		}
+		for i, secret := range step.BuildInfo.Secrets {
+			if secret.File != "" || secret.Environment != "" {
+				continue
+			}
+			def, found := p.Secrets[secret.Source]
+			if !found {
+				return fmt.Errorf("unknown build secret '%s' for '%s'", secret.Source, name)
+			}
+			step.BuildInfo.Secrets[i].File = def.path
+		}
+	}
+	return nil
+}
+
 // https://docs.docker.com/compose/compose-file/compose-versioning/#versioning
 func (p *PipelineDefinition) checkVersion() error {
 	var err error
@@ -386,6 +569,15 @@ func (p *PipelineDefinition) Pipelines() (*Pipelines, error) {
 				ignoredSteps[name] = true
 			}
 		}
+		// Ignore all not selected steps outside of the active profiles
+		for name, step := range p.Steps {
+			if step.Meta.Selected || step.IsInActiveProfile(ActiveProfiles) {
+				continue
+			}
+			step.Meta.Ignore = true
+			p.Steps[name] = step
+			ignoredSteps[name] = true
+		}
 
 		// Build list of active steps
 		steps := make(map[string]Step)
@@ -410,6 +602,7 @@ func (p *PipelineDefinition) Pipelines() (*Pipelines, error) {
 type runConfig struct {
 	usePreconditions bool
 	selection        func(step Step) bool
+	condition        func(step Step) (bool, error)
 	pre              func(runner Runner, step Step) error
 	run              func(runner Runner, step Step) func() error
 	post             func(runner Runner, step Step) error
@@ -433,6 +626,20 @@ func runCommandParallel(config runConfig, runner Runner, step Step, durations *s
 		return
 	}
 
+	// Skip step if its condition is false, dependents are not blocked.
+	// Ignored steps are not run, their conditions are not evaluated.
+	if config.condition != nil && !step.Meta.Ignore {
+		ok, err := config.condition(step)
+		if err != nil {
+			reportStepError(step, err, abort)
+			return
+		}
+		if !ok {
+			pipelineLogger.Printf("- Skipping %s: condition '%s' is false", step.ColoredContainerName(), step.When)
+			return
+		}
+	}
+
 	// Execute pre for step if provided
 	if config.pre != nil {
 		if err := config.pre(runner, step); err != nil {
@@ -443,19 +650,7 @@ func runCommandParallel(config runConfig, runner Runner, step Step, durations *s
 	// Execute run for step
 	duration, err := executeF(config.run(runner, step))
 	if err != nil {
-		pipelineLogger.Printf("  %s: %s", step.ColoredContainerName(), err)
-		if !step.Meta.IgnoreFailure {
-			// If no previous error is stored, store the current error in the
-			// abort channel.
-			if len(abort) < 1 {
-				abort <- ExecutionError{
-					err:              err,
-					exitCodeOverride: step.Meta.ExitCodeOverride,
-				}
-			}
-		} else {
-			pipelineLogger.Printf("  Ignoring error of: %s", step.ColoredContainerName())
-		}
+		reportStepError(step, err, abort)
 	}
 	durations.Store(step.Name, duration)
 
@@ -467,6 +662,24 @@ func runCommandParallel(config runConfig, runner Runner, step Step, durations *s
 	}
 }
 
+// reportStepError logs err of step and stores it in abort, unless failures
+// of step are ignored.
+func reportStepError(step Step, err error, abort chan error) {
+	pipelineLogger.Printf("  %s: %s", step.ColoredContainerName(), err)
+	if step.Meta.IgnoreFailure {
+		pipelineLogger.Printf("  Ignoring error of: %s", step.ColoredContainerName())
+		return
+	}
+	// If no previous error is stored, store the current error in the abort
+	// channel.
+	if len(abort) < 1 {
+		abort <- ExecutionError{
+			err:              err,
+			exitCodeOverride: step.Meta.ExitCodeOverride,
+		}
+	}
+}
+
 func (p Pipeline) runCommand(config runConfig) (int, time.Duration, time.Duration, error) {
 	pipelines, err := p.Definition.Pipelines()
 	if err != nil {
@@ -571,6 +784,90 @@ func (p Pipeline) PullImages(force bool) error {
 	return err
 }
 
+// PushImages pushes all buildable images of Pipeline p in parallel.
+func (p Pipeline) PushImages() error {
+	if Verbose {
+		pipelineLogger.Printf("Push Images:")
+	}
+	count, elapsedTime, totalElapsedTime, err := p.runCommand(runConfig{
+		selection: func(step Step) bool {
+			return step.IsPushable()
+		},
+		run: func(runner Runner, step Step) func() error {
+			return runner.ImagePusher(step)
+		},
+	})
+	if Verbose {
+		pipelineLogger.Printf("Pushed %d images in %s", count, elapsedTime)
+		pipelineLogger.Printf("Total time spent pushing images: %s", totalElapsedTime)
+	}
+	return err
+}
+
+// UpdateLock pulls all pullable images of Pipeline p, resolves them to their
+// digests and writes the lock file to path. Images of ignored steps are
+// resolved as well, so partial runs keep the lock complete. Entries of images
+// which could not be resolved are kept.
+func (p *Pipeline) UpdateLock(path string) error {
+	if Verbose {
+		pipelineLogger.Printf("Lock Images:")
+	}
+	// Resolve the unpinned images
+	(&ImageLock{}).Pin(p.Definition.Steps)
+	p.Definition.pipelines = nil
+	digests := &sync.Map{}
+	count, elapsedTime, _, err := p.runCommand(runConfig{
+		selection: func(step Step) bool {
+			return step.IsPullable()
+		},
+		run: func(runner Runner, step Step) func() error {
+			if step.Meta.Ignore {
+				runner = p.localRunner.Copy()
+			}
+			return func() error {
+				if err := runner.ImagePuller(step)(); err != nil {
+					return err
+				}
+				digest, err := runner.ImageDigestResolver(step)()
+				if err != nil {
+					return err
+				}
+				if digest != "" {
+					digests.Store(step.ImageName(), digest)
+				}
+				return nil
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	lock := &ImageLock{Images: map[string]string{}}
+	for _, step := range p.Definition.Steps {
+		if !step.IsPullable() {
+			continue
+		}
+		image := step.ImageName()
+		if digest, found := digests.Load(image); found {
+			lock.Images[image] = digest.(string)
+		} else if p.Lock != nil {
+			if digest, found := p.Lock.Images[image]; found {
+				lock.Images[image] = digest
+			}
+		}
+	}
+	if err := lock.Write(path); err != nil {
+		return err
+	}
+	if Verbose {
+		pipelineLogger.Printf("Locked %d images in %s", count, elapsedTime)
+	}
+	p.Lock = lock
+	lock.Pin(p.Definition.Steps)
+	p.Definition.pipelines = nil
+	return nil
+}
+
 // KillContainers kills all running containers of Pipeline p.
 func (p Pipeline) KillContainers(preRun bool) error {
 	_, _, _, err := p.runCommand(runConfig{
@@ -622,34 +919,68 @@ func (p Pipeline) RemoveNetwork() error {
 
 // RemoveTempDirData deletes all data stored in temporary directories.
 func (p Pipeline) RemoveTempDirData() error {
-	if len(p.Environment.tempPaths) < 1 {
+	paths := make([]string, 0, len(p.Environment.tempPaths))
+	for _, v := range p.Environment.tempPaths {
+		paths = append(paths, v)
+	}
+	return p.removeDirData(paths)
+}
+
+// removeDirData deletes all data stored in the directories paths using a
+// container, as deletion from outside will fail when user-namespaces are
+// used.
+func (p Pipeline) removeDirData(paths []string) error {
+	if len(paths) < 1 {
 		return nil
 	}
-	step := Step{
+	return p.runHelper(Step{
 		Service: Service{
 			Name:       "TempDirCleanUp",
 			Image:      "alpine",
 			Entrypoint: []string{"/bin/sh"},
 			Command:    []string{"-c", "rm -rf /data/*/*"},
-			Meta: ServiceMeta{
-				Stdout: ServiceLog{
-					Handler: LogHandlerStdout,
-				},
-				Stderr: ServiceLog{
-					Handler: LogHandlerStdout,
-				},
-			},
 		},
+	}, paths)
+}
+
+// chownOutputs changes the owner of all writable host paths mounted by step
+// to the user running gantry using a container, as files written inside of
+// containers are owned by other users when user-namespaces are used.
+// Rootless engines map root inside of containers to the user running them,
+// so files are owned by root in that case. With userns-remap the ids of the
+// host user can not be set from inside of containers, the files are owned by
+// the matching subordinate ids instead.
+func (p Pipeline) chownOutputs(step Step) error {
+	paths := step.WritableHostPaths()
+	if len(paths) < 1 {
+		return nil
+	}
+	owner := fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
+	if _, local := p.localRunner.(*LocalRunner); local && isEngineRootless() {
+		owner = "0:0"
 	}
+	return p.runHelper(Step{
+		Service: Service{
+			Name:       step.Name + "-chown",
+			Image:      "alpine",
+			Entrypoint: []string{"/bin/sh"},
+			Command:    []string{"-c", "chown -R " + owner + " /data/*"},
+			Meta:       ServiceMeta{Type: ServiceTypeStep},
+		},
+	}, paths)
+}
+
+// runHelper runs step with all paths mounted as /data/i.
+func (p Pipeline) runHelper(step Step, paths []string) error {
+	step.Meta.Stdout = ServiceLog{Handler: LogHandlerStdout}
+	step.Meta.Stderr = ServiceLog{Handler: LogHandlerStdout}
 	if err := step.Meta.Open(); err != nil {
 		pipelineLogger.Printf("Error creating log output of %s: %s", step.ColoredName(), err)
 	}
 	step.InitColor()
-	// Mount all temporary directories as /data/i
-	i := 0
-	for _, v := range p.Environment.tempPaths {
+	// Mount all directories as /data/i
+	for i, v := range paths {
 		step.Volumes = append(step.Volumes, fmt.Sprintf("%s:/data/%d", v, i))
-		i++
 	}
 	runner := p.GetRunnerForMeta(step.Meta)
 	if _, err := runner.ContainerKiller(step)(); err != nil {
@@ -675,8 +1006,38 @@ func (p Pipeline) RemoveTempDirData() error {
 // there dependencies. Each step/service is run as soon as possible.
 func (p Pipeline) ExecuteSteps() error {
 	pipelineLogger.Printf("Execute:")
+	outputs := &OutputRecord{Steps: map[string][]string{}}
+	// Provide outputs files for all steps whose values are used by others
+	referenced := types.StringSet{}
+	for _, step := range p.Definition.Steps {
+		for name := range step.OutputReferences() {
+			referenced[name] = true
+		}
+	}
+	var values *stepOutputs
+	if len(referenced) > 0 {
+		dir, err := p.Environment.GetOrCreateTempDir("gantry_outputs")
+		if err != nil {
+			return err
+		}
+		values = &stepOutputs{dir: dir}
+		if err := values.clear(referenced); err != nil {
+			return err
+		}
+	}
 	count, elapsedTime, totalElapsedTime, err := p.runCommand(runConfig{
 		usePreconditions: true,
+		condition: func(step Step) (bool, error) {
+			if step.When == "" {
+				return true, nil
+			}
+			condition, err := ParseCondition(step.When)
+			if err != nil {
+				return false, err
+			}
+			// Substitutions of the step shadow the global ones
+			return condition.Evaluate(&stepEnvironment{Environment: p.Environment, substitutions: step.Meta.Substitutions}, step.dir)
+		},
 		pre: func(runner Runner, step Step) error {
 			count, err := runner.ContainerKiller(step)()
 			if err != nil {
@@ -693,12 +1054,70 @@ func (p Pipeline) ExecuteSteps() error {
 		},
 		run: func(runner Runner, step Step) func() error {
 			return func() error {
-				return runner.ContainerRunner(step, p.Network)()
+				if values != nil {
+					if referenced[step.Name] && !step.Meta.Ignore {
+						volume, err := values.prepare(step.Name)
+						if err != nil {
+							return err
+						}
+						step.Volumes = append(append([]string{}, step.Volumes...), volume)
+					}
+					var err error
+					if step, err = step.ResolveOutputReferences(values.read); err != nil {
+						return err
+					}
+				}
+				var err error
+				if step, err = p.workspaces.Resolve(step); err != nil {
+					return err
+				}
+				runErr := runner.ContainerRunner(step, p.Network)()
+				// Outputs of failed steps are handed back as well, they may
+				// be kept for inspection
+				if step.Meta.Type == ServiceTypeStep && !step.Meta.Ignore && (step.Meta.ChownOutputs || p.Environment.ChownOutputs) {
+					if err := p.chownOutputs(step); err != nil {
+						if runErr != nil {
+							pipelineLogger.Printf("Error changing owner of outputs of %s: %s", step.ColoredName(), err)
+							return runErr
+						}
+						return fmt.Errorf("could not change owner of outputs: %s", err)
+					}
+				}
+				if runErr != nil {
+					return runErr
+				}
+				if step.Meta.Type != ServiceTypeStep || step.Meta.Ignore || len(step.Outputs) == 0 {
+					return nil
+				}
+				// Fail steps which did not produce their outputs
+				paths, err := step.VerifyOutputs()
+				if err != nil {
+					return err
+				}
+				outputs.Add(step.Name, paths)
+				return nil
 			}
 		},
 	})
 	pipelineLogger.Printf("Executed %d steps in %s", count, elapsedTime)
 	pipelineLogger.Printf("Total time spent inside steps: %s", totalElapsedTime)
+	if err != nil {
+		p.workspaces.Failed()
+	}
+	// Partial runs keep the recorded outputs of all steps not run
+	previous, perr := NewOutputRecord(p.OutputsPath)
+	if perr != nil && !os.IsNotExist(perr) {
+		pipelineLogger.Printf("Error reading %s: %s", p.OutputsPath, perr)
+	}
+	outputs.Merge(previous, func(name string) bool {
+		step, found := p.Definition.Steps[name]
+		return found && step.Meta.Ignore
+	})
+	if len(outputs.Steps) > 0 {
+		if werr := outputs.Write(p.OutputsPath); werr != nil {
+			pipelineLogger.Printf("Error writing %s: %s", p.OutputsPath, werr)
+		}
+	}
 	return err
 }
 
@@ -61,7 +61,7 @@ func TestPipelineCompatibilityWordpress(t *testing.T) {
 
 	// Perform parse and tests
 	for i, c := range cases {
-		p, err := gantry.NewPipeline(tmpDef.Name(), "", types.StringMap{}, types.StringSet{}, c.selected)
+		p, err := gantry.NewPipeline([]string{tmpDef.Name()}, []string{}, types.StringMap{}, types.StringSet{}, c.selected)
 		if err != nil {
 			t.Error(err)
 		}
@@ -98,7 +98,7 @@ func TestPipelineCompatibilityUnknownService(t *testing.T) {
 
 	// Perform parse and tests
 	for i, c := range cases {
-		_, err := gantry.NewPipeline(tmpDef.Name(), "", types.StringMap{}, types.StringSet{}, c.selected)
+		_, err := gantry.NewPipeline([]string{tmpDef.Name()}, []string{}, types.StringMap{}, types.StringSet{}, c.selected)
 		if err != nil {
 			if c.err == "" {
 				t.Errorf("unexpected error @%d, got: %s, wanted: nil", i, err)
@@ -1,10 +1,13 @@
 package gantry
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/ad-freiburg/gantry/types"
@@ -71,7 +74,7 @@ func TestPipelineGetRunnerForMeta(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -101,7 +104,7 @@ func TestPipelineBuildImages(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -132,7 +135,7 @@ func TestPipelineBuildImagesForced(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -163,7 +166,7 @@ func TestPipelinePullImages(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -194,12 +197,78 @@ func TestPipelinePullImages(t *testing.T) {
 	}
 }
 
+func TestPipelinePushImages(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  build index:
+    build:
+      context: ./dummy
+  b:
+    image: localhost:5000/b:stable
+    build: ./dummy
+  c:
+    image: alpine
+    after:
+      - build index
+`, `image_tag_template: localhost:5000/${PROJECT}/${STEP}:${GIT_SHA}
+substitutions:
+  GIT_SHA: 1a2b3c4
+`)
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+	defer func(name string) { ProjectName = name }(ProjectName)
+	ProjectName = "project"
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	localRunner := NewNoopRunner(false)
+	p.localRunner = localRunner
+
+	images := map[string]string{
+		"build index": "localhost:5000/project/build_index:1a2b3c4",
+		"b":           "localhost:5000/b:stable",
+		"c":           "alpine",
+	}
+	for name, image := range images {
+		if r := p.Definition.Steps[name].ImageName(); r != image {
+			t.Errorf("incorrect image for '%s', got: '%s', wanted '%s'", name, r, image)
+		}
+	}
+	// Without project name the directory of the definition is used
+	ProjectName = ""
+	project := NormalizeProjectName(filepath.Base(filepath.Dir(tmpDef)))
+	if r, image := p.Definition.Steps["build index"].ImageName(), "localhost:5000/"+project+"/build_index:1a2b3c4"; r != image {
+		t.Errorf("incorrect image without project name, got: '%s', wanted '%s'", r, image)
+	}
+	ProjectName = "project"
+
+	cases := []struct {
+		key    string
+		runner *NoopRunner
+		calls  int
+		called int
+	}{
+		{"ImagePusher(build index)", localRunner, 1, 1},
+		{"ImagePusher(b)", localRunner, 1, 1},
+		{"ImagePusher(c)", localRunner, 0, 0},
+	}
+
+	if err := p.PushImages(); err != nil {
+		t.Errorf("unexpected error, got: '%#v', wanted 'nil'", err)
+	}
+	for _, c := range cases {
+		checkCallsAndCalled(t, c.runner, c.key, c.calls, c.called)
+	}
+}
+
 func TestPipelinePullImagesForced(t *testing.T) {
 	tmpDef, tmpEnv := setupDefAndEnv(def, env)
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -235,7 +304,7 @@ func TestPipelineKillContainers(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -271,7 +340,7 @@ func TestPipelineKillContainersPreRun(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -307,7 +376,7 @@ func TestPipelineRemoveContainers(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -340,7 +409,7 @@ func TestPipelineRemoveContainersPreRun(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -373,7 +442,7 @@ func TestPipelineCreateNetwork(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -405,7 +474,7 @@ func TestPipelineRemoveNetwork(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -437,7 +506,7 @@ func TestPipelineExecuteSteps(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -483,7 +552,7 @@ steps:
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -520,7 +589,7 @@ steps:
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -554,7 +623,7 @@ func TestPipelineLogs(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, tmpEnv, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	if err != nil {
 		t.Errorf("unexpected error creating pipeline: '%#v'", err)
 	}
@@ -587,7 +656,7 @@ func TestPipelineCheck(t *testing.T) {
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, "", types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	localRunner := NewNoopRunner(false)
 	p.localRunner = localRunner
 	noopRunner := NewNoopRunner(false)
@@ -608,7 +677,7 @@ steps:
 	defer os.Remove(tmpDef)
 	defer os.Remove(tmpEnv)
 
-	p, err := NewPipeline(tmpDef, "", types.StringMap{}, types.StringSet{}, types.StringSet{})
+	p, err := NewPipeline([]string{tmpDef}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
 	localRunner := NewNoopRunner(false)
 	p.localRunner = localRunner
 	noopRunner := NewNoopRunner(false)
@@ -688,3 +757,189 @@ func TestPipelineDefinitionCheckVersion(t *testing.T) {
 		}
 	}
 }
+
+func TestPipelineExecuteStepsWhen(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  a:
+    image: alpine
+    when: sub.DEPLOY == 'yes'
+  b:
+    image: alpine
+    when: "!sub.DEPLOY"
+  c:
+    image: alpine
+    after:
+      - a
+      - b
+  d:
+    image: alpine
+    when: sub.DEPLOY == 'yes'
+`, `substitutions:
+  DEPLOY: "yes"
+steps:
+  d:
+    substitutions:
+      DEPLOY: "no"
+`)
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	if err := p.Check(); err != nil {
+		t.Fatalf("unexpected error checking pipeline: '%#v'", err)
+	}
+	localRunner := NewNoopRunner(false)
+	p.localRunner = localRunner
+	p.Network = Network("test")
+
+	if err := p.ExecuteSteps(); err != nil {
+		t.Errorf("unexpected error, got: '%#v', wanted 'nil'", err)
+	}
+	checkCallsAndCalled(t, localRunner, "ContainerRunner(a,test)", 1, 1)
+	// Skipped steps do not block their dependents
+	checkCallsAndCalled(t, localRunner, "ContainerKiller(b)", 0, 0)
+	checkCallsAndCalled(t, localRunner, "ContainerRunner(b,test)", 0, 0)
+	checkCallsAndCalled(t, localRunner, "ContainerRunner(c,test)", 1, 1)
+	// Substitutions of steps are used in their conditions
+	checkCallsAndCalled(t, localRunner, "ContainerRunner(d,test)", 0, 0)
+}
+
+func TestPipelineExecuteStepsWhenIgnored(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  a:
+    image: alpine
+    when: "false"
+  b:
+    image: alpine
+    after:
+      - a
+`, `steps:
+  a:
+    ignore: true
+`)
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	if err := p.Check(); err != nil {
+		t.Fatalf("unexpected error checking pipeline: '%#v'", err)
+	}
+	localRunner := NewNoopRunner(false)
+	p.localRunner = localRunner
+	p.Network = Network("test")
+	var buf bytes.Buffer
+	logger := pipelineLogger
+	pipelineLogger = NewPrefixedLogger("pipeline", log.New(&buf, "", 0))
+	defer func() { pipelineLogger = logger }()
+
+	if err := p.ExecuteSteps(); err != nil {
+		t.Errorf("unexpected error, got: '%#v', wanted 'nil'", err)
+	}
+	if strings.Contains(buf.String(), "condition") {
+		t.Errorf("condition of ignored step evaluated, got: '%s'", buf.String())
+	}
+	checkCallsAndCalled(t, localRunner, "ContainerRunner(b,test)", 1, 1)
+}
+
+func TestPipelineExecuteStepsChownOutputs(t *testing.T) {
+	def := `version: "2.0"
+steps:
+  a:
+    image: alpine
+    volumes:
+      - /tmp/a:/data
+    x-gantry:
+      chown_outputs: true
+  b:
+    image: alpine
+    volumes:
+      - /tmp/b:/data:ro
+    x-gantry:
+      chown_outputs: true
+  c:
+    image: alpine
+    volumes:
+      - /tmp/c:/data
+`
+	cases := []struct {
+		env    string
+		chowns map[string]int
+	}{
+		{"", map[string]int{"a": 1, "b": 0, "c": 0}},
+		{"chown_outputs: true\n", map[string]int{"a": 1, "b": 0, "c": 1}},
+	}
+	for _, c := range cases {
+		tmpDef, tmpEnv := setupDefAndEnv(def, c.env)
+		p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		os.Remove(tmpDef)
+		os.Remove(tmpEnv)
+		if err != nil {
+			t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+		}
+		localRunner := NewNoopRunner(true)
+		p.localRunner = localRunner
+		p.Network = Network("test")
+
+		if err := p.ExecuteSteps(); err != nil {
+			t.Errorf("unexpected error, got: '%#v', wanted 'nil'", err)
+		}
+		for name, count := range c.chowns {
+			checkCallsAndCalled(t, localRunner, fmt.Sprintf("ContainerRunner(%s-chown,test)", name), count, count)
+		}
+	}
+}
+
+// failingRunner fails the containers of the steps in failing.
+type failingRunner struct {
+	*NoopRunner
+	failing types.StringSet
+}
+
+func (r *failingRunner) Copy() Runner {
+	return r
+}
+
+func (r *failingRunner) ContainerRunner(step Step, network Network) func() error {
+	run := r.NoopRunner.ContainerRunner(step, network)
+	return func() error {
+		if err := run(); err != nil {
+			return err
+		}
+		if r.failing[step.Name] {
+			return fmt.Errorf("step '%s' failed", step.Name)
+		}
+		return nil
+	}
+}
+
+func TestPipelineExecuteStepsChownOutputsOfFailedStep(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  a:
+    image: alpine
+    volumes:
+      - /tmp/a:/data
+`, "chown_outputs: true\n")
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	runner := &failingRunner{NoopRunner: NewNoopRunner(true), failing: types.StringSet{"a": true}}
+	p.localRunner = runner
+	p.Network = Network("test")
+
+	if err := p.ExecuteSteps(); err == nil || !strings.Contains(err.Error(), "step 'a' failed") {
+		t.Errorf("Incorrect error, got: '%v', wanted error of failed step", err)
+	}
+	checkCallsAndCalled(t, runner.NoopRunner, "ContainerRunner(a-chown,test)", 1, 1)
+}
@@ -149,6 +149,49 @@ func TestPipelineDefinitionPipelines(t *testing.T) {
 	}
 }
 
+func TestPipelineDefinitionPipelinesProfiles(t *testing.T) {
+	steps := func() gantry.StepList {
+		return gantry.StepList{
+			"a": gantry.Step{Service: gantry.Service{Name: "a"}},
+			"b": gantry.Step{Service: gantry.Service{Name: "b", Profiles: types.StringSet{"debug": true}}},
+			"c": gantry.Step{Service: gantry.Service{Name: "c", Profiles: types.StringSet{"debug": true, "metrics": true}}},
+			"d": gantry.Step{Service: gantry.Service{Name: "d"}, After: types.StringSet{"c": true}},
+		}
+	}
+	cases := []struct {
+		profiles types.StringSet
+		selected types.StringSet
+		ignored  types.StringSet
+	}{
+		{types.StringSet{}, types.StringSet{}, types.StringSet{"b": true, "c": true}},
+		{types.StringSet{"metrics": true}, types.StringSet{}, types.StringSet{"b": true}},
+		{types.StringSet{"debug": true}, types.StringSet{}, types.StringSet{}},
+		{types.StringSet{}, types.StringSet{"b": true}, types.StringSet{"a": true, "c": true, "d": true}},
+		{types.StringSet{}, types.StringSet{"d": true}, types.StringSet{"a": true, "b": true}},
+	}
+
+	defer func() { gantry.ActiveProfiles = types.StringSet{} }()
+	for i, c := range cases {
+		gantry.ActiveProfiles = c.profiles
+		definition := gantry.PipelineDefinition{Steps: steps()}
+		for name := range c.selected {
+			step := definition.Steps[name]
+			step.Meta.Selected = true
+			definition.Steps[name] = step
+		}
+		pipelines, err := definition.Pipelines()
+		if err != nil {
+			t.Errorf("Unexpected error@%d: '%s'", i, err)
+			continue
+		}
+		for _, step := range pipelines.AllSteps() {
+			if step.Meta.Ignore != c.ignored[step.Name] {
+				t.Errorf("Incorrect ignored state@%d for '%s', got: '%t', wanted: '%t'", i, step.Name, step.Meta.Ignore, c.ignored[step.Name])
+			}
+		}
+	}
+}
+
 func TestPipelineIgnoreStepsFromMetaAndArgument(t *testing.T) {
 	tmpDef, err := ioutil.TempFile("", "def")
 	if err != nil {
@@ -207,7 +250,7 @@ func TestPipelineIgnoreStepsFromMetaAndArgument(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		r, err := gantry.NewPipeline(c.def, c.env, c.environment, c.ignore, c.selected)
+		r, err := gantry.NewPipeline([]string{c.def}, []string{c.env}, c.environment, c.ignore, c.selected)
 		if (err == nil && c.err != "") || (err != nil && c.err == "") {
 			t.Errorf("Incorrect error for '%v','%v','%v',%v', got: '%s', wanted '%s'", c.def, c.env, c.environment, c.ignore, err, c.err)
 		}
@@ -255,7 +298,7 @@ func TestPipelineNewPipelineWithoutEnvironemntFile(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		r, err := gantry.NewPipeline(c.def, c.env, c.environment, c.ignore, c.selected)
+		r, err := gantry.NewPipeline([]string{c.def}, []string{c.env}, c.environment, c.ignore, c.selected)
 		if (err == nil && c.err != "") || (err != nil && c.err == "") {
 			t.Errorf("Incorrect error for '%v','%v','%v',%v', got: '%s', wanted '%s'", c.def, c.env, c.environment, c.ignore, err, c.err)
 		}
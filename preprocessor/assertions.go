@@ -0,0 +1,172 @@
+package preprocessor
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// checksumAlgorithms are the hashes supported by CHECKSUM.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// sizeUnits are the factors of the units supported by CHECK_FREE_SPACE.
+var sizeUnits = map[string]uint64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+	"P": 1 << 50,
+}
+
+// sizeExpression matches sizes like 50G, 1.5TiB or 4096.
+var sizeExpression = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([KMGTP]?)(?:I?B)?$`)
+
+// currentValue returns the current value of the variable of i, empty if it is
+// not set.
+func currentValue(i Instruction) string {
+	if i.CurrentValueFound && i.CurrentValue != nil {
+		return *i.CurrentValue
+	}
+	return ""
+}
+
+// currentPath returns the current value of the variable of i as path,
+// relative paths are resolved from the directory of the processed file.
+func currentPath(i Instruction) string {
+	path := currentValue(i)
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(i.Dir, path)
+	}
+	return path
+}
+
+func require(i Instruction, e Environment, dryRun bool) error {
+	if dryRun || currentValue(i) != "" {
+		return nil
+	}
+	if len(i.Arguments) > 0 {
+		return fmt.Errorf("missing value in %s for %s: %s", i.Function, i.Variable, strings.Join(i.Arguments, " "))
+	}
+	return fmt.Errorf("missing value in %s for %s", i.Function, i.Variable)
+}
+
+func checkIfFileExists(i Instruction, e Environment, dryRun bool) error {
+	// If in dryRun, default to found file
+	if dryRun {
+		return nil
+	}
+	path, err := filepath.Abs(currentPath(i))
+	if err != nil {
+		return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("path error in %s for %s: not a file '%s'", i.Function, i.Variable, path)
+	}
+	return nil
+}
+
+func assertMatches(i Instruction, e Environment, dryRun bool) error {
+	expression, err := regexp.Compile("^(?:" + i.Arguments[0] + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regular expression in %s for %s: %s", i.Function, i.Variable, err)
+	}
+	if dryRun {
+		return nil
+	}
+	if value := currentValue(i); !expression.MatchString(value) {
+		return fmt.Errorf("assertion error in %s for %s: '%s' does not match '%s'", i.Function, i.Variable, value, i.Arguments[0])
+	}
+	return nil
+}
+
+func assertOneOf(i Instruction, e Environment, dryRun bool) error {
+	if dryRun {
+		return nil
+	}
+	value := currentValue(i)
+	for _, allowed := range i.Arguments {
+		if value == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("assertion error in %s for %s: '%s' is not one of '%s'", i.Function, i.Variable, value, strings.Join(i.Arguments, "', '"))
+}
+
+func checkFreeSpace(i Instruction, e Environment, dryRun bool) error {
+	wanted, err := parseSize(i.Arguments[0])
+	if err != nil {
+		return fmt.Errorf("invalid size in %s for %s: %s", i.Function, i.Variable, err)
+	}
+	if dryRun {
+		return nil
+	}
+	path, err := filepath.Abs(currentPath(i))
+	if err != nil {
+		return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+	}
+	available, err := availableSpace(path)
+	if err != nil {
+		return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+	}
+	if available < wanted {
+		return fmt.Errorf("space error in %s for %s: %d bytes available in '%s', wanted: %s", i.Function, i.Variable, available, path, i.Arguments[0])
+	}
+	return nil
+}
+
+// parseSize returns the number of bytes of size, units are powers of 1024.
+func parseSize(size string) (uint64, error) {
+	match := sizeExpression.FindStringSubmatch(strings.ToUpper(size))
+	if match == nil {
+		return 0, fmt.Errorf("'%s' is not a size", size)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(value * float64(sizeUnits[match[2]])), nil
+}
+
+func checksum(i Instruction, e Environment, dryRun bool) error {
+	parts := strings.SplitN(i.Arguments[0], ":", 2)
+	algorithm, found := checksumAlgorithms[strings.ToLower(parts[0])]
+	if !found || len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("invalid checksum in %s for %s: '%s', wanted: 'ALGORITHM:HEX' with ALGORITHM one of md5, sha1, sha256, sha512", i.Function, i.Variable, i.Arguments[0])
+	}
+	if dryRun {
+		return nil
+	}
+	file, err := os.Open(currentPath(i))
+	if err != nil {
+		return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+	}
+	defer file.Close()
+	h := algorithm()
+	if _, err := io.Copy(h, file); err != nil {
+		return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != strings.ToLower(parts[1]) {
+		return fmt.Errorf("checksum error in %s for %s: got: '%s:%s', wanted: '%s'", i.Function, i.Variable, parts[0], sum, i.Arguments[0])
+	}
+	return nil
+}
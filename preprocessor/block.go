@@ -0,0 +1,130 @@
+package preprocessor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// blockKind describes a directive of a conditional block.
+type blockKind struct {
+	// branch is one of if, elif, else or endif.
+	branch string
+	// test is one of set, eq or ne for if and elif.
+	test string
+}
+
+// blockDirectives stores the kind of all directives of conditional blocks by
+// their main name.
+var blockDirectives = map[string]blockKind{
+	"IF":      {"if", "set"},
+	"IF_EQ":   {"if", "eq"},
+	"IF_NE":   {"if", "ne"},
+	"ELIF":    {"elif", "set"},
+	"ELIF_EQ": {"elif", "eq"},
+	"ELIF_NE": {"elif", "ne"},
+	"ELSE":    {"else", ""},
+	"ENDIF":   {"endif", ""},
+}
+
+// blockDescriptions documents the directives of conditional blocks.
+var blockDescriptions = map[string]string{
+	"set":   "if ${VAR} is set and not empty.",
+	"eq":    "if ${VAR} equals ARG0.",
+	"ne":    "if ${VAR} does not equal ARG0.",
+	"else":  "Keeps the following lines if no previous branch of the block was taken.",
+	"endif": "Ends a conditional block.",
+}
+
+// registerBlockDirectives adds the directives of conditional blocks to p. They
+// are handled by processPreprocessorLines, the functions only check their
+// arguments.
+func registerBlockDirectives(p *Preprocessor) error {
+	for _, name := range []string{"IF", "IF_EQ", "IF_NE", "ELIF", "ELIF_EQ", "ELIF_NE", "ELSE", "ENDIF"} {
+		kind := blockDirectives[name]
+		f := &Function{
+			Names:       []string{name, strings.ToLower(name)},
+			Description: blockDescriptions[kind.branch],
+		}
+		switch kind.test {
+		case "set":
+			f.NeedsVariable = true
+		case "eq", "ne":
+			f.NeedsVariable = true
+			f.NumArgsMin = 1
+			f.NumArgsMax = 1
+		}
+		switch kind.branch {
+		case "if":
+			f.Description = "Keeps the following lines up to the matching ELIF, ELSE or ENDIF " + blockDescriptions[kind.test]
+		case "elif":
+			f.Description = "Keeps the following lines if no previous branch of the block was taken and " + blockDescriptions[kind.test]
+		}
+		if err := p.Register(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// conditionalBlock stores the state of an IF block while processing lines.
+type conditionalBlock struct {
+	// line is the line number of the IF directive.
+	line int
+	// parent is set if the enclosing block is active.
+	parent bool
+	// taken is set if a branch of the block was taken.
+	taken bool
+	// current is set if the current branch is taken.
+	current bool
+	// hasElse is set after the ELSE directive.
+	hasElse bool
+}
+
+// active returns whether lines of the current branch of b are kept.
+func (b *conditionalBlock) active() bool {
+	return b.parent && b.current
+}
+
+// evaluate returns whether the test of kind holds for instruction.
+func (kind blockKind) evaluate(i Instruction) bool {
+	value := currentValue(i)
+	switch kind.test {
+	case "eq":
+		return value == i.Arguments[0]
+	case "ne":
+		return value != i.Arguments[0]
+	}
+	return value != ""
+}
+
+// updateBlocks applies the directive instruction of kind at line to the stack
+// of open blocks.
+func updateBlocks(blocks []*conditionalBlock, kind blockKind, instruction Instruction, line int) ([]*conditionalBlock, error) {
+	if kind.branch == "if" {
+		parent := len(blocks) == 0 || blocks[len(blocks)-1].active()
+		result := kind.evaluate(instruction)
+		return append(blocks, &conditionalBlock{line: line, parent: parent, taken: result, current: result}), nil
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("%s without IF", instruction.Function)
+	}
+	block := blocks[len(blocks)-1]
+	switch kind.branch {
+	case "elif":
+		if block.hasElse {
+			return nil, fmt.Errorf("%s after ELSE of IF in line %d", instruction.Function, block.line)
+		}
+		block.current = !block.taken && kind.evaluate(instruction)
+		block.taken = block.taken || block.current
+	case "else":
+		if block.hasElse {
+			return nil, fmt.Errorf("duplicate ELSE of IF in line %d", block.line)
+		}
+		block.hasElse = true
+		block.current = !block.taken
+		block.taken = true
+	case "endif":
+		return blocks[:len(blocks)-1], nil
+	}
+	return blocks, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+
+package preprocessor
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// availableSpace is not supported on this platform.
+func availableSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("checking free space is not supported on %s", runtime.GOOS)
+}
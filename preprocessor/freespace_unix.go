@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package preprocessor
+
+import "syscall"
+
+// availableSpace returns the number of bytes available to unprivileged users
+// on the file system containing path.
+func availableSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
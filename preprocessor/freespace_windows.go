@@ -0,0 +1,19 @@
+//go:build windows
+
+package preprocessor
+
+import "golang.org/x/sys/windows"
+
+// availableSpace returns the number of bytes available to the current user
+// on the volume containing path.
+func availableSpace(path string) (uint64, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var available, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &total, &free); err != nil {
+		return 0, err
+	}
+	return available, nil
+}
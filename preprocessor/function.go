@@ -6,12 +6,16 @@ import (
 
 // Function is a function executable by the preprocessor
 type Function struct {
-	Func          func(Instruction, Environment, bool) error
-	Names         []string
-	Description   string
-	NumArgsMin    int
-	NumArgsMax    int
+	Func        func(Instruction, Environment, bool) error
+	Names       []string
+	Description string
+	NumArgsMin  int
+	NumArgsMax  int
+	// Variadic allows any number of arguments after the first NumArgsMin.
+	Variadic      bool
 	NeedsVariable bool
+	// RunsCommands marks functions executing commands on the host.
+	RunsCommands bool
 }
 
 // Check performs basic checks, e.g. to enforce correct number of arguments
@@ -22,7 +26,7 @@ func (f Function) Check(i Instruction) error {
 	if len(i.Arguments) < f.NumArgsMin {
 		return fmt.Errorf("missing argument(s) in %s for %s, wanted: %d, got: %d", i.Function, i.Variable, f.NumArgsMin, len(i.Arguments))
 	}
-	if len(i.Arguments) > f.NumArgsMax {
+	if !f.Variadic && len(i.Arguments) > f.NumArgsMax {
 		return fmt.Errorf("too many arguments in %s for %s, wanted: %d, got: %d", i.Function, i.Variable, f.NumArgsMax, len(i.Arguments))
 	}
 	return nil
@@ -52,7 +56,9 @@ func (f Function) Usage() string {
 			argc++
 		}
 	}
-	if f.NumArgsMax > f.NumArgsMin {
+	if f.Variadic {
+		argline = fmt.Sprintf("%s [ ARG%d ... ]", argline, argc)
+	} else if f.NumArgsMax > f.NumArgsMin {
 		argline = fmt.Sprintf("%s [", argline)
 		for i := 0; i < f.NumArgsMax-f.NumArgsMin; i++ {
 			argline = fmt.Sprintf("%s ARG%d", argline, argc)
@@ -43,6 +43,17 @@ func TestFunctionCheck(t *testing.T) {
 	if err := f.Check(i); err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
+
+	f.Variadic = true
+	i.Arguments = []string{"arg0", "arg1", "arg2"}
+	if err := f.Check(i); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+
+	i.Arguments = []string{}
+	if err := f.Check(i); err == nil {
+		t.Errorf("expected error, got nil")
+	}
 }
 
 func TestFunctionUsage(t *testing.T) {
@@ -110,6 +121,15 @@ func TestFunctionUsage(t *testing.T) {
 			},
 			"#! FOO ${VAR} ARG0 ARG1",
 		},
+		{
+			preprocessor.Function{
+				Names:         []string{"FOO"},
+				NeedsVariable: true,
+				NumArgsMin:    1,
+				Variadic:      true,
+			},
+			"#! FOO ${VAR} ARG0 [ ARG1 ... ]",
+		},
 		{
 			preprocessor.Function{
 				Names:       []string{"FOO"},
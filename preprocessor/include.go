@@ -0,0 +1,88 @@
+package preprocessor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// includeNames are the names of the INCLUDE directive.
+var includeNames = []string{"INCLUDE", "include"}
+
+// registerIncludeDirective adds the INCLUDE directive to p. It is handled by
+// processPreprocessorLines, as its argument is a path and not a variable.
+func registerIncludeDirective(p *Preprocessor) error {
+	return p.Register(&Function{
+		Names:       includeNames,
+		NumArgsMin:  1,
+		NumArgsMax:  2,
+		Description: "Inserts the preprocessed lines of the file ARG0, relative to the including file, indented by ARG1 spaces.",
+	})
+}
+
+// isIncludeDirective returns whether the directive line is an INCLUDE.
+func isIncludeDirective(line string) bool {
+	name := strings.SplitN(line, " ", 2)[0]
+	for _, n := range includeNames {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// include returns the preprocessed lines of the file referenced by the
+// INCLUDE directive line. Variables in the path are expanded using env, files
+// is the stack of files being processed.
+func (p Preprocessor) include(line string, env Environment, files []string) ([]string, error) {
+	parts := strings.Fields(line)
+	f := p.mapping[parts[0]]
+	instruction := Instruction{Function: parts[0], Arguments: parts[1:]}
+	if err := f.Check(instruction); err != nil {
+		return nil, err
+	}
+	indent := 0
+	if len(instruction.Arguments) > 1 {
+		var err error
+		indent, err = strconv.Atoi(instruction.Arguments[1])
+		if err != nil || indent < 0 {
+			return nil, fmt.Errorf("invalid indent '%s' in %s", instruction.Arguments[1], instruction.Function)
+		}
+	}
+	path, err := interpolate(instruction.Arguments[0], env, p.Strict)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) && files[len(files)-1] != "" {
+		path = filepath.Join(filepath.Dir(files[len(files)-1]), path)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file == path {
+			return nil, fmt.Errorf("cyclic %s of '%s'", instruction.Function, path)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := splitLines(data)
+	if err != nil {
+		return nil, err
+	}
+	included, _, err := p.processPreprocessorLines(extractPreprocessorLines(lines), env, append(files[:len(files):len(files)], path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	prefix := strings.Repeat(" ", indent)
+	for i, l := range included {
+		if strings.TrimSpace(l) != "" {
+			included[i] = prefix + l
+		}
+	}
+	return included, nil
+}
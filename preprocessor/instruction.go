@@ -12,6 +12,10 @@ type Instruction struct {
 	Arguments         []string
 	CurrentValue      *string
 	CurrentValueFound bool
+	// Dir is the directory of the processed file containing the instruction,
+	// relative paths are resolved from it. It is empty for input without
+	// file.
+	Dir string
 }
 
 // NewInstruction parses a line and looks up the current value from the environment
@@ -0,0 +1,202 @@
+package preprocessor
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// interpolationOperators lists the supported operators inside ${...} ordered
+// such that longer operators are matched first.
+var interpolationOperators = []string{":-", ":?", ":+", "-", "?", "+"}
+
+// referencePrefixes start variables which are resolved by gantry after
+// preprocessing, they are kept as is.
+var referencePrefixes = []string{"matrix.", "params.", "steps.", "workspaces."}
+
+// interpolate expands all variables in s using the compose interpolation
+// syntax:
+//
+//	$VAR, ${VAR}          value of VAR
+//	${VAR:-default}       default if VAR is unset or empty
+//	${VAR-default}        default if VAR is unset
+//	${VAR:?error}         error if VAR is unset or empty
+//	${VAR?error}          error if VAR is unset
+//	${VAR:+alternative}   alternative if VAR is set and not empty
+//	${VAR+alternative}    alternative if VAR is set
+//	$$                    a literal $
+//	${matrix.KEY}         kept as is, see referencePrefixes
+//	${params.NAME}        kept as is, see referencePrefixes
+//	${steps.NAME.outputs.KEY} kept as is, see referencePrefixes
+//	${workspaces.NAME}    kept as is, see referencePrefixes
+//
+// Defaults and alternatives are interpolated themselves. If strict is set,
+// unset variables without default are an error.
+func interpolate(s string, env Environment, strict bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		next := s[i+1]
+		switch {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '{':
+			end, err := closingBrace(s, i+2)
+			if err != nil {
+				return "", err
+			}
+			if isReference(s[i+2 : end]) {
+				b.WriteString(s[i : end+1])
+				i = end
+				continue
+			}
+			value, err := interpolateBraced(s[i+2:end], env, strict)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end
+		case isNameStart(next):
+			end := i + 2
+			for end < len(s) && isNameChar(s[end]) {
+				end++
+			}
+			value, err := lookupVariable(s[i+1:end], env, strict)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i = end - 1
+		default:
+			// Not a variable, keep the $ as is
+			b.WriteByte('$')
+		}
+	}
+	return b.String(), nil
+}
+
+// interpolateBraced expands the content of ${...}.
+func interpolateBraced(content string, env Environment, strict bool) (string, error) {
+	end := 0
+	for end < len(content) && isNameChar(content[end]) {
+		end++
+	}
+	name := content[:end]
+	if len(name) == 0 || !isNameStart(name[0]) {
+		return "", fmt.Errorf("invalid interpolation format for '${%s}'", content)
+	}
+	if end == len(content) {
+		return lookupVariable(name, env, strict)
+	}
+	rest := content[end:]
+	operator := ""
+	for _, op := range interpolationOperators {
+		if strings.HasPrefix(rest, op) {
+			operator = op
+			break
+		}
+	}
+	if operator == "" {
+		return "", fmt.Errorf("invalid interpolation format for '${%s}'", content)
+	}
+	word := rest[len(operator):]
+	val, found := env.GetSubstitution(name)
+	isSet := found && val != nil
+	isEmpty := !isSet || len(*val) == 0
+	useWord := false
+	switch operator {
+	case ":-":
+		useWord = isEmpty
+	case "-":
+		useWord = !isSet
+	case ":?", "?":
+		if (operator == ":?" && isEmpty) || (operator == "?" && !isSet) {
+			message, err := interpolate(word, env, strict)
+			if err != nil {
+				return "", err
+			}
+			return "", fmt.Errorf("required variable '%s' is missing a value: %s", name, message)
+		}
+	case ":+":
+		if isEmpty {
+			return "", nil
+		}
+		useWord = true
+	case "+":
+		if !isSet {
+			return "", nil
+		}
+		useWord = true
+	}
+	if useWord {
+		return interpolate(word, env, strict)
+	}
+	if !isSet {
+		return "", nil
+	}
+	return *val, nil
+}
+
+// unsetVariables stores the names of unset variables already warned about.
+var unsetVariables sync.Map
+
+// lookupVariable returns the value of name, unset variables are empty or
+// an error in strict mode. Unset variables are reported once.
+func lookupVariable(name string, env Environment, strict bool) (string, error) {
+	val, found := env.GetSubstitution(name)
+	if found && val != nil {
+		return *val, nil
+	}
+	if strict {
+		return "", fmt.Errorf("variable '%s' is not set", name)
+	}
+	if _, warned := unsetVariables.LoadOrStore(name, true); !warned {
+		log.Printf("The '%s' variable is not set. Defaulting to a blank string.", name)
+	}
+	return "", nil
+}
+
+// closingBrace returns the index of the brace closing the ${ opened before
+// start, nested ${...} are skipped.
+func closingBrace(s string, start int) (int, error) {
+	depth := 1
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && (s[i+1] == '$' || s[i+1] == '{'):
+			if s[i+1] == '{' {
+				depth++
+			}
+			i++
+		case s[i] == '}':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("missing closing brace in '%s'", s[start-2:])
+}
+
+// isReference returns whether content of ${...} is a reference resolved
+// after preprocessing.
+func isReference(content string) bool {
+	for _, prefix := range referencePrefixes {
+		if strings.HasPrefix(content, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
@@ -0,0 +1,107 @@
+package preprocessor
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	value := "value"
+	empty := ""
+	env := testEnv{
+		"SET":   &value,
+		"EMPTY": &empty,
+		"NIL":   nil,
+	}
+	cases := []struct {
+		input  string
+		result string
+		err    string
+	}{
+		{"static", "static", ""},
+		{"$SET", "value", ""},
+		{"${SET}", "value", ""},
+		{"pre${SET}post", "prevaluepost", ""},
+		{"$SET.$SET", "value.value", ""},
+		{"$$SET", "$SET", ""},
+		{"$${SET}", "${SET}", ""},
+		{"echo $1 $ $", "echo $1 $ $", ""},
+		{"${UNSET}", "", ""},
+		{"${NIL}", "", ""},
+		{"${SET:-default}", "value", ""},
+		{"${EMPTY:-default}", "default", ""},
+		{"${UNSET:-default}", "default", ""},
+		{"${EMPTY-default}", "", ""},
+		{"${UNSET-default}", "default", ""},
+		{"${UNSET:-${SET}}", "value", ""},
+		{"${UNSET:-${EMPTY:-nested}}", "nested", ""},
+		{"${UNSET:-a}${SET}", "avalue", ""},
+		{"${SET:+alt}", "alt", ""},
+		{"${EMPTY:+alt}", "", ""},
+		{"${EMPTY+alt}", "alt", ""},
+		{"${UNSET+alt}", "", ""},
+		{"${SET:?error}", "value", ""},
+		{"${SET?error}", "value", ""},
+		{"${EMPTY?error}", "", ""},
+		{"${EMPTY:?is empty}", "", "required variable 'EMPTY' is missing a value: is empty"},
+		{"${UNSET?is unset}", "", "required variable 'UNSET' is missing a value: is unset"},
+		{"${UNSET:?$SET missing}", "", "required variable 'UNSET' is missing a value: value missing"},
+		{"${}", "", "invalid interpolation format for '${}'"},
+		{"${1A}", "", "invalid interpolation format for '${1A}'"},
+		{"${SET!}", "", "invalid interpolation format for '${SET!}'"},
+		{"${SET", "", "missing closing brace in '${SET'"},
+		{"${matrix.dataset}-${SET}", "${matrix.dataset}-value", ""},
+		{"${UNSET:-${matrix.dataset}}", "${matrix.dataset}", ""},
+		{"${steps.prep.build.outputs.index}", "${steps.prep.build.outputs.index}", ""},
+	}
+
+	for _, c := range cases {
+		r, err := interpolate(c.input, env, false)
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("incorrect error for '%s', got: %v, wanted: %s", c.input, err, c.err)
+		}
+		if r != c.result {
+			t.Errorf("incorrect result for '%s', got: '%s', wanted: '%s'", c.input, r, c.result)
+		}
+	}
+}
+
+func TestInterpolateStrict(t *testing.T) {
+	value := "value"
+	env := testEnv{"SET": &value}
+	cases := []struct {
+		input string
+		err   string
+	}{
+		{"${SET}", ""},
+		{"${UNSET:-default}", ""},
+		{"${UNSET-}", ""},
+		{"$UNSET", "variable 'UNSET' is not set"},
+		{"${UNSET}", "variable 'UNSET' is not set"},
+		{"${UNSET:-$OTHER}", "variable 'OTHER' is not set"},
+	}
+
+	for _, c := range cases {
+		_, err := interpolate(c.input, env, true)
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("incorrect error for '%s', got: %v, wanted: %s", c.input, err, c.err)
+		}
+	}
+}
+
+func TestInterpolateWarnsOnce(t *testing.T) {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+	for i := 0; i < 2; i++ {
+		if _, err := interpolate("${GANTRY_TEST_UNSET} ${GANTRY_TEST_UNSET}", testEnv{}, false); err != nil {
+			t.Fatalf("unexpected error: '%s'", err)
+		}
+	}
+	if r := strings.Count(buffer.String(), "'GANTRY_TEST_UNSET' variable is not set"); r != 1 {
+		t.Errorf("Incorrect number of warnings, got: %d, wanted: 1", r)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -17,6 +18,17 @@ type Environment interface {
 	GetOrCreateTempDir(string) (string, error)
 }
 
+// ScopedEnvironment is an Environment providing additional substitutions for
+// the blocks of single steps and services.
+type ScopedEnvironment interface {
+	Environment
+	Scope(string) Environment
+}
+
+// scopeSections are the top-level keys whose entries are expanded using
+// scoped environments.
+var scopeSections = map[string]bool{"steps": true, "services": true}
+
 func checkIfDirExists(i Instruction, e Environment, dryRun bool) error {
 	// If in dryRun, default to found dir
 	if dryRun {
@@ -70,6 +82,10 @@ type Preprocessor struct {
 	mapping   map[string]*Function
 	functions []*Function
 	DryRun    bool
+	// Strict turns variables which are not set into errors.
+	Strict bool
+	// DisableCommands rejects functions running commands on the host.
+	DisableCommands bool
 }
 
 // NewPreprocessor returns a new Preprocessor with basic functions preregistered.
@@ -113,6 +129,127 @@ func NewPreprocessor() (Preprocessor, error) {
 	}); err != nil {
 		return p, err
 	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"REQUIRE",
+			"require",
+		},
+		NeedsVariable: true,
+		Variadic:      true,
+		Func:          require,
+		Description:   "Checks if ${VAR} is set and not empty, aborts execution with the message ARG0 ... on failure.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"CHECK_IF_FILE_EXISTS",
+			"check_if_file_exists",
+		},
+		NeedsVariable: true,
+		Func:          checkIfFileExists,
+		Description:   "Checks if ${VAR} points to a regular file, aborts execution on failure.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"ASSERT_MATCHES",
+			"assert_matches",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		NumArgsMax:    1,
+		Func:          assertMatches,
+		Description:   "Checks if ${VAR} entirely matches the regular expression ARG0, aborts execution on failure.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"ASSERT_ONE_OF",
+			"assert_one_of",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		Variadic:      true,
+		Func:          assertOneOf,
+		Description:   "Checks if ${VAR} equals one of the arguments, aborts execution on failure.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"CHECK_FREE_SPACE",
+			"check_free_space",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		NumArgsMax:    1,
+		Func:          checkFreeSpace,
+		Description:   "Checks if at least ARG0 (e.g. 50G) are available in the directory ${VAR}, aborts execution on failure.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"CHECKSUM",
+			"checksum",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		NumArgsMax:    1,
+		Func:          checksum,
+		Description:   "Checks if the file ${VAR} has the checksum ARG0 (e.g. sha256:HEX), aborts execution on failure.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"SET_FROM_COMMAND",
+			"set_from_command",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		Variadic:      true,
+		RunsCommands:  true,
+		Func:          setFromCommand,
+		Description:   "Sets ${VAR} to the output of the command ARG0 ... if ${VAR} is empty or not set.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"SET_FROM_FILE",
+			"set_from_file",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		NumArgsMax:    1,
+		Func:          setFromFile,
+		Description:   "Sets ${VAR} to the contents of the file ARG0 if ${VAR} is empty or not set.",
+	}); err != nil {
+		return p, err
+	}
+	if err := p.Register(&Function{
+		Names: []string{
+			"SET_FROM_ENV",
+			"set_from_env",
+		},
+		NeedsVariable: true,
+		NumArgsMin:    1,
+		NumArgsMax:    1,
+		Func:          setFromEnv,
+		Description:   "Sets ${VAR} to the value of the host environment variable ARG0 if ${VAR} is empty or not set.",
+	}); err != nil {
+		return p, err
+	}
+	if err := registerBlockDirectives(&p); err != nil {
+		return p, err
+	}
+	if err := registerIncludeDirective(&p); err != nil {
+		return p, err
+	}
 	return p, nil
 }
 
@@ -135,7 +272,72 @@ func (p Preprocessor) Functions() []*Function {
 
 // Process processes a raw file with a given environment.
 func (p Preprocessor) Process(rawFile []byte, env Environment) ([]byte, error) {
-	// Parse bytes as lines
+	result, _, err := p.ProcessLines(rawFile, env)
+	return result, err
+}
+
+// ProcessLines processes a raw file with a given environment like Process.
+// Additionally the 1-based line number in rawFile of each line of the result
+// is returned.
+func (p Preprocessor) ProcessLines(rawFile []byte, env Environment) ([]byte, []int, error) {
+	return p.process(rawFile, "", env)
+}
+
+// ProcessFile processes the file at path with a given environment like
+// Process. Files included by it are resolved relative to its directory.
+func (p Preprocessor) ProcessFile(path string, env Environment) ([]byte, error) {
+	result, _, err := p.ProcessFileLines(path, env)
+	return result, err
+}
+
+// ProcessFileLines processes the file at path with a given environment like
+// ProcessLines.
+func (p Preprocessor) ProcessFileLines(path string, env Environment) ([]byte, []int, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return []byte(""), nil, err
+	}
+	rawFile, err := ioutil.ReadFile(abs)
+	if err != nil {
+		return []byte(""), nil, err
+	}
+	return p.process(rawFile, abs, env)
+}
+
+// process processes rawFile read from file, empty if unknown, with env.
+func (p Preprocessor) process(rawFile []byte, file string, env Environment) ([]byte, []int, error) {
+	lines, err := splitLines(rawFile)
+	if err != nil {
+		return []byte(""), nil, err
+	}
+	// Run preprocessor steps
+	normal, numbers, err := p.processPreprocessorLines(extractPreprocessorLines(lines), env, []string{file})
+	if err != nil {
+		return []byte(""), nil, err
+	}
+	lines, err = expandVariables(normal, numbers, env, p.Strict)
+	if err != nil {
+		return []byte(""), nil, err
+	}
+	// Reconvert to byte slice
+	var b bytes.Buffer
+	bw := bufio.NewWriter(&b)
+	for i, line := range lines {
+		if i > 0 {
+			if _, err := bw.WriteString("\n"); err != nil {
+				return []byte(""), nil, err
+			}
+		}
+		if _, err := bw.WriteString(line); err != nil {
+			return []byte(""), nil, err
+		}
+	}
+	bw.Flush()
+	return b.Bytes(), numbers, nil
+}
+
+// splitLines parses rawFile as lines.
+func splitLines(rawFile []byte) ([]string, error) {
 	var lines []string
 	var lineBytesBuffer bytes.Buffer
 	r := bufio.NewReader(bytes.NewReader(rawFile))
@@ -145,7 +347,7 @@ func (p Preprocessor) Process(rawFile []byte, env Environment) ([]byte, error) {
 			if err == io.EOF {
 				break
 			}
-			return []byte(""), err
+			return nil, err
 		}
 		lineBytesBuffer.Write(lineBytes)
 		// Line continues, continue reading before storing
@@ -155,78 +357,168 @@ func (p Preprocessor) Process(rawFile []byte, env Environment) ([]byte, error) {
 		lines = append(lines, lineBytesBuffer.String())
 		lineBytesBuffer.Reset()
 	}
-	// Run preprocessor steps
-	preprocessor, normal := extractPreprocessorLines(lines)
-	if err := p.processPreprocessorLines(preprocessor, env); err != nil {
-		return []byte(""), err
-	}
-	lines = expandVariables(normal, env)
-	// Reconvert to byte slice
-	var b bytes.Buffer
-	bw := bufio.NewWriter(&b)
-	for i, line := range lines {
-		if i > 0 {
-			if _, err := bw.WriteString("\n"); err != nil {
-				return []byte(""), err
-			}
-		}
-		if _, err := bw.WriteString(line); err != nil {
-			return []byte(""), err
-		}
-	}
-	bw.Flush()
-	return b.Bytes(), nil
+	return lines, nil
 }
 
-// processPreprocessorLines executes each `#!` line
-func (p Preprocessor) processPreprocessorLines(lines []string, env Environment) error {
+// processPreprocessorLines executes each `#!` line in the order of lines.
+// Lines inside of conditional blocks are only kept and executed if the
+// condition of the block holds. The kept normal lines are returned with their
+// line numbers, lines of included files get the number of their INCLUDE.
+// files is the stack of files being processed, the last one contains lines.
+func (p Preprocessor) processPreprocessorLines(lines []preprocessorLine, env Environment, files []string) ([]string, []int, error) {
+	normal := []string{}
+	numbers := []int{}
+	blocks := []*conditionalBlock{}
 	for _, line := range lines {
-		instruction, err := NewInstruction(line, env)
+		active := len(blocks) == 0 || blocks[len(blocks)-1].active()
+		if !line.directive {
+			if active {
+				normal = append(normal, line.text)
+				numbers = append(numbers, line.number)
+			}
+			continue
+		}
+		if isIncludeDirective(line.text) {
+			if !active {
+				continue
+			}
+			included, err := p.include(line.text, env, files)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", line.number, err)
+			}
+			for _, l := range included {
+				normal = append(normal, l)
+				numbers = append(numbers, line.number)
+			}
+			continue
+		}
+		instruction, err := NewInstruction(line.text, env)
 		if err != nil {
-			return err
+			return nil, nil, fmt.Errorf("line %d: %s", line.number, err)
+		}
+		f, ok := p.mapping[instruction.Function]
+		if !ok {
+			return nil, nil, fmt.Errorf("line %d: unknown preprocessor directive: '%s'", line.number, instruction.Function)
 		}
-		if f, ok := p.mapping[instruction.Function]; ok {
-			if err := f.Execute(instruction, env, p.DryRun); err != nil {
-				return err
+		if kind, isBlock := blockDirectives[f.Names[0]]; isBlock {
+			if err := f.Check(instruction); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", line.number, err)
 			}
-		} else {
-			return fmt.Errorf("unknown preprocessor directive: '%s'", instruction.Function)
+			if blocks, err = updateBlocks(blocks, kind, instruction, line.number); err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s", line.number, err)
+			}
+			continue
+		}
+		if !active {
+			continue
+		}
+		if f.RunsCommands && p.DisableCommands {
+			return nil, nil, fmt.Errorf("line %d: %s is disabled by the environment", line.number, instruction.Function)
+		}
+		if file := files[len(files)-1]; file != "" {
+			instruction.Dir = filepath.Dir(file)
+		}
+		if err := f.Execute(instruction, env, p.DryRun); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line.number, err)
 		}
 	}
-	return nil
+	if len(blocks) > 0 {
+		return nil, nil, fmt.Errorf("line %d: missing ENDIF for IF", blocks[len(blocks)-1].line)
+	}
+	return normal, numbers, nil
 }
 
-// extractPreprocessorLines splits lines in two lists, preprocessor instructions and normal lines.
-func extractPreprocessorLines(lines []string) ([]string, []string) {
-	preprocessor := []string{}
-	normal := []string{}
-	for _, line := range lines {
+// preprocessorLine is a line of a file which is either a preprocessor
+// directive or a normal line.
+type preprocessorLine struct {
+	text      string
+	number    int
+	directive bool
+}
+
+// extractPreprocessorLines returns all lines which are not comments, the text
+// of directives is stripped of the leading `#!`.
+func extractPreprocessorLines(lines []string) []preprocessorLine {
+	result := []preprocessorLine{}
+	for i, line := range lines {
 		trimmed := strings.TrimSpace(line)
 		if len(trimmed) < 2 || trimmed[0] != '#' {
-			normal = append(normal, line)
+			result = append(result, preprocessorLine{text: line, number: i + 1})
 			continue
 		}
 		if trimmed[1] != '!' {
 			continue
 		}
-		preprocessor = append(preprocessor, strings.TrimSpace(trimmed[2:]))
+		result = append(result, preprocessorLine{text: strings.TrimSpace(trimmed[2:]), number: i + 1, directive: true})
 	}
-	return preprocessor, normal
+	return result
 }
 
-// expandVariables expands variables in all lines
-func expandVariables(lines []string, env Environment) []string {
-	expandFunc := func(placeholder string) string {
-		val, ok := env.GetSubstitution(placeholder)
-		if ok && val != nil {
-			return *val
-		}
-		// No real substitution found, return empty string
-		return ""
-	}
+// expandVariables expands variables in all lines using the compose
+// interpolation syntax and the scoped environment of each line. Errors are
+// reported with the given line numbers.
+func expandVariables(lines []string, numbers []int, env Environment, strict bool) ([]string, error) {
+	envs := scopedEnvironments(lines, env)
 	result := make([]string, len(lines))
 	for i, l := range lines {
-		result[i] = os.Expand(l, expandFunc)
+		var err error
+		result[i], err = interpolate(l, envs[i], strict)
+		if err != nil {
+			number := i + 1
+			if i < len(numbers) {
+				number = numbers[i]
+			}
+			return nil, fmt.Errorf("line %d: %s", number, err)
+		}
+	}
+	return result, nil
+}
+
+// scopedEnvironments returns the environment of each line. Lines inside the
+// block of an entry of a scope section use the scope of the entry if env is a
+// ScopedEnvironment, all other lines use env.
+func scopedEnvironments(lines []string, env Environment) []Environment {
+	result := make([]Environment, len(lines))
+	scoped, ok := env.(ScopedEnvironment)
+	inSection := false
+	entryIndent := -1
+	current := env
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if !ok || trimmed == "" || trimmed[0] == '#' {
+			result[i] = current
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent == 0 {
+			inSection = scopeSections[blockKey(trimmed)]
+			entryIndent = -1
+			current = env
+		} else if inSection {
+			if entryIndent < 0 {
+				entryIndent = indent
+			}
+			if indent == entryIndent {
+				current = env
+				if key := blockKey(trimmed); key != "" {
+					current = scoped.Scope(key)
+				}
+			}
+		}
+		result[i] = current
 	}
 	return result
 }
+
+// blockKey returns the key of a line starting a yaml mapping entry, empty if
+// the line does not start an entry.
+func blockKey(line string) string {
+	if strings.HasPrefix(line, "-") {
+		return ""
+	}
+	pos := strings.Index(line, ":")
+	if pos < 1 || (pos+1 < len(line) && line[pos+1] != ' ' && line[pos+1] != '\t') {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(line[:pos]), "\"'")
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -52,38 +54,27 @@ func TestExtractPreprocessorStatements(t *testing.T) {
 		"    value3",
 		"#! POST",
 	}
-	statements := []string{
-		"PRE",
-		"WITHOUT SPACE",
-		"INNER",
-		"MULTIPLE SPACES",
-		"POST",
-	}
-	lines := []string{
-		"outer:",
-		"  inner1:",
-		"    value1",
-		"    value2",
-		"  inner2:",
-		"    value3",
-	}
-	rs, rl := extractPreprocessorLines(input)
-	if len(rs) != len(statements) {
-		t.Errorf("incorrect number of statements, got: %d, wanted: %d", len(rs), len(statements))
+	wanted := []preprocessorLine{
+		{"PRE", 1, true},
+		{"WITHOUT SPACE", 2, true},
+		{"outer:", 3, false},
+		{"  inner1:", 4, false},
+		{"    value1", 6, false},
+		{"    value2", 7, false},
+		{"INNER", 8, true},
+		{"  inner2:", 9, false},
+		{"MULTIPLE SPACES", 10, true},
+		{"    value3", 11, false},
+		{"POST", 12, true},
+	}
+	r := extractPreprocessorLines(input)
+	if len(r) != len(wanted) {
+		t.Errorf("incorrect number of lines, got: %d, wanted: %d", len(r), len(wanted))
 		return
 	}
-	for i, s := range rs {
-		if s != statements[i] {
-			t.Errorf("incorrect statement @%d, got: '%s', wanted: '%s'", i, s, statements[i])
-		}
-	}
-	if len(rl) != len(lines) {
-		t.Errorf("incorrect number of normal lines, got: %d, wanted: %d", len(rl), len(lines))
-		return
-	}
-	for i, l := range rl {
-		if l != lines[i] {
-			t.Errorf("incorrect line @%d, got: '%s', wanted: '%s'", i, l, lines[i])
+	for i, l := range r {
+		if l != wanted[i] {
+			t.Errorf("incorrect line @%d, got: '%#v', wanted: '%#v'", i, l, wanted[i])
 		}
 	}
 }
@@ -388,15 +379,15 @@ func TestProcessPreprocessorLines(t *testing.T) {
 	}{
 		{
 			"",
-			"empty preprocessor line found",
+			"line 1: empty preprocessor line found",
 		},
 		{
 			"FUNCTION_WITHOUT_VAR_OR_ARG",
-			"unknown preprocessor directive: 'FUNCTION_WITHOUT_VAR_OR_ARG'",
+			"line 1: unknown preprocessor directive: 'FUNCTION_WITHOUT_VAR_OR_ARG'",
 		},
 		{
 			"FUNCTION INVALID_VAR",
-			"invalid variable in: 'FUNCTION INVALID_VAR'",
+			"line 1: invalid variable in: 'FUNCTION INVALID_VAR'",
 		},
 		{
 			"SET_IF_EMPTY ${X} Foo",
@@ -408,7 +399,7 @@ func TestProcessPreprocessorLines(t *testing.T) {
 		},
 		{
 			"DEFECTIVE_CHECK",
-			"missing argument(s) in DEFECTIVE_CHECK for , wanted: 1, got: 0",
+			"line 1: missing argument(s) in DEFECTIVE_CHECK for , wanted: 1, got: 0",
 		},
 	}
 	preprocessor, err := NewPreprocessor()
@@ -430,7 +421,7 @@ func TestProcessPreprocessorLines(t *testing.T) {
 			"EMPTY":   &empty,
 			"TEMPDIR": &tempDir,
 		}
-		err := preprocessor.processPreprocessorLines([]string{c.line}, &env)
+		_, _, err := preprocessor.processPreprocessorLines([]preprocessorLine{{c.line, 1, true}}, &env, []string{""})
 		if len(c.errorMessage) > 0 {
 			if err == nil {
 				t.Errorf("expected error @%d, got nil", i)
@@ -632,7 +623,7 @@ func TestExpandVariables(t *testing.T) {
 			[]string{
 				"static",
 				"",
-				"$X",
+				"",
 			},
 		},
 		{
@@ -685,10 +676,275 @@ func TestExpandVariables(t *testing.T) {
 		},
 	}
 	for i, c := range cases {
-		r := expandVariables(c.input, &env)
+		r, err := expandVariables(c.input, nil, &env, false)
+		if err != nil {
+			t.Errorf("unexpected error @%d: %s", i, err)
+			continue
+		}
 		if len(r) != len(c.expected) {
 			t.Errorf("incorrect result size @%d, got: %d, wanted: %d", i, len(r), len(c.expected))
 			continue
 		}
+		for j, l := range r {
+			if l != c.expected[j] {
+				t.Errorf("incorrect line @%d,%d, got: '%s', wanted: '%s'", i, j, l, c.expected[j])
+			}
+		}
+	}
+}
+
+func TestExpandVariablesErrors(t *testing.T) {
+	env := testEnv{}
+	cases := []struct {
+		input   []string
+		numbers []int
+		strict  bool
+		err     string
+	}{
+		{[]string{"a", "${X:?needed}"}, nil, false, "line 2: required variable 'X' is missing a value: needed"},
+		{[]string{"a", "${X:?needed}"}, []int{3, 5}, false, "line 5: required variable 'X' is missing a value: needed"},
+		{[]string{"${X}"}, []int{7}, true, "line 7: variable 'X' is not set"},
+		{[]string{"${X:-default}"}, []int{7}, true, ""},
+		{[]string{"${X"}, []int{1}, false, "line 1: missing closing brace in '${X'"},
+	}
+	for i, c := range cases {
+		_, err := expandVariables(c.input, c.numbers, &env, c.strict)
+		if (err != nil && c.err == "") || (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("incorrect error @%d, got: %v, wanted: %s", i, err, c.err)
+		}
+	}
+}
+
+type testScopedEnv struct {
+	testEnv
+	scopes map[string]testEnv
+}
+
+func (e testScopedEnv) Scope(name string) Environment {
+	if scope, found := e.scopes[name]; found {
+		return scope
+	}
+	return e.testEnv
+}
+
+func TestExpandVariablesScoped(t *testing.T) {
+	global := "global"
+	local := "local"
+	env := testScopedEnv{
+		testEnv: testEnv{"X": &global},
+		scopes: map[string]testEnv{
+			"a": {"X": &local},
+		},
+	}
+	input := []string{
+		"x-top: ${X}",
+		"steps:",
+		"  a:",
+		"    # ${X}",
+		"    image: ${X}",
+		"    command:",
+		"      - ${X}",
+		"",
+		"  b:",
+		"    image: ${X}",
+		"services:",
+		"  'a':",
+		"    image: ${X}",
+		"other:",
+		"  a: ${X}",
+	}
+	expected := []string{
+		"x-top: global",
+		"steps:",
+		"  a:",
+		"    # local",
+		"    image: local",
+		"    command:",
+		"      - local",
+		"",
+		"  b:",
+		"    image: global",
+		"services:",
+		"  'a':",
+		"    image: local",
+		"other:",
+		"  a: global",
+	}
+	r, err := expandVariables(input, nil, env, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i, l := range r {
+		if l != expected[i] {
+			t.Errorf("incorrect line @%d, got: '%s', wanted: '%s'", i, l, expected[i])
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "assertions")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.WriteString("gantry\n"); err != nil {
+		t.Error(err)
+		return
+	}
+	tempFile.Close()
+	file := tempFile.Name()
+	dir := os.TempDir()
+	value := "prod"
+	empty := ""
+
+	instruction := func(function string, current *string, arguments ...string) Instruction {
+		return Instruction{
+			Function:          function,
+			Variable:          "VAR",
+			Arguments:         arguments,
+			CurrentValue:      current,
+			CurrentValueFound: current != nil,
+		}
+	}
+	// Relative paths are resolved from the directory of the processed file
+	relative := func(function string, arguments ...string) Instruction {
+		name := filepath.Base(file)
+		i := instruction(function, &name, arguments...)
+		i.Dir = filepath.Dir(file)
+		return i
+	}
+	cases := []struct {
+		f            func(Instruction, Environment, bool) error
+		instruction  Instruction
+		dryRun       bool
+		errorMessage string
+	}{
+		{require, instruction("REQUIRE", &value), false, ""},
+		{require, instruction("REQUIRE", &empty), false, "missing value in REQUIRE for VAR"},
+		{require, instruction("REQUIRE", nil, "set", "VAR", "to", "the", "stage"), false, "missing value in REQUIRE for VAR: set VAR to the stage"},
+		{require, instruction("REQUIRE", nil), true, ""},
+		{checkIfFileExists, instruction("CHECK_IF_FILE_EXISTS", &file), false, ""},
+		{checkIfFileExists, instruction("CHECK_IF_FILE_EXISTS", &dir), false, fmt.Sprintf("path error in CHECK_IF_FILE_EXISTS for VAR: not a file '%s'", dir)},
+		{checkIfFileExists, instruction("CHECK_IF_FILE_EXISTS", nil), true, ""},
+		{checkIfFileExists, relative("CHECK_IF_FILE_EXISTS"), false, ""},
+		{assertMatches, instruction("ASSERT_MATCHES", &value, "pro?d|dev"), false, ""},
+		{assertMatches, instruction("ASSERT_MATCHES", &value, "pro"), false, "assertion error in ASSERT_MATCHES for VAR: 'prod' does not match 'pro'"},
+		{assertMatches, instruction("ASSERT_MATCHES", &value, "("), true, "invalid regular expression in ASSERT_MATCHES for VAR: error parsing regexp: missing closing ): `^(?:()$`"},
+		{assertMatches, instruction("ASSERT_MATCHES", nil, "pro"), true, ""},
+		{assertOneOf, instruction("ASSERT_ONE_OF", &value, "dev", "prod"), false, ""},
+		{assertOneOf, instruction("ASSERT_ONE_OF", &empty, "dev", "prod"), false, "assertion error in ASSERT_ONE_OF for VAR: '' is not one of 'dev', 'prod'"},
+		{assertOneOf, instruction("ASSERT_ONE_OF", &empty, "dev"), true, ""},
+		{checkFreeSpace, instruction("CHECK_FREE_SPACE", &dir, "1K"), false, ""},
+		{checkFreeSpace, instruction("CHECK_FREE_SPACE", &dir, "fifty"), true, "invalid size in CHECK_FREE_SPACE for VAR: 'fifty' is not a size"},
+		{checkFreeSpace, instruction("CHECK_FREE_SPACE", &dir, "16000PiB"), true, ""},
+		{checkFreeSpace, relative("CHECK_FREE_SPACE", "1K"), false, ""},
+		{checksum, instruction("CHECKSUM", &file, "sha256:81fde2561ba93999448e2c27574714a31339dc8d3bdb1ed8ba8f13a7d7c82146"), false, ""},
+		{checksum, instruction("CHECKSUM", &file, "md5:5185C361BA0F3CBB02FC78A3BAFF714F"), false, ""},
+		{checksum, instruction("CHECKSUM", &file, "md5:00000000000000000000000000000000"), false, "checksum error in CHECKSUM for VAR: got: 'md5:5185c361ba0f3cbb02fc78a3baff714f', wanted: 'md5:00000000000000000000000000000000'"},
+		{checksum, instruction("CHECKSUM", nil, "md5:00000000000000000000000000000000"), true, ""},
+		{checksum, relative("CHECKSUM", "md5:5185C361BA0F3CBB02FC78A3BAFF714F"), false, ""},
+		{checksum, instruction("CHECKSUM", &file, "crc32:1234"), true, "invalid checksum in CHECKSUM for VAR: 'crc32:1234', wanted: 'ALGORITHM:HEX' with ALGORITHM one of md5, sha1, sha256, sha512"},
+	}
+	for i, c := range cases {
+		err := c.f(c.instruction, testEnv{}, c.dryRun)
+		if len(c.errorMessage) > 0 {
+			if err == nil {
+				t.Errorf("expected error @%d, got nil", i)
+				continue
+			}
+			if err.Error() != c.errorMessage {
+				t.Errorf("incorrect error @%d, got: '%s', wanted: '%s'", i, err, c.errorMessage)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected error @%d: '%s'", i, err)
+		}
+	}
+	err = checkFreeSpace(instruction("CHECK_FREE_SPACE", &dir, "16000PiB"), testEnv{}, false)
+	if err == nil || !strings.HasPrefix(err.Error(), "space error in CHECK_FREE_SPACE for VAR: ") {
+		t.Errorf("incorrect error for missing space, got: '%v'", err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]uint64{
+		"4096":  4096,
+		"1k":    1024,
+		"50G":   50 << 30,
+		"1.5TB": 3 << 39,
+		"2MiB":  2 << 20,
+	}
+	for size, wanted := range cases {
+		if r, err := parseSize(size); err != nil || r != wanted {
+			t.Errorf("incorrect size for '%s', got: %d (%v), wanted: %d", size, r, err, wanted)
+		}
+	}
+	if _, err := parseSize("5X"); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestSetFrom(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "setFromFile")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err := tempFile.WriteString("1.2.3\n"); err != nil {
+		t.Error(err)
+		return
+	}
+	tempFile.Close()
+	os.Setenv("GANTRY_TEST_SET_FROM_ENV", "host")
+	defer os.Unsetenv("GANTRY_TEST_SET_FROM_ENV")
+	set := "set"
+
+	cases := []struct {
+		f            func(Instruction, Environment, bool) error
+		arguments    []string
+		current      *string
+		dryRun       bool
+		value        string
+		errorMessage string
+	}{
+		{setFromCommand, []string{"echo", "'a  b'", "c"}, nil, false, "a  b c", ""},
+		{setFromCommand, []string{"echo", "a"}, &set, false, "set", ""},
+		{setFromCommand, []string{"iDoNotExist"}, nil, true, "dummy-command-output", ""},
+		{setFromCommand, []string{"sh", "-c", "'echo failed >&2; exit 1'"}, nil, false, "", "command error in FUNCTION for VAR: err: 'exit status 1' failed"},
+		{setFromCommand, []string{"'unterminated"}, nil, false, "", "invalid command in FUNCTION for VAR: ''unterminated'"},
+		{setFromFile, []string{tempFile.Name()}, nil, false, "1.2.3", ""},
+		{setFromFile, []string{"/iDoNotExist"}, nil, true, "dummy-file-content", ""},
+		{setFromFile, []string{"/iDoNotExist"}, nil, false, "", "path error in FUNCTION for VAR: err: 'open /iDoNotExist: no such file or directory'"},
+		{setFromEnv, []string{"GANTRY_TEST_SET_FROM_ENV"}, nil, false, "host", ""},
+		{setFromEnv, []string{"GANTRY_TEST_SET_FROM_ENV"}, &set, false, "set", ""},
+		{setFromEnv, []string{"GANTRY_TEST_NOT_SET"}, nil, true, "dummy-env-value", ""},
+		{setFromEnv, []string{"GANTRY_TEST_NOT_SET"}, nil, false, "", "environment error in FUNCTION for VAR: 'GANTRY_TEST_NOT_SET' is not set"},
+	}
+	for i, c := range cases {
+		env := testEnv{"VAR": c.current}
+		instruction := Instruction{
+			Function:          "FUNCTION",
+			Variable:          "VAR",
+			Arguments:         c.arguments,
+			CurrentValue:      c.current,
+			CurrentValueFound: true,
+		}
+		err := c.f(instruction, env, c.dryRun)
+		if len(c.errorMessage) > 0 {
+			if err == nil {
+				t.Errorf("expected error @%d, got nil", i)
+			} else if err.Error() != c.errorMessage {
+				t.Errorf("incorrect error @%d, got: '%s', wanted: '%s'", i, err, c.errorMessage)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error @%d: '%s'", i, err)
+			continue
+		}
+		if env["VAR"] == nil || *env["VAR"] != c.value {
+			t.Errorf("incorrect value @%d, got: '%v', wanted: '%s'", i, env["VAR"], c.value)
+		}
 	}
 }
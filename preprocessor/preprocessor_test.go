@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/ad-freiburg/gantry"
@@ -115,7 +117,7 @@ ${EMPTY}`,
 			}
 			path = tmpEnv.Name()
 		}
-		e, err := gantry.NewPipelineEnvironment(path, c.substitutions, types.StringSet{}, types.StringSet{})
+		e, err := gantry.NewPipelineEnvironment([]string{path}, c.substitutions, types.StringSet{}, types.StringSet{})
 		if err != nil {
 			if os.IsNotExist(err) && len(c.env) < 1 {
 				// No env provided, error is expected
@@ -145,14 +147,14 @@ func TestPreprocessorProcessErrors(t *testing.T) {
 		{
 			"#! UNKNOWN",
 			"",
-			"unknown preprocessor directive: 'UNKNOWN'",
+			"line 1: unknown preprocessor directive: 'UNKNOWN'",
 			"",
 			types.StringMap{},
 		},
 		{
 			"#! DEFECTIVE_CHECK",
 			"",
-			"missing argument(s) in DEFECTIVE_CHECK for , wanted: 1, got: 0",
+			"line 1: missing argument(s) in DEFECTIVE_CHECK for , wanted: 1, got: 0",
 			"",
 			types.StringMap{},
 		},
@@ -184,7 +186,7 @@ func TestPreprocessorProcessErrors(t *testing.T) {
 			}
 			path = tmpEnv.Name()
 		}
-		e, err := gantry.NewPipelineEnvironment(path, c.substitutions, types.StringSet{}, types.StringSet{})
+		e, err := gantry.NewPipelineEnvironment([]string{path}, c.substitutions, types.StringSet{}, types.StringSet{})
 		if err != nil {
 			if os.IsNotExist(err) && len(c.env) < 1 {
 				// No env provided, error is expected
@@ -206,6 +208,33 @@ func TestPreprocessorProcessErrors(t *testing.T) {
 	}
 }
 
+func TestPreprocessorProcessLines(t *testing.T) {
+	bar := barValue
+	preproc, err := preprocessor.NewPreprocessor()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	e, err := gantry.NewPipelineEnvironment([]string{""}, types.StringMap{"Foo": &bar}, types.StringSet{}, types.StringSet{})
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	in := `#! SET_IF_EMPTY ${Baz} 1
+a: ${Foo}
+# comment
+b: 2`
+	resBytes, lines, err := preproc.ProcessLines([]byte(in), e)
+	if err != nil {
+		t.Error(err)
+	}
+	if out := "a: Bar\nb: 2"; string(resBytes) != out {
+		t.Errorf("incorrect transformation: got: '%s', wanted: '%s'", string(resBytes), out)
+	}
+	if expected := []int{2, 4}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("incorrect line numbers: got: '%#v', wanted: '%#v'", lines, expected)
+	}
+}
+
 func TestPreprocessorFunctions(t *testing.T) {
 	preproc, err := preprocessor.NewPreprocessor()
 	if err != nil {
@@ -226,3 +255,188 @@ func TestPreprocessorFunctions(t *testing.T) {
 		t.Errorf("incorrect number of functions, got: %d, wanted: %d", updatedNumFunctions, numFunctions+1)
 	}
 }
+
+func TestPreprocessorProcessBlocks(t *testing.T) {
+	bar := barValue
+	empty := ""
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{"#! IF ${Foo}\na: 1\n#! ELSE\na: 2\n#! ENDIF", "a: 1"},
+		{"#! IF ${Empty}\na: 1\n#! ELSE\na: 2\n#! ENDIF", "a: 2"},
+		{"#! IF ${NOT_DECLARED}\na: 1\n#! ENDIF\nb: 2", "b: 2"},
+		{"#! IF_EQ ${Foo} Baz\na: 1\n#! ELIF_EQ ${Foo} Bar\na: 2\n#! ELIF ${Foo}\na: 3\n#! ELSE\na: 4\n#! ENDIF", "a: 2"},
+		{"#! IF_NE ${Foo} Bar\na: 1\n#! ELIF_NE ${Foo} Baz\na: 2\n#! ENDIF", "a: 2"},
+		{"#! if_eq ${Foo} Bar\na: 1\n#! endif", "a: 1"},
+		{"#! IF ${Foo}\n#! IF ${Empty}\na: 1\n#! ELSE\na: 2\n#! ENDIF\n#! ELSE\n#! IF ${Foo}\na: 3\n#! ENDIF\n#! ENDIF", "a: 2"},
+		{"#! IF ${Empty}\n#! SET_IF_EMPTY ${Baz} 1\n#! ENDIF\n#! SET_IF_EMPTY ${Baz} 2\nb: ${Baz}", "b: 2"},
+		{"#! IF ${Foo}\n#! SET_IF_EMPTY ${Baz} 1\n#! ENDIF\n#! IF_EQ ${Baz} 1\nb: ${Baz}\n#! ENDIF", "b: 1"},
+	}
+	preproc, err := preprocessor.NewPreprocessor()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, c := range cases {
+		e, err := gantry.NewPipelineEnvironment([]string{""}, types.StringMap{"Foo": &bar, "Empty": &empty}, types.StringSet{}, types.StringSet{})
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		resBytes, err := preproc.Process([]byte(c.in), e)
+		if err != nil {
+			t.Errorf("unexpected error for '%s': %s", c.in, err)
+		}
+		if string(resBytes) != c.out {
+			t.Errorf("incorrect transformation of '%s': got: '%s', wanted: '%s'", c.in, string(resBytes), c.out)
+		}
+	}
+}
+
+func TestPreprocessorProcessBlocksErrors(t *testing.T) {
+	cases := []struct {
+		in  string
+		err string
+	}{
+		{"a: 1\n#! ELSE", "line 2: ELSE without IF"},
+		{"#! ENDIF", "line 1: ENDIF without IF"},
+		{"#! IF ${Foo}\n#! IF ${Foo}\n#! ENDIF", "line 1: missing ENDIF for IF"},
+		{"#! IF ${Foo}\n#! ELSE\n#! ELSE\n#! ENDIF", "line 3: duplicate ELSE of IF in line 1"},
+		{"#! IF ${Foo}\n#! ELSE\n#! ELIF ${Foo}\n#! ENDIF", "line 3: ELIF after ELSE of IF in line 1"},
+		{"#! IF_EQ ${Foo}\n#! ENDIF", "line 1: missing argument(s) in IF_EQ for Foo, wanted: 1, got: 0"},
+		{"#! IF ${Empty}\n#! UNKNOWN\n#! ENDIF", "line 2: unknown preprocessor directive: 'UNKNOWN'"},
+	}
+	preproc, err := preprocessor.NewPreprocessor()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, c := range cases {
+		e, err := gantry.NewPipelineEnvironment([]string{""}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+		_, err = preproc.Process([]byte(c.in), e)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("incorrect error for '%s': got: '%v', wanted: '%s'", c.in, err, c.err)
+		}
+	}
+}
+
+func TestPreprocessorProcessFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"main.yml": `#! SET_IF_EMPTY ${Level} debug
+environment:
+#! INCLUDE fragments/env.yml 2
+#! IF ${Extra}
+#! INCLUDE ${Missing}/missing.yml
+#! ENDIF
+level: ${Level}
+port: ${Port}`,
+		"fragments/env.yml": `#! SET_IF_EMPTY ${Port} 8080
+LEVEL: ${Level}
+#! INCLUDE nested/env.yml 2`,
+		"fragments/nested/env.yml": `
+# comment
+nested: true`,
+		"cycle.yml":  "#! INCLUDE cycle2.yml",
+		"cycle2.yml": "a: 1\n#! INCLUDE cycle.yml",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	preproc, err := preprocessor.NewPreprocessor()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	e, err := gantry.NewPipelineEnvironment([]string{""}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	resBytes, lines, err := preproc.ProcessFileLines(filepath.Join(dir, "main.yml"), e)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if out := "environment:\n  LEVEL: debug\n\n    nested: true\nlevel: debug\nport: 8080"; string(resBytes) != out {
+		t.Errorf("incorrect transformation: got: '%s', wanted: '%s'", string(resBytes), out)
+	}
+	if expected := []int{2, 3, 3, 3, 7, 8}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("incorrect line numbers: got: '%#v', wanted: '%#v'", lines, expected)
+	}
+
+	path := filepath.Join(dir, "cycle.yml")
+	_, err = preproc.ProcessFile(path, e)
+	if wanted := fmt.Sprintf("line 1: %s: line 2: cyclic INCLUDE of '%s'", filepath.Join(dir, "cycle2.yml"), path); err == nil || err.Error() != wanted {
+		t.Errorf("incorrect error: got: '%v', wanted: '%s'", err, wanted)
+	}
+	for in, wanted := range map[string]string{
+		"#! INCLUDE":                "line 1: missing argument(s) in INCLUDE for , wanted: 1, got: 0",
+		"#! INCLUDE main.yml two":   "line 1: invalid indent 'two' in INCLUDE",
+		"#! include main.yml 2 2":   "line 1: too many arguments in include for , wanted: 2, got: 3",
+		"#! INCLUDE unknown.yml":    "line 1: open " + filepath.Join(dir, "unknown.yml") + ": no such file or directory",
+		"#! INCLUDE main.yml\na: 1": "line 1: cyclic INCLUDE of '" + filepath.Join(dir, "main.yml") + "'",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "main.yml"), []byte(in), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = preproc.ProcessFile(filepath.Join(dir, "main.yml"), e)
+		if err == nil || err.Error() != wanted {
+			t.Errorf("incorrect error for '%s': got: '%v', wanted: '%s'", in, err, wanted)
+		}
+	}
+}
+
+func TestPreprocessorProcessFileSetFromRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setfrom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"main.yml": `#! INCLUDE fragments/env.yml
+version: ${Version}
+where: ${Where}`,
+		"fragments/env.yml": `#! SET_FROM_FILE ${Version} VERSION
+#! SET_FROM_COMMAND ${Where} pwd`,
+		"fragments/VERSION": "1.2.3\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	preproc, err := preprocessor.NewPreprocessor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := gantry.NewPipelineEnvironment([]string{""}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	resBytes, err := preproc.ProcessFile(filepath.Join(dir, "main.yml"), e)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if out := "version: 1.2.3\nwhere: " + filepath.Join(dir, "fragments"); string(resBytes) != out {
+		t.Errorf("incorrect transformation: got: '%s', wanted: '%s'", string(resBytes), out)
+	}
+}
@@ -0,0 +1,81 @@
+package preprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// setFromCommand sets the variable of i to the output of the command given by
+// the arguments of i, which are split like a shell would. The command is run
+// in the directory of the processed file.
+func setFromCommand(i Instruction, e Environment, dryRun bool) error {
+	if currentValue(i) != "" {
+		return nil
+	}
+	args, err := shlex.Split(strings.Join(i.Arguments, " "))
+	if err != nil || len(args) == 0 {
+		return fmt.Errorf("invalid command in %s for %s: '%s'", i.Function, i.Variable, strings.Join(i.Arguments, " "))
+	}
+	value := "dummy-command-output"
+	if !dryRun {
+		var stderr bytes.Buffer
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Dir = i.Dir
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("command error in %s for %s: err: '%s' %s", i.Function, i.Variable, err, strings.TrimSpace(stderr.String()))
+		}
+		value = strings.TrimSpace(string(output))
+	}
+	e.SetSubstitution(i.Variable, &value)
+	return nil
+}
+
+// setFromFile sets the variable of i to the contents of the file given by
+// the first argument of i, relative paths are resolved from the directory of
+// the processed file.
+func setFromFile(i Instruction, e Environment, dryRun bool) error {
+	if currentValue(i) != "" {
+		return nil
+	}
+	value := "dummy-file-content"
+	if !dryRun {
+		path := i.Arguments[0]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(i.Dir, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("path error in %s for %s: err: '%s'", i.Function, i.Variable, err)
+		}
+		value = strings.TrimSpace(string(content))
+	}
+	e.SetSubstitution(i.Variable, &value)
+	return nil
+}
+
+// setFromEnv sets the variable of i to the value of the host environment
+// variable given by the first argument of i.
+func setFromEnv(i Instruction, e Environment, dryRun bool) error {
+	if currentValue(i) != "" {
+		return nil
+	}
+	value := "dummy-env-value"
+	if !dryRun {
+		var found bool
+		value, found = os.LookupEnv(i.Arguments[0])
+		if !found {
+			return fmt.Errorf("environment error in %s for %s: '%s' is not set", i.Function, i.Variable, i.Arguments[0])
+		}
+	}
+	e.SetSubstitution(i.Variable, &value)
+	return nil
+}
@@ -3,9 +3,11 @@ package gantry // import "github.com/ad-freiburg/gantry"
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
 	"os/user"
 	"strings"
@@ -57,6 +59,21 @@ func isUserInDockerGroup() bool {
 	return false
 }
 
+var (
+	engineRootless     bool
+	engineRootlessOnce sync.Once
+)
+
+// isEngineRootless returns whether the container engine runs without root
+// privileges, e.g. rootless docker.
+func isEngineRootless() bool {
+	engineRootlessOnce.Do(func() {
+		out, err := exec.Command(getContainerExecutable(), "info", "--format", "{{.SecurityOptions}}").Output()
+		engineRootless = err == nil && strings.Contains(string(out), "rootless")
+	})
+	return engineRootless
+}
+
 func isWharferInstalled() bool {
 	cmd := exec.Command(wharfer, "--version")
 	if err := cmd.Run(); err != nil {
@@ -71,7 +88,9 @@ type Runner interface {
 	PrintContainerExecutable() func() error
 	ImageBuilder(Step, bool) func() error
 	ImagePuller(Step) func() error
+	ImagePusher(Step) func() error
 	ImageExistenceChecker(Step) func() error
+	ImageDigestResolver(Step) func() (string, error)
 	ContainerKiller(Step) func() (int, error)
 	ContainerRemover(Step) func() error
 	ContainerRunner(Step, Network) func() error
@@ -165,6 +184,16 @@ func (r *NoopRunner) ImagePuller(step Step) func() error {
 	}
 }
 
+// ImagePusher returns a function to push the image for the given step.
+func (r *NoopRunner) ImagePusher(step Step) func() error {
+	key := fmt.Sprintf("ImagePusher(%s)", step.Name)
+	r.incrementCalls(key)
+	return func() error {
+		r.incrementCalled(key)
+		return nil
+	}
+}
+
 // ImageExistenceChecker returns a function which checks if the image for the given step exists.
 func (r *NoopRunner) ImageExistenceChecker(step Step) func() error {
 	key := fmt.Sprintf("ImageExistenceChecker(%s)", step.Name)
@@ -175,6 +204,17 @@ func (r *NoopRunner) ImageExistenceChecker(step Step) func() error {
 	}
 }
 
+// ImageDigestResolver returns a function which resolves the digest of the
+// image for the given step.
+func (r *NoopRunner) ImageDigestResolver(step Step) func() (string, error) {
+	key := fmt.Sprintf("ImageDigestResolver(%s)", step.Name)
+	r.incrementCalls(key)
+	return func() (string, error) {
+		r.incrementCalled(key)
+		return "", nil
+	}
+}
+
 // ContainerKiller returns a function to kill the container for the given step.
 func (r *NoopRunner) ContainerKiller(step Step) func() (int, error) {
 	key := fmt.Sprintf("ContainerKiller(%s)", step.Name)
@@ -265,11 +305,20 @@ func (r *LocalRunner) Copy() Runner {
 
 // Exec executes given arguments with the containerExecutable.
 func (r *LocalRunner) Exec(args []string) error {
+	return r.execWithEnv(args, nil)
+}
+
+// execWithEnv executes given arguments with the containerExecutable, env is
+// added to the environment of the process.
+func (r *LocalRunner) execWithEnv(args []string, env []string) error {
 	ce := getContainerExecutable()
 	if ShowContainerCommands {
-		log.Printf("Exec:   %s %s", ce, strings.Join(args, " "))
+		log.Printf("Exec:   %s %s", ce, MaskSecrets(strings.Join(args, " ")))
 	}
 	cmd := exec.Command(ce, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	cmd.Stdout = NewPrefixedLogger(r.prefix, log.New(r.stdout, "", log.LstdFlags))
 	cmd.Stderr = NewPrefixedLogger(r.prefix, log.New(r.stderr, "", log.LstdFlags))
 	return cmd.Run()
@@ -279,7 +328,7 @@ func (r *LocalRunner) Exec(args []string) error {
 func (r *LocalRunner) Output(args []string) ([]byte, error) {
 	ce := getContainerExecutable()
 	if ShowContainerCommands {
-		log.Printf("Output: %s %s", ce, strings.Join(args, " "))
+		log.Printf("Output: %s %s", ce, MaskSecrets(strings.Join(args, " ")))
 	}
 	cmd := exec.Command(ce, args...)
 	return cmd.Output()
@@ -303,7 +352,7 @@ func (r *LocalRunner) ImageBuilder(step Step, pull bool) func() error {
 		r.prefix = step.ColoredContainerName()
 		r.stdout = step.Meta.Stdout
 		r.stderr = step.Meta.Stderr
-		return r.Exec(step.BuildCommand(pull))
+		return r.execWithEnv(step.BuildCommand(pull), step.BuildEnvironment())
 	}
 }
 
@@ -320,6 +369,19 @@ func (r *LocalRunner) ImagePuller(step Step) func() error {
 	}
 }
 
+// ImagePusher returns a function to push the image for the given step.
+func (r *LocalRunner) ImagePusher(step Step) func() error {
+	return func() error {
+		if Verbose {
+			log.Printf("Push image for '%s'", step.ContainerName())
+		}
+		r.prefix = step.ColoredContainerName()
+		r.stdout = step.Meta.Stdout
+		r.stderr = step.Meta.Stderr
+		return r.Exec(step.PushCommand())
+	}
+}
+
 // ImageExistenceChecker returns a function which checks if the image for the given step exists.
 func (r *LocalRunner) ImageExistenceChecker(step Step) func() error {
 	return func() error {
@@ -352,6 +414,29 @@ func (r *LocalRunner) ImageExistenceChecker(step Step) func() error {
 	}
 }
 
+// ImageDigestResolver returns a function which resolves the digest of the
+// image for the given step.
+func (r *LocalRunner) ImageDigestResolver(step Step) func() (string, error) {
+	return func() (string, error) {
+		if Verbose {
+			log.Printf("Resolve digest of image ('%s') for '%s'", step.ImageName(), step.ContainerName())
+		}
+		out, err := r.Output([]string{"image", "inspect", "--format", "{{json .RepoDigests}}", step.ImageName()})
+		if err != nil {
+			return "", err
+		}
+		var repoDigests []string
+		if err := json.Unmarshal(bytes.TrimSpace(out), &repoDigests); err != nil {
+			return "", err
+		}
+		digest := digestFromRepoDigests(step.ImageName(), repoDigests)
+		if digest == "" {
+			return "", fmt.Errorf("no digest found for image '%s'", step.ImageName())
+		}
+		return digest, nil
+	}
+}
+
 // ContainerKiller returns a function to kill the container for the given step.
 func (r *LocalRunner) ContainerKiller(step Step) func() (int, error) {
 	return func() (int, error) {
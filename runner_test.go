@@ -82,6 +82,22 @@ func TestNoopRunnerImagePuller(t *testing.T) {
 	checkCallsAndCalled(t, runner, key, 1, 1)
 }
 
+func TestNoopRunnerImagePusher(t *testing.T) {
+	runner := gantry.NewNoopRunner(true)
+	step := gantry.Step{}
+	step.Name = stepName
+	key := fmt.Sprintf("ImagePusher(%s)", step.Name)
+	checkCallsAndCalled(t, runner, key, 0, 0)
+
+	f := runner.ImagePusher(step)
+	checkCallsAndCalled(t, runner, key, 1, 0)
+
+	if err := f(); err != nil {
+		t.Errorf("unexpected error, got: '%#v', wanted 'nil'", err)
+	}
+	checkCallsAndCalled(t, runner, key, 1, 1)
+}
+
 func TestNoopRunnerImageExistenceChecker(t *testing.T) {
 	runner := gantry.NewNoopRunner(true)
 	step := gantry.Step{}
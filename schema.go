@@ -0,0 +1,258 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+// JSONSchemaDraft is the JSON Schema version of the generated schemas.
+const JSONSchemaDraft string = "http://json-schema.org/draft-07/schema#"
+
+// Schema is a JSON Schema stored as generic map.
+type Schema map[string]interface{}
+
+// extensionPattern matches extension fields, which are not validated.
+const extensionPattern string = "^x-"
+
+// scalarSchema is the schema of strings. Definitions are loaded into
+// generic maps first, numbers and booleans are not converted into strings.
+var scalarSchema = Schema{"type": "string"}
+
+// schemaOverride returns the schema of types with custom unmarshalling.
+func schemaOverride(t reflect.Type) (Schema, bool) {
+	switch t {
+	case reflect.TypeOf(types.StringOrStringSlice{}), reflect.TypeOf(types.StringSet{}):
+		return Schema{"type": []interface{}{"string", "array"}, "items": scalarSchema}, true
+	case reflect.TypeOf(types.StringMap{}):
+		return Schema{
+			"type":                 []interface{}{"object", "array"},
+			"additionalProperties": Schema{"type": []interface{}{"string", "null"}},
+			"items":                scalarSchema,
+		}, true
+	case reflect.TypeOf(types.StringOrNumber("")):
+		return Schema{"type": []interface{}{"string", "number"}}, true
+	case reflect.TypeOf(ServiceKeepAlive(0)):
+		return Schema{"type": "string", "enum": []interface{}{"yes", "no", "replace"}}, true
+	case reflect.TypeOf(WorkspaceLifecycle("")):
+		return Schema{"type": "string", "enum": []interface{}{"run", "project", "persistent"}}, true
+	case reflect.TypeOf(ServiceLogHandler(0)):
+		return Schema{"type": "string", "enum": []interface{}{"stdout", "file", "both", "discard"}}, true
+	case reflect.TypeOf(BuildInfo{}):
+		return stringOrObjectSchema(buildInfoJSON{}), true
+	case reflect.TypeOf(BuildSecret{}):
+		return stringOrObjectSchema(buildSecretJSON{}), true
+	case reflect.TypeOf(ServiceSecret{}):
+		return stringOrObjectSchema(serviceSecretJSON{}), true
+	}
+	return nil, false
+}
+
+// definitionOnlyKeys are handled while loading definitions and are not part
+// of the Service struct.
+var definitionOnlyKeys = map[string]Schema{
+	"extends": {
+		"type":                 []interface{}{"string", "object"},
+		"properties":           map[string]interface{}{"service": scalarSchema, "file": scalarSchema},
+		"additionalProperties": false,
+	},
+}
+
+// composeServiceKeys are keys of the compose specification which gantry
+// accepts in services and steps but ignores.
+var composeServiceKeys = []string{
+	"annotations", "attach", "blkio_config", "cap_add", "cap_drop", "cgroup",
+	"cgroup_parent", "configs", "container_name", "cpu_count", "cpu_percent",
+	"cpu_period", "cpu_quota", "cpu_rt_period", "cpu_rt_runtime", "cpu_shares",
+	"credential_spec", "develop", "device_cgroup_rules", "devices", "dns",
+	"dns_opt", "dns_search", "domainname", "env_file", "expose",
+	"external_links", "extra_hosts", "gpus", "group_add", "healthcheck",
+	"hostname", "init", "ipc", "isolation", "label_file", "labels", "links",
+	"logging", "mac_address", "mem_swappiness", "memswap_limit", "models",
+	"network_mode", "networks", "oom_kill_disable", "oom_score_adj", "pid",
+	"platform", "post_start", "pre_stop", "privileged", "provider",
+	"pull_policy", "read_only", "runtime", "scale", "security_opt",
+	"shm_size", "stdin_open", "stop_grace_period", "stop_signal",
+	"storage_opt", "sysctls", "tmpfs", "tty", "ulimits", "use_api_socket",
+	"user", "userns_mode", "uts", "volumes_from", "working_dir",
+}
+
+// composeTopLevelKeys are top-level keys of the compose specification which
+// gantry accepts but ignores.
+var composeTopLevelKeys = []string{"configs", "models", "name", "networks", "volumes"}
+
+// DefinitionSchema returns the JSON Schema of gantry definitions.
+func DefinitionSchema() Schema {
+	services := Schema{
+		"type":                 "object",
+		"additionalProperties": serviceSchema(reflect.TypeOf(Service{})),
+	}
+	step := serviceSchema(reflect.TypeOf(Step{}))
+	step["properties"].(map[string]interface{})[matrixKey] = Schema{
+		"type": "object",
+		"additionalProperties": Schema{
+			"type":  "array",
+			"items": Schema{"type": []interface{}{"string", "number"}},
+		},
+	}
+	template := serviceSchema(reflect.TypeOf(Step{}))
+	for k, v := range step["properties"].(map[string]interface{}) {
+		template["properties"].(map[string]interface{})[k] = v
+	}
+	template["properties"].(map[string]interface{})[templateParamsKey] = Schema{
+		"type":                 []interface{}{"array", "object"},
+		"items":                scalarSchema,
+		"additionalProperties": Schema{"type": []interface{}{"string", "number", "boolean", "null"}},
+	}
+	step["properties"].(map[string]interface{})[templateUsesKey] = scalarSchema
+	step["properties"].(map[string]interface{})[templateWithKey] = Schema{
+		"type":                 "object",
+		"additionalProperties": Schema{"type": []interface{}{"string", "number", "boolean", "null"}},
+	}
+	steps := Schema{
+		"type":                 "object",
+		"additionalProperties": step,
+	}
+	properties := map[string]interface{}{
+		"version":  scalarSchema,
+		"services": services,
+		"steps":    steps,
+		"secrets": Schema{
+			"type":                 "object",
+			"additionalProperties": schemaForType(reflect.TypeOf(SecretDefinition{})),
+		},
+		templatesKey: Schema{
+			"type":                 "object",
+			"additionalProperties": template,
+		},
+		"workspaces": Schema{
+			"type":                 "object",
+			"additionalProperties": schemaForType(reflect.TypeOf(Workspace{})),
+		},
+		includeKey: Schema{
+			"type":                 "object",
+			"additionalProperties": scalarSchema,
+		},
+	}
+	for _, key := range composeTopLevelKeys {
+		properties[key] = Schema{}
+	}
+	return Schema{
+		"$schema":              JSONSchemaDraft,
+		"title":                "gantry definition",
+		"type":                 "object",
+		"properties":           properties,
+		"patternProperties":    map[string]interface{}{extensionPattern: Schema{}},
+		"additionalProperties": false,
+	}
+}
+
+// EnvironmentSchema returns the JSON Schema of gantry environments.
+func EnvironmentSchema() Schema {
+	schema := schemaForType(reflect.TypeOf(pipelineEnvironmentJSON{}))
+	profile := Schema{
+		"type":                 "object",
+		"properties":           map[string]interface{}{},
+		"additionalProperties": false,
+	}
+	properties := schema["properties"].(map[string]interface{})
+	for _, key := range environmentProfileKeys {
+		profile["properties"].(map[string]interface{})[key] = properties[key]
+	}
+	properties["profiles"] = Schema{
+		"type":                 "object",
+		"additionalProperties": profile,
+	}
+	schema["$schema"] = JSONSchemaDraft
+	schema["title"] = "gantry environment"
+	return schema
+}
+
+// serviceSchema returns the schema of t including keys only used while
+// loading and extension fields.
+func serviceSchema(t reflect.Type) Schema {
+	schema := schemaForType(t)
+	properties := schema["properties"].(map[string]interface{})
+	for key, value := range definitionOnlyKeys {
+		properties[key] = value
+	}
+	for _, key := range composeServiceKeys {
+		if _, found := properties[key]; !found {
+			properties[key] = Schema{}
+		}
+	}
+	// Substitutions of x-gantry are not available while preprocessing
+	if meta, ok := properties["x-gantry"].(Schema); ok {
+		delete(meta["properties"].(map[string]interface{}), "substitutions")
+	}
+	schema["patternProperties"] = map[string]interface{}{extensionPattern: Schema{}}
+	// Entries without keys are allowed
+	schema["type"] = []interface{}{"object", "null"}
+	return schema
+}
+
+// stringOrObjectSchema returns the schema of types which are given either as
+// a string or as object of v.
+func stringOrObjectSchema(v interface{}) Schema {
+	schema := schemaForType(reflect.TypeOf(v))
+	schema["type"] = []interface{}{"string", "object"}
+	return schema
+}
+
+// schemaForType derives the schema of t from its json tags. Struct fields
+// without json tag are not part of the schema.
+func schemaForType(t reflect.Type) Schema {
+	if override, found := schemaOverride(t); found {
+		return override
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem())
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		addStructProperties(t, properties)
+		return Schema{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	case reflect.Map:
+		return Schema{
+			"type":                 "object",
+			"additionalProperties": schemaForType(t.Elem()),
+		}
+	case reflect.Slice, reflect.Array:
+		return Schema{
+			"type":  "array",
+			"items": schemaForType(t.Elem()),
+		}
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return scalarSchema
+	}
+	return Schema{}
+}
+
+// addStructProperties adds the schema of all tagged fields of t, fields of
+// embedded structs are added as well.
+func addStructProperties(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addStructProperties(field.Type, properties)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[name] = schemaForType(field.Type)
+	}
+}
@@ -0,0 +1,222 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// SecretMask replaces secret values in all output.
+const SecretMask string = "***"
+
+// SecretsMountPath is the directory secrets are mounted to in containers.
+const SecretsMountPath string = "/run/secrets"
+
+// secretsPrefix is the prefix of the temporary directory storing secrets
+// given as values.
+const secretsPrefix string = "gantry-secrets"
+
+var (
+	secretValues      = map[string]bool{}
+	secretValuesMutex sync.RWMutex
+)
+
+// secretLineMinLength is the minimal length of single lines of multi-line
+// secrets to be masked, shorter lines like braces of json or the armor lines
+// of keys would mask unrelated output.
+const secretLineMinLength = 8
+
+// RegisterSecret adds value to the values masked in all output. Lines of
+// multi-line values are masked separately if they are long enough.
+func RegisterSecret(value string) {
+	secretValuesMutex.Lock()
+	defer secretValuesMutex.Unlock()
+	if v := strings.TrimSpace(value); v != "" {
+		secretValues[v] = true
+	}
+	lines := strings.Split(value, "\n")
+	if len(lines) < 2 {
+		return
+	}
+	for _, v := range lines {
+		if v = strings.TrimSpace(v); len(v) >= secretLineMinLength && !strings.HasPrefix(v, "-----") {
+			secretValues[v] = true
+		}
+	}
+}
+
+// MaskSecrets replaces all registered secret values in s with SecretMask.
+func MaskSecrets(s string) string {
+	secretValuesMutex.RLock()
+	defer secretValuesMutex.RUnlock()
+	if len(secretValues) == 0 {
+		return s
+	}
+	values := make([]string, 0, len(secretValues))
+	for v := range secretValues {
+		values = append(values, v)
+	}
+	// Replace longer values first, they may contain shorter ones
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, SecretMask)
+	}
+	return s
+}
+
+// MaskedWriter is a writer which masks secret values before writing to its
+// target.
+type MaskedWriter struct {
+	target io.Writer
+}
+
+// NewMaskedWriter returns a MaskedWriter for target.
+func NewMaskedWriter(target io.Writer) *MaskedWriter {
+	return &MaskedWriter{target: target}
+}
+
+// Write masks b and writes the result to the target.
+func (w *MaskedWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(w.target, MaskSecrets(string(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SecretDefinition represents an entry of the top-level secrets-keyword.
+type SecretDefinition struct {
+	File        string `json:"file"`
+	Environment string `json:"environment"`
+	path        string
+}
+
+// SecretDefinitions stores secret definitions by name.
+type SecretDefinitions map[string]SecretDefinition
+
+// resolve reads the values of all secrets in d and registers them for
+// masking. Secrets from the environment or substitutions, including decrypted
+// ones, are written to temporary files of env to be mounted, these files are
+// kept in memory if possible and removed on clean up.
+func (d SecretDefinitions) resolve(env *PipelineEnvironment) error {
+	for name, secret := range d {
+		if (secret.File == "") == (secret.Environment == "") {
+			return fmt.Errorf("secret '%s' requires either 'file' or 'environment'", name)
+		}
+		if secret.File != "" {
+			path, err := filepath.Abs(secret.File)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("could not read secret '%s': %s", name, err)
+			}
+			RegisterSecret(string(data))
+			secret.path = path
+		} else {
+			value, found := env.GetSubstitution(secret.Environment)
+			if !found || value == nil {
+				v, ok := os.LookupEnv(secret.Environment)
+				if !ok {
+					return fmt.Errorf("environment variable '%s' of secret '%s' is not set", secret.Environment, name)
+				}
+				value = &v
+			}
+			RegisterSecret(*value)
+			dir, err := env.secretsTempDir()
+			if err != nil {
+				return err
+			}
+			secret.path = filepath.Join(dir, name)
+			// Files of previous runs are read-only if the temp dir is kept
+			if err := os.Remove(secret.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := ioutil.WriteFile(secret.path, []byte(*value), 0600); err != nil {
+				return err
+			}
+			if err := os.Chmod(secret.path, 0444); err != nil {
+				return err
+			}
+		}
+		d[name] = secret
+	}
+	return nil
+}
+
+// resolveSecretFiles resolves the relative files of all secrets and build
+// secrets of doc from dir, the directory of the definition file.
+func resolveSecretFiles(doc map[string]interface{}, dir string) {
+	resolve := func(raw interface{}) {
+		if secret, ok := raw.(map[string]interface{}); ok {
+			if file, ok := secret["file"].(string); ok && file != "" && !filepath.IsAbs(file) {
+				secret["file"] = filepath.Join(dir, file)
+			}
+		}
+	}
+	secrets, _ := doc["secrets"].(map[string]interface{})
+	for _, secret := range secrets {
+		resolve(secret)
+	}
+	for _, section := range definitionSections {
+		definitions, _ := doc[section].(map[string]interface{})
+		for _, raw := range definitions {
+			definition, _ := raw.(map[string]interface{})
+			build, _ := definition["build"].(map[string]interface{})
+			secrets, _ := build["secrets"].([]interface{})
+			for _, secret := range secrets {
+				resolve(secret)
+			}
+		}
+	}
+}
+
+// ServiceSecret represents an entry of the secrets-keyword of a service.
+type ServiceSecret struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	path   string
+}
+
+type serviceSecretJSON ServiceSecret
+
+// UnmarshalJSON loads a ServiceSecret from json, a single string is used as
+// source.
+func (s *ServiceSecret) UnmarshalJSON(data []byte) error {
+	var source string
+	if err := json.Unmarshal(data, &source); err == nil {
+		*s = ServiceSecret{Source: source}
+		return nil
+	}
+	parsedJSON := serviceSecretJSON{}
+	if err := json.Unmarshal(data, &parsedJSON); err != nil {
+		return err
+	}
+	*s = ServiceSecret(parsedJSON)
+	return nil
+}
+
+// MountPath returns the path s is mounted to inside the container.
+func (s ServiceSecret) MountPath() string {
+	target := s.Target
+	if target == "" {
+		target = s.Source
+	}
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(SecretsMountPath, target)
+}
+
+// VolumeFlag returns the value of the -v flag mounting s read-only.
+func (s ServiceSecret) VolumeFlag() string {
+	return fmt.Sprintf("%s:%s:ro", s.path, s.MountPath())
+}
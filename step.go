@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/ad-freiburg/gantry/types"
@@ -12,24 +14,43 @@ import (
 
 // Service provides a service definition from docker-compose.
 type Service struct {
-	BuildInfo   BuildInfo                 `json:"build"`
-	Command     types.StringOrStringSlice `json:"command"`
-	Entrypoint  types.StringOrStringSlice `json:"entrypoint"`
-	Image       string                    `json:"image"`
-	Ports       []string                  `json:"ports"`
-	Volumes     []string                  `json:"volumes"`
-	Environment types.StringMap           `json:"environment"`
-	DependsOn   types.StringSet           `json:"depends_on"`
-	Restart     string                    `json:"restart"`
-	Name        string
-	Meta        ServiceMeta
-	color       int
+	BuildInfo      BuildInfo                 `json:"build"`
+	Command        types.StringOrStringSlice `json:"command"`
+	Entrypoint     types.StringOrStringSlice `json:"entrypoint"`
+	Image          string                    `json:"image"`
+	Ports          []string                  `json:"ports"`
+	Volumes        []string                  `json:"volumes"`
+	Environment    types.StringMap           `json:"environment"`
+	DependsOn      types.StringSet           `json:"depends_on"`
+	Restart        string                    `json:"restart"`
+	Deploy         DeployInfo                `json:"deploy"`
+	MemLimit       types.StringOrNumber      `json:"mem_limit"`
+	MemReservation types.StringOrNumber      `json:"mem_reservation"`
+	CPUs           types.StringOrNumber      `json:"cpus"`
+	CPUSet         string                    `json:"cpuset"`
+	PidsLimit      int                       `json:"pids_limit"`
+	Profiles       types.StringSet           `json:"profiles"`
+	Secrets        []ServiceSecret           `json:"secrets"`
+	When           string                    `json:"when"`
+	GantryMeta     *ServiceMeta              `json:"x-gantry"`
+	Name           string
+	Meta           ServiceMeta
+	color          int
+	imageTemplate  string
+	// imageProject replaces PROJECT in imageTemplate if ProjectName is not
+	// set.
+	imageProject string
+	pinnedImage  string
+	// dir is the directory of the definition, relative paths in When are
+	// resolved from it.
+	dir string
 }
 
 // Step provides an extended service.
 type Step struct {
 	Service
-	After types.StringSet `json:"after"`
+	After   types.StringSet `json:"after"`
+	Outputs []string        `json:"outputs"`
 }
 
 // Dependencies returns all steps needed for running s.
@@ -52,9 +73,74 @@ func (s Step) Check() error {
 	if len(s.Restart) > 0 && s.Restart != "no" && s.Meta.Type == ServiceTypeStep {
 		return fmt.Errorf("invalid restart value '%s' for step '%s'", s.Restart, s.ColoredName())
 	}
+	if err := s.ResourceLimits().Check(); err != nil {
+		return fmt.Errorf("%s in limits of '%s'", err, s.ColoredName())
+	}
+	if err := s.ResourceReservations().Check(); err != nil {
+		return fmt.Errorf("%s in reservations of '%s'", err, s.ColoredName())
+	}
+	if s.When != "" {
+		if _, err := ParseCondition(s.When); err != nil {
+			return fmt.Errorf("%s for '%s'", err, s.ColoredName())
+		}
+	}
+	for _, output := range s.Outputs {
+		if strings.TrimSpace(output) == "" {
+			return fmt.Errorf("empty output for '%s'", s.ColoredName())
+		}
+	}
+	dependencies := s.Dependencies()
+	for name := range s.OutputReferences() {
+		if !dependencies[name] {
+			return fmt.Errorf("outputs of '%s' are used by '%s' which does not depend on it", name, s.ColoredName())
+		}
+	}
 	return nil
 }
 
+// ResourceLimits returns the hard resource limits of s. The compose v2 keys
+// take precedence over the values of deploy.resources.limits.
+func (s Service) ResourceLimits() ResourceInfo {
+	r := s.Deploy.Resources.Limits
+	if s.MemLimit != "" {
+		r.Memory = s.MemLimit
+	}
+	if s.CPUs != "" {
+		r.CPUs = s.CPUs
+	}
+	if s.CPUSet != "" {
+		r.CPUSet = s.CPUSet
+	}
+	if s.PidsLimit != 0 {
+		r.Pids = s.PidsLimit
+	}
+	return r
+}
+
+// ResourceReservations returns the resources reserved for s. The compose v2
+// keys take precedence over the values of deploy.resources.reservations.
+func (s Service) ResourceReservations() ResourceInfo {
+	r := s.Deploy.Resources.Reservations
+	if s.MemReservation != "" {
+		r.Memory = s.MemReservation
+	}
+	return r
+}
+
+// IsInActiveProfile returns whether s is in no profile or in at least one of
+// the active profiles.
+func (s Service) IsInActiveProfile(active types.StringSet) bool {
+	if len(s.Profiles) == 0 {
+		return true
+	}
+	for profile := range s.Profiles {
+		if active[profile] {
+			return true
+		}
+	}
+	return false
+}
+
 // InitColor initializes the color of s.
 func (s *Service) InitColor() {
 	s.color = GetNextFriendlyColor()
@@ -71,14 +157,27 @@ func (s Service) ColoredContainerName() string {
 }
 
 // ImageName returns the name of the image of s.
-// The name of the step is used if non is specified.
+// If non is specified the image tag template of the environment is used,
+// without template the name of the step.
 func (s Service) ImageName() string {
 	if s.Image != "" {
 		return s.Image
 	}
+	if s.imageTemplate != "" {
+		return expandImageTag(s.imageTemplate, s)
+	}
 	return strings.ReplaceAll(strings.ToLower(s.Name), " ", "_")
 }
 
+// ImageReference returns the reference used to pull and run the image of s,
+// the pinned digest if the image is locked, otherwise the name of the image.
+func (s Service) ImageReference() string {
+	if s.pinnedImage != "" {
+		return s.pinnedImage
+	}
+	return s.ImageName()
+}
+
 // RawContainerName returns the name for a container of s.
 func (s Service) RawContainerName() string {
 	return strings.ReplaceAll(strings.ToLower(s.Name), " ", "_")
@@ -95,7 +194,17 @@ func (s Step) IsBuildable() bool {
 	return s.BuildInfo.Dockerfile != "" || s.BuildInfo.Context != ""
 }
 
-// BuildCommand returns the command to build a new image for s.
+// BuildEnvironment returns the environment variables needed to run the
+// BuildCommand of s, BuildKit is enabled if its features are requested.
+func (s Step) BuildEnvironment() []string {
+	if s.BuildInfo.NeedsBuildKit() {
+		return []string{"DOCKER_BUILDKIT=1"}
+	}
+	return nil
+}
+
+// BuildCommand returns the command to build a new image for s. It has to be
+// run with the BuildEnvironment of s.
 func (s Step) BuildCommand(pull bool) []string {
 	args := []string{"build", "--tag", s.ImageName()}
 	if s.BuildInfo.Dockerfile != "" {
@@ -107,6 +216,39 @@ func (s Step) BuildCommand(pull bool) []string {
 	if pull {
 		args = append(args, "--pull")
 	}
+	if s.BuildInfo.Target != "" {
+		args = append(args, "--target", s.BuildInfo.Target)
+	}
+	for _, image := range s.BuildInfo.CacheFrom {
+		args = append(args, "--cache-from", image)
+	}
+	if s.BuildInfo.Network != "" {
+		args = append(args, "--network", s.BuildInfo.Network)
+	}
+	if s.BuildInfo.ShmSize != "" {
+		args = append(args, "--shm-size", string(s.BuildInfo.ShmSize))
+	}
+	for _, host := range s.BuildInfo.ExtraHosts {
+		args = append(args, "--add-host", strings.Replace(host, "=", ":", 1))
+	}
+	labels := make([]string, 0, len(s.BuildInfo.Labels))
+	for k := range s.BuildInfo.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	for _, k := range labels {
+		if v := s.BuildInfo.Labels[k]; v != nil {
+			args = append(args, "--label", fmt.Sprintf("%s=%s", k, *v))
+		} else {
+			args = append(args, "--label", k)
+		}
+	}
+	for _, secret := range s.BuildInfo.Secrets {
+		args = append(args, "--secret", secret.Flag())
+	}
+	for _, ssh := range s.BuildInfo.SSH {
+		args = append(args, "--ssh", ssh)
+	}
 	for k, v := range s.BuildInfo.Args {
 		if v == nil {
 			t := os.Getenv(k)
@@ -136,6 +278,22 @@ func (s Step) RunCommand(network Network) []string {
 		args = append(args, "--restart")
 		args = append(args, s.Restart)
 	}
+	limits := s.ResourceLimits()
+	if limits.Memory != "" {
+		args = append(args, "--memory", string(limits.Memory))
+	}
+	if limits.CPUs != "" {
+		args = append(args, "--cpus", string(limits.CPUs))
+	}
+	if limits.CPUSet != "" {
+		args = append(args, "--cpuset-cpus", limits.CPUSet)
+	}
+	if limits.Pids != 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(limits.Pids))
+	}
+	if reservations := s.ResourceReservations(); reservations.Memory != "" {
+		args = append(args, "--memory-reservation", string(reservations.Memory))
+	}
 	for _, port := range s.Ports {
 		args = append(args, "-p", port)
 	}
@@ -145,6 +303,9 @@ func (s Step) RunCommand(network Network) []string {
 		parts[0], _ = filepath.Abs(parts[0])
 		args = append(args, "-v", strings.Join(parts, ":"))
 	}
+	for _, secret := range s.Secrets {
+		args = append(args, "-v", secret.VolumeFlag())
+	}
 	for k, v := range s.Environment {
 		if v == nil {
 			t := os.Getenv(k)
@@ -173,13 +334,31 @@ func (s Step) RunCommand(network Network) []string {
 			callerArgs = append(callerArgs, tokens...)
 		}
 	}
-	args = append(args, s.ImageName())
+	args = append(args, s.ImageReference())
 	if len(callerArgs) > 0 {
 		args = append(args, callerArgs...)
 	}
 	return args
 }
 
+// WritableHostPaths returns the absolute host paths of all volumes of s not
+// mounted read-only.
+func (s Step) WritableHostPaths() []string {
+	paths := []string{}
+	for _, volume := range s.Volumes {
+		parts := strings.SplitN(volume, ":", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		if len(parts) == 3 && containsString(strings.Split(parts[2], ","), "ro") {
+			continue
+		}
+		path, _ := filepath.Abs(parts[0])
+		paths = append(paths, path)
+	}
+	return paths
+}
+
 // IsPullable returns whether or not a image is pulled for this step.
 func (s Step) IsPullable() bool {
 	return !s.IsBuildable()
@@ -187,5 +366,15 @@ func (s Step) IsPullable() bool {
 
 // PullCommand returns the command to pull the image for step s.
 func (s Step) PullCommand() []string {
-	return []string{"pull", s.ImageName()}
+	return []string{"pull", s.ImageReference()}
+}
+
+// IsPushable returns whether or not the image of s is pushed.
+func (s Step) IsPushable() bool {
+	return s.IsBuildable()
+}
+
+// PushCommand returns the command to push the image of step s.
+func (s Step) PushCommand() []string {
+	return []string{"push", s.ImageName()}
 }
@@ -20,6 +20,9 @@ func TestStepCheck(t *testing.T) {
 		{gantry.Step{Service: gantry.Service{Name: "a", Image: "alpine", Meta: gantry.ServiceMeta{Type: gantry.ServiceTypeStep}}}, false},
 		{gantry.Step{Service: gantry.Service{Name: "a", Image: "alpine", Restart: "always", Meta: gantry.ServiceMeta{Type: gantry.ServiceTypeStep}}}, true},
 		{gantry.Step{Service: gantry.Service{Name: "a", Image: "alpine", Restart: "always", Meta: gantry.ServiceMeta{Type: gantry.ServiceTypeService}}}, false},
+		{gantry.Step{Service: gantry.Service{Name: "a", Image: "alpine", MemLimit: "1g", CPUs: "0.5"}}, false},
+		{gantry.Step{Service: gantry.Service{Name: "a", Image: "alpine", MemLimit: "lots"}}, true},
+		{gantry.Step{Service: gantry.Service{Name: "a", Image: "alpine", Deploy: gantry.DeployInfo{Resources: gantry.DeployResources{Reservations: gantry.ResourceInfo{CPUs: "many"}}}}}, true},
 	}
 
 	for i, c := range cases {
@@ -184,6 +187,21 @@ func TestStepBuildCommand(t *testing.T) {
 			false,
 			[]string{"build", "--tag", "img", "--build-arg", fmt.Sprintf("USER=%s", os.Getenv("USER")), "."},
 		},
+		{
+			gantry.Step{Service: gantry.Service{Image: "img", BuildInfo: gantry.BuildInfo{Target: "prod", CacheFrom: types.StringOrStringSlice{"img:latest", "img:cache"}, Network: "host", ShmSize: "2g", ExtraHosts: types.StringOrStringSlice{"somehost:162.242.195.82", "otherhost=50.31.209.229"}, Labels: map[string]*string{"b": &bar, "a": nil}}}},
+			false,
+			[]string{"build", "--tag", "img", "--target", "prod", "--cache-from", "img:latest", "--cache-from", "img:cache", "--network", "host", "--shm-size", "2g", "--add-host", "somehost:162.242.195.82", "--add-host", "otherhost:50.31.209.229", "--label", "a", "--label", "b=Bar", "."},
+		},
+		{
+			gantry.Step{Service: gantry.Service{Image: "img", BuildInfo: gantry.BuildInfo{Secrets: []gantry.BuildSecret{{Source: "token"}, {Source: "cert", File: "./cert.pem"}, {Source: "key", Environment: "KEY"}}}}},
+			true,
+			[]string{"build", "--tag", "img", "--pull", "--secret", "id=token", "--secret", "id=cert,src=./cert.pem", "--secret", "id=key,env=KEY", "."},
+		},
+		{
+			gantry.Step{Service: gantry.Service{Image: "img", BuildInfo: gantry.BuildInfo{SSH: types.StringOrStringSlice{"default"}}}},
+			false,
+			[]string{"build", "--tag", "img", "--ssh", "default", "."},
+		},
 	}
 
 	for _, c := range cases {
@@ -194,6 +212,24 @@ func TestStepBuildCommand(t *testing.T) {
 	}
 }
 
+func TestStepBuildEnvironment(t *testing.T) {
+	cases := []struct {
+		step   gantry.Step
+		result []string
+	}{
+		{gantry.Step{Service: gantry.Service{Image: "img", BuildInfo: gantry.BuildInfo{Context: "."}}}, nil},
+		{gantry.Step{Service: gantry.Service{Image: "img", BuildInfo: gantry.BuildInfo{Secrets: []gantry.BuildSecret{{Source: "token"}}}}}, []string{"DOCKER_BUILDKIT=1"}},
+		{gantry.Step{Service: gantry.Service{Image: "img", BuildInfo: gantry.BuildInfo{SSH: types.StringOrStringSlice{"default"}}}}, []string{"DOCKER_BUILDKIT=1"}},
+	}
+
+	for _, c := range cases {
+		r := c.step.BuildEnvironment()
+		if !reflect.DeepEqual(r, c.result) {
+			t.Errorf("Incorrect result for '%v', got: '%v', wanted '%v'", c.step, r, c.result)
+		}
+	}
+}
+
 func TestStepRunCommand(t *testing.T) {
 	bar := "Bar"
 	cases := []struct {
@@ -261,6 +297,16 @@ func TestStepRunCommand(t *testing.T) {
 			gantry.Network("dummy"),
 			[]string{"run", "--name", "T_name", "--network", "dummy", "--network-alias", "name", "--network-alias", "T_name", "-d", "--restart", "unless-stopped", "img"},
 		},
+		{
+			gantry.Step{Service: gantry.Service{Image: "img", Name: "name", MemLimit: "1g", CPUs: "1.5", CPUSet: "0-1", PidsLimit: 64, MemReservation: "512m", Meta: gantry.ServiceMeta{Type: gantry.ServiceTypeStep}}},
+			gantry.Network("dummy"),
+			[]string{"run", "--name", "T_name", "--network", "dummy", "--network-alias", "name", "--network-alias", "T_name", "--rm", "--memory", "1g", "--cpus", "1.5", "--cpuset-cpus", "0-1", "--pids-limit", "64", "--memory-reservation", "512m", "img"},
+		},
+		{
+			gantry.Step{Service: gantry.Service{Image: "img", Name: "name", Deploy: gantry.DeployInfo{Resources: gantry.DeployResources{Limits: gantry.ResourceInfo{Memory: "2g"}, Reservations: gantry.ResourceInfo{Memory: "1g"}}}, Meta: gantry.ServiceMeta{Type: gantry.ServiceTypeStep}}},
+			gantry.Network("dummy"),
+			[]string{"run", "--name", "T_name", "--network", "dummy", "--network-alias", "name", "--network-alias", "T_name", "--rm", "--memory", "2g", "--memory-reservation", "1g", "img"},
+		},
 	}
 
 	gantry.ProjectName = "T"
@@ -287,3 +333,38 @@ func TestStepPullCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestStepPushCommand(t *testing.T) {
+	cases := []struct {
+		step   gantry.Step
+		result []string
+	}{
+		{gantry.Step{Service: gantry.Service{Name: "a"}}, []string{"push", "a"}},
+		{gantry.Step{Service: gantry.Service{Image: "localhost:5000/img:1.0"}}, []string{"push", "localhost:5000/img:1.0"}},
+	}
+
+	for _, c := range cases {
+		r := c.step.PushCommand()
+		if !reflect.DeepEqual(r, c.result) {
+			t.Errorf("Incorrect result for '%v', got: '%v', wanted '%v'", c.step, r, c.result)
+		}
+	}
+}
+
+func TestStepWritableHostPaths(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := gantry.Step{Service: gantry.Service{Volumes: []string{
+		"/data:/data",
+		"./index:/index:rw",
+		"/config:/config:ro",
+		"/cache:/cache:z,ro",
+		"anonymous",
+	}}}
+	wanted := []string{"/data", cwd + "/index"}
+	if r := step.WritableHostPaths(); !reflect.DeepEqual(r, wanted) {
+		t.Errorf("Incorrect paths, got: '%v', wanted: '%v'", r, wanted)
+	}
+}
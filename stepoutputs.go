@@ -0,0 +1,172 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+// StepOutputsFile is the file in the container of a step in which key=value
+// lines are written to pass values to later steps.
+const StepOutputsFile string = "/gantry/outputs"
+
+// stepOutputReference matches references to values written by other steps.
+var stepOutputReference = regexp.MustCompile(`\$\{steps\.([^}]+?)\.outputs\.([^}]+)\}`)
+
+// OutputReferences returns the names of all steps whose values are referenced
+// by s.
+func (s Step) OutputReferences() types.StringSet {
+	r := types.StringSet{}
+	for _, value := range s.outputReferenceFields() {
+		for _, match := range stepOutputReference.FindAllStringSubmatch(value, -1) {
+			r[match[1]] = true
+		}
+	}
+	return r
+}
+
+// outputReferenceFields returns all values of s which can reference values
+// of other steps.
+func (s Step) outputReferenceFields() []string {
+	values := append([]string{}, s.Command...)
+	values = append(values, s.Entrypoint...)
+	values = append(values, s.Volumes...)
+	for _, v := range s.Environment {
+		if v != nil {
+			values = append(values, *v)
+		}
+	}
+	return values
+}
+
+// ResolveOutputReferences returns a copy of s with all references to values
+// of other steps replaced. The values of a step are returned by lookup.
+func (s Step) ResolveOutputReferences(lookup func(step string) (map[string]string, error)) (Step, error) {
+	result, err := s.replaceReferences(stepOutputReference, func(match []string) (string, error) {
+		values, err := lookup(match[1])
+		if err != nil {
+			return "", err
+		}
+		value, found := values[match[2]]
+		if !found {
+			return "", fmt.Errorf("step '%s' did not write output '%s'", match[1], match[2])
+		}
+		return value, nil
+	})
+	if err != nil {
+		return s, fmt.Errorf("could not resolve outputs for '%s': %s", s.Name, err)
+	}
+	return result, nil
+}
+
+// replaceReferences returns a copy of s with all matches of reference in
+// the values returned by outputReferenceFields replaced by the result of
+// value, which is called with the submatches. The first error of value is
+// returned.
+func (s Step) replaceReferences(reference *regexp.Regexp, value func(match []string) (string, error)) (Step, error) {
+	var err error
+	replace := func(v string) string {
+		return reference.ReplaceAllStringFunc(v, func(match string) string {
+			replaced, verr := value(reference.FindStringSubmatch(match))
+			if verr != nil {
+				if err == nil {
+					err = verr
+				}
+				return match
+			}
+			return replaced
+		})
+	}
+	replaceAll := func(values []string) []string {
+		result := make([]string, len(values))
+		for i, v := range values {
+			result[i] = replace(v)
+		}
+		return result
+	}
+	s.Command = replaceAll(s.Command)
+	s.Entrypoint = replaceAll(s.Entrypoint)
+	s.Volumes = replaceAll(s.Volumes)
+	if s.Environment != nil {
+		environment := make(types.StringMap, len(s.Environment))
+		for k, v := range s.Environment {
+			if v != nil {
+				replaced := replace(*v)
+				v = &replaced
+			}
+			environment[k] = v
+		}
+		s.Environment = environment
+	}
+	return s, err
+}
+
+// stepOutputs manages the files storing the values written by steps.
+type stepOutputs struct {
+	dir string
+}
+
+// path returns the host path of the outputs file of step.
+func (o stepOutputs) path(step string) string {
+	return filepath.Join(o.dir, strings.ReplaceAll(step, string(filepath.Separator), "_"))
+}
+
+// clear removes the outputs files of steps, values of earlier runs are not
+// read.
+func (o stepOutputs) clear(steps types.StringSet) error {
+	for step := range steps {
+		if err := os.Remove(o.path(step)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare creates an empty outputs file for step and returns the volume
+// mounting it at StepOutputsFile.
+func (o stepOutputs) prepare(step string) (string, error) {
+	path := o.path(step)
+	if err := ioutil.WriteFile(path, []byte{}, 0666); err != nil {
+		return "", err
+	}
+	// Allow writes by any user inside of the container
+	if err := os.Chmod(path, 0666); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", path, StepOutputsFile), nil
+}
+
+// read returns the values written by step.
+func (o stepOutputs) read(step string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(o.path(step))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("step '%s' did not run", step)
+		}
+		return nil, err
+	}
+	return parseStepOutputs(string(data)), nil
+}
+
+// parseStepOutputs parses key=value lines, empty lines and lines starting
+// with # are ignored.
+func parseStepOutputs(data string) map[string]string {
+	result := map[string]string{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		result[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return result
+}
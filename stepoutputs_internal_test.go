@@ -0,0 +1,198 @@
+package gantry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+// outputsRunner writes outputs of steps into their outputs files and records
+// the commands steps are run with.
+type outputsRunner struct {
+	*NoopRunner
+	outputs  map[string]string
+	commands sync.Map
+}
+
+func (r *outputsRunner) Copy() Runner {
+	return r
+}
+
+func (r *outputsRunner) ContainerRunner(step Step, network Network) func() error {
+	run := r.NoopRunner.ContainerRunner(step, network)
+	return func() error {
+		r.commands.Store(step.Name, strings.Join(step.RunCommand(network), " "))
+		for _, volume := range step.Volumes {
+			if strings.HasSuffix(volume, ":"+StepOutputsFile) {
+				path := strings.TrimSuffix(volume, ":"+StepOutputsFile)
+				if err := ioutil.WriteFile(path, []byte(r.outputs[step.Name]), 0644); err != nil {
+					return err
+				}
+			}
+		}
+		return run()
+	}
+}
+
+func TestParseStepOutputs(t *testing.T) {
+	r := parseStepOutputs("index=wikidata\n# comment\n\nport = 7001\nurl=http://a?b=c\r\ninvalid\n")
+	wanted := map[string]string{"index": "wikidata", "port": " 7001", "url": "http://a?b=c"}
+	if len(r) != len(wanted) {
+		t.Errorf("Incorrect outputs, got: '%v', wanted: '%v'", r, wanted)
+	}
+	for k, v := range wanted {
+		if r[k] != v {
+			t.Errorf("Incorrect value for '%s', got: '%s', wanted: '%s'", k, r[k], v)
+		}
+	}
+}
+
+func TestStepCheckOutputReferences(t *testing.T) {
+	s := Step{Service: Service{Name: "b", Image: "alpine", Command: []string{"${steps.a.outputs.x}"}}}
+	if err := s.Check(); err == nil {
+		t.Errorf("Got no error for reference to outputs of a step which is not a dependency")
+	}
+	s.After = types.StringSet{"a": true}
+	if err := s.Check(); err != nil {
+		t.Errorf("unexpected error: '%s'", err)
+	}
+}
+
+func TestPipelineExecuteStepsOutputReferences(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  prepare:
+    image: alpine
+  query:
+    image: alpine
+    command: ["query", "--index", "${steps.prepare.outputs.index}"]
+    environment:
+      PORT: ${steps.prepare.outputs.port}
+    after:
+      - prepare
+  missing:
+    image: alpine
+    command: ["${steps.prepare.outputs.unknown}"]
+    after:
+      - prepare
+      - query
+`, "")
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	defer p.Environment.CleanUp(nil)
+	if err := p.Check(); err != nil {
+		t.Fatalf("unexpected error checking pipeline: '%#v'", err)
+	}
+	runner := &outputsRunner{
+		NoopRunner: NewNoopRunner(false),
+		outputs:    map[string]string{"prepare": "index=wikidata\nport=7001\n"},
+	}
+	p.localRunner = runner
+	p.Network = Network("test")
+
+	err = p.ExecuteSteps()
+	if err == nil || !strings.Contains(err.Error(), "did not write output 'unknown'") {
+		t.Errorf("Incorrect error, got: '%v', wanted error about missing output", err)
+	}
+	checkCallsAndCalled(t, runner.NoopRunner, "ContainerRunner(missing,test)", 0, 0)
+	command, _ := runner.commands.Load("query")
+	if r, _ := command.(string); !strings.HasSuffix(r, "alpine query --index wikidata") || !strings.Contains(r, "-e PORT=7001") {
+		t.Errorf("Incorrect command for 'query', got: '%s'", r)
+	}
+	command, _ = runner.commands.Load("prepare")
+	if r, _ := command.(string); !strings.Contains(r, ":"+StepOutputsFile) {
+		t.Errorf("outputs file not mounted for 'prepare', got: '%s'", r)
+	}
+}
+
+func TestPipelineExecuteStepsOutputReferencesStale(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  prepare:
+    image: alpine
+  query:
+    image: alpine
+    command: ["query", "${steps.prepare.outputs.index}"]
+    after:
+      - prepare
+`, "")
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{"prepare": true}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+	}
+	defer p.Environment.CleanUp(nil)
+	// Outputs written by an earlier run are not used
+	dir, err := p.Environment.GetOrCreateTempDir("gantry_outputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "prepare"), []byte("index=stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runner := &outputsRunner{NoopRunner: NewNoopRunner(false)}
+	p.localRunner = runner
+	p.Network = Network("test")
+
+	err = p.ExecuteSteps()
+	if err == nil || !strings.Contains(err.Error(), "step 'prepare' did not run") {
+		t.Errorf("Incorrect error, got: '%v', wanted error about ignored step", err)
+	}
+	checkCallsAndCalled(t, runner.NoopRunner, "ContainerRunner(query,test)", 0, 0)
+}
+
+func TestNewPipelineIncludeOutputReferences(t *testing.T) {
+	dir := setupIncludeDir(t, map[string]string{
+		"gantry.yml": `version: "2.0"
+include:
+  prep: prep.yml
+steps:
+  query:
+    image: alpine
+    command: ["query", "${steps.prep.index.outputs.path}"]
+    after:
+      - prep.index
+`,
+		"prep.yml": `version: "2.0"
+steps:
+  index:
+    image: alpine
+  check:
+    image: alpine
+    command: ["check", "${steps.index.outputs.path}", "${steps.other.outputs.path}"]
+    environment:
+      - INDEX=${steps.index.outputs.path}
+    after:
+      - index
+`,
+	})
+	defer os.RemoveAll(dir)
+
+	p, err := NewPipeline([]string{filepath.Join(dir, "gantry.yml")}, []string{}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	defer p.Environment.CleanUp(nil)
+	check := p.Definition.Steps["prep.check"]
+	if r := strings.Join(check.Command, " "); r != "check ${steps.prep.index.outputs.path} ${steps.other.outputs.path}" {
+		t.Errorf("Incorrect command, got: '%s'", r)
+	}
+	if r := check.Environment["INDEX"]; r == nil || *r != "${steps.prep.index.outputs.path}" {
+		t.Errorf("Incorrect environment, got: '%v'", r)
+	}
+	if r := p.Definition.Steps["query"].OutputReferences(); !r["prep.index"] {
+		t.Errorf("Incorrect references of 'query', got: '%v'", r)
+	}
+}
@@ -2,6 +2,7 @@ package gantry // import "github.com/ad-freiburg/gantry"
 // Adapted version of https://github.com/looplab/tarjan/blob/master/tarjan.go
 import (
 	"fmt"
+	"strings"
 )
 
 type tarjanData struct {
@@ -26,7 +27,7 @@ func (td *tarjanData) strongConnect(v string) (*tarjanNode, error) {
 
 	for w := range td.graph[v].Dependencies() {
 		if _, ok := td.graph[w]; !ok {
-			return nil, fmt.Errorf("unknown dependency '%s' for step '%s'", w, v)
+			return nil, td.unknownDependency(w, v)
 		}
 		i, seen := td.index[w]
 		if !seen {
@@ -63,6 +64,33 @@ func (td *tarjanData) strongConnect(v string) (*tarjanNode, error) {
 	return node, nil
 }
 
+// unknownDependency returns the error for the unknown dependency w of v.
+// Dependencies on included pipelines are checked for their namespace.
+func (td *tarjanData) unknownDependency(w string, v string) error {
+	i := strings.LastIndex(w, NamespaceSeparator)
+	if i < 0 {
+		return fmt.Errorf("unknown dependency '%s' for step '%s'", w, v)
+	}
+	namespace := w[:i]
+	candidates := []string{}
+	namespaces := []string{}
+	for name := range td.graph {
+		if strings.HasPrefix(name, namespace+NamespaceSeparator) {
+			candidates = append(candidates, name)
+		}
+		if j := strings.LastIndex(name, NamespaceSeparator); j >= 0 {
+			namespaces = append(namespaces, name[:j])
+		}
+	}
+	if len(namespaces) == 0 {
+		return fmt.Errorf("unknown dependency '%s' for step '%s'", w, v)
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("unknown dependency '%s' for step '%s': no included pipeline '%s'%s", w, v, namespace, suggestion(namespace, namespaces))
+	}
+	return fmt.Errorf("unknown dependency '%s' for step '%s' in included pipeline '%s'%s", w, v, namespace, suggestion(w, candidates))
+}
+
 // NewTarjan performs tarjans algorithm to convert steps to pipelines.
 func NewTarjan(steps map[string]Step) (*Pipelines, error) {
 	// Determine components and topological order
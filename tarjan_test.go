@@ -211,3 +211,22 @@ func TestNewTarjanMissingDependency(t *testing.T) {
 		t.Errorf("Got no error for: '%#v'", input)
 	}
 }
+
+func TestNewTarjanMissingNamespacedDependency(t *testing.T) {
+	stepBuild := gantry.Step{Service: gantry.Service{Name: "prep.build"}}
+	cases := []struct {
+		dependency string
+		err        string
+	}{
+		{"prep.buld", "unknown dependency 'prep.buld' for step 'b' in included pipeline 'prep', did you mean 'prep.build'?"},
+		{"prp.build", "unknown dependency 'prp.build' for step 'b': no included pipeline 'prp', did you mean 'prep'?"},
+	}
+	for _, c := range cases {
+		stepB := gantry.Step{Service: gantry.Service{Name: "b"}, After: map[string]bool{c.dependency: true}}
+		input := map[string]gantry.Step{"b": stepB, "prep.build": stepBuild}
+		_, err := gantry.NewTarjan(input)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("Incorrect error, got: '%v', wanted: '%s'", err, c.err)
+		}
+	}
+}
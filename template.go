@@ -0,0 +1,199 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+)
+
+// templatesKey is the top-level key storing step templates.
+const templatesKey string = "templates"
+
+// templateParamsKey stores the parameters of a template.
+const templateParamsKey string = "params"
+
+// templateUsesKey selects the template of a step.
+const templateUsesKey string = "uses"
+
+// templateWithKey stores the arguments of a step using a template.
+const templateWithKey string = "with"
+
+// paramReference matches references to template parameters.
+var paramReference = regexp.MustCompile(`\$\{params\.([^}]*)\}`)
+
+// templateError is returned if a template can not be instantiated.
+type templateError struct {
+	template     string
+	templateFile string
+	step         string
+	stepFile     string
+	err          error
+}
+
+// Error returns the string representation of the error.
+func (e *templateError) Error() string {
+	template := fmt.Sprintf("'%s'", e.template)
+	if e.templateFile != "" {
+		template = fmt.Sprintf("'%s' (defined in '%s')", e.template, e.templateFile)
+	}
+	return fmt.Sprintf("could not instantiate template %s for step '%s' (in '%s'): %s", template, e.step, e.stepFile, e.err)
+}
+
+// expandTemplates replaces all steps of doc using a template by the
+// instantiated template merged with the definition of the step. The files
+// stored in origins are used to report errors. The templates are removed
+// from doc.
+func expandTemplates(doc map[string]interface{}, origins map[string]string) error {
+	rawTemplates, found := doc[templatesKey]
+	if !found {
+		rawTemplates = map[string]interface{}{}
+	}
+	templates, ok := rawTemplates.(map[string]interface{})
+	if !ok && rawTemplates != nil {
+		return fmt.Errorf("'%s' must be a mapping in '%s'", templatesKey, origins[templatesKey])
+	}
+	delete(doc, templatesKey)
+	steps, ok := doc["steps"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	expanded := make(map[string]interface{}, len(steps))
+	for _, name := range sortedKeys(steps) {
+		raw := steps[name]
+		definition, ok := raw.(map[string]interface{})
+		if !ok || definition[templateUsesKey] == nil {
+			expanded[name] = raw
+			continue
+		}
+		templateName, ok := definition[templateUsesKey].(string)
+		if !ok {
+			return fmt.Errorf("'%s' of step '%s' in '%s' must be the name of a template", templateUsesKey, name, origins["steps."+name])
+		}
+		step, err := instantiateTemplate(templates[templateName], definition)
+		if err != nil {
+			return &templateError{
+				template:     templateName,
+				templateFile: origins[templatesKey+"."+templateName],
+				step:         name,
+				stepFile:     origins["steps."+name+"."+templateUsesKey],
+				err:          err,
+			}
+		}
+		expanded[name] = step
+	}
+	doc["steps"] = expanded
+	return nil
+}
+
+// instantiateTemplate merges definition into template and replaces all
+// parameters with the arguments given in definition.
+func instantiateTemplate(template interface{}, definition map[string]interface{}) (map[string]interface{}, error) {
+	if template == nil {
+		return nil, fmt.Errorf("no such template")
+	}
+	body, ok := template.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("template must be a mapping")
+	}
+	if _, found := body[templateUsesKey]; found {
+		return nil, fmt.Errorf("templates can not use other templates")
+	}
+	params, err := templateParams(body[templateParamsKey])
+	if err != nil {
+		return nil, err
+	}
+	args, ok := definition[templateWithKey].(map[string]interface{})
+	if !ok && definition[templateWithKey] != nil {
+		return nil, fmt.Errorf("'%s' must be a mapping of parameters to values", templateWithKey)
+	}
+	values := map[string]string{}
+	for _, param := range sortedKeys(args) {
+		value := args[param]
+		if _, found := params[param]; !found {
+			return nil, fmt.Errorf("unknown parameter '%s'", param)
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("argument for parameter '%s' must be a scalar value", param)
+		case nil:
+			values[param] = ""
+		default:
+			values[param] = scalarString(value)
+		}
+	}
+	for _, param := range sortedKeys(params) {
+		value := params[param]
+		if _, found := values[param]; found {
+			continue
+		}
+		if value == nil {
+			return nil, fmt.Errorf("missing argument for parameter '%s'", param)
+		}
+		values[param] = *value
+	}
+	base := map[string]interface{}{}
+	for k, v := range body {
+		if k != templateParamsKey {
+			base[k] = v
+		}
+	}
+	override := map[string]interface{}{}
+	for k, v := range definition {
+		if k != templateUsesKey && k != templateWithKey {
+			override[k] = v
+		}
+	}
+	merged, err := mergeDefinitionValues(nil, base, override)
+	if err != nil {
+		return nil, err
+	}
+	result, err := substituteReferences(merged, paramReference, values, "parameter", "")
+	if err != nil {
+		return nil, err
+	}
+	return result.(map[string]interface{}), nil
+}
+
+// templateParams returns the parameters of a template given as list of names
+// or as mapping of names to default values. Parameters without default are
+// nil.
+func templateParams(raw interface{}) (map[string]*string, error) {
+	result := map[string]*string{}
+	switch v := raw.(type) {
+	case nil:
+	case []interface{}:
+		for _, param := range v {
+			name, ok := param.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid parameter '%v'", param)
+			}
+			result[name] = nil
+		}
+	case map[string]interface{}:
+		for name, value := range v {
+			switch value.(type) {
+			case nil:
+				result[name] = nil
+			case map[string]interface{}, []interface{}:
+				return nil, fmt.Errorf("default of parameter '%s' must be a scalar value", name)
+			default:
+				s := scalarString(value)
+				result[name] = &s
+			}
+		}
+	default:
+		return nil, fmt.Errorf("'%s' must be a list of names or a mapping of names to defaults", templateParamsKey)
+	}
+	return result, nil
+}
+
+// sortedKeys returns the sorted keys of the map m.
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,132 @@
+package gantry
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+const templateDef = `version: "2.0"
+templates:
+  qlever_query:
+    image: qlever/query
+    entrypoint: ["query", "${params.endpoint}"]
+    command: ["${params.file}"]
+    environment:
+      TIMEOUT: ${params.timeout}
+    params:
+      endpoint:
+      file:
+      timeout: 60
+`
+
+func TestNewPipelineTemplates(t *testing.T) {
+	tmpDef, tmpEnv := setupDefAndEnv(templateDef+`steps:
+  q1:
+    uses: qlever_query
+    with:
+      endpoint: http://a
+      file: q1.sparql
+  q2:
+    uses: qlever_query
+    with:
+      endpoint: http://b
+      file: q2.sparql
+      timeout: 5
+    environment:
+      EXTRA: "1"
+    after:
+      - q1
+  q3:
+    uses: qlever_query
+    with:
+      endpoint: http://c
+      file: q3.sparql
+      timeout: 1000000
+`, "")
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	cases := []struct {
+		name        string
+		entrypoint  string
+		command     string
+		environment string
+	}{
+		{"q1", "query http://a", "q1.sparql", "TIMEOUT=60"},
+		{"q2", "query http://b", "q2.sparql", "EXTRA=1 TIMEOUT=5"},
+		{"q3", "query http://c", "q3.sparql", "TIMEOUT=1000000"},
+	}
+	for _, c := range cases {
+		step, found := p.Definition.Steps[c.name]
+		if !found {
+			t.Fatalf("missing step '%s'", c.name)
+		}
+		if step.Image != "qlever/query" {
+			t.Errorf("Incorrect image for '%s', got: '%s'", c.name, step.Image)
+		}
+		if r := strings.Join(step.Entrypoint, " "); r != c.entrypoint {
+			t.Errorf("Incorrect entrypoint for '%s', got: '%s', wanted: '%s'", c.name, r, c.entrypoint)
+		}
+		if r := strings.Join(step.Command, " "); r != c.command {
+			t.Errorf("Incorrect command for '%s', got: '%s', wanted: '%s'", c.name, r, c.command)
+		}
+		environment := []string{}
+		for _, k := range []string{"EXTRA", "TIMEOUT"} {
+			if v, found := step.Environment[k]; found {
+				environment = append(environment, fmt.Sprintf("%s=%s", k, *v))
+			}
+		}
+		if r := strings.Join(environment, " "); r != c.environment {
+			t.Errorf("Incorrect environment for '%s', got: '%s', wanted: '%s'", c.name, r, c.environment)
+		}
+	}
+	if !p.Definition.Steps["q2"].Dependencies()["q1"] {
+		t.Errorf("Incorrect dependencies of 'q2', got: '%#v'", p.Definition.Steps["q2"].Dependencies())
+	}
+}
+
+func TestNewPipelineTemplatesErrors(t *testing.T) {
+	cases := []struct {
+		use string
+		err string
+	}{
+		{`uses: qlever_query
+    with:
+      endpoint: a`, "missing argument for parameter 'file'"},
+		{`uses: qlever_query
+    with:
+      endpoint: a
+      file: b
+      fiel: c`, "unknown parameter 'fiel'"},
+		{`uses: missing`, "no such template"},
+	}
+	for _, c := range cases {
+		tmpTemplates, tmpEnv := setupDefAndEnv(templateDef, "")
+		tmpDef, tmpDefEnv := setupDefAndEnv(`version: "2.0"
+steps:
+  q:
+    `+c.use+`
+`, "")
+		_, err := NewPipeline([]string{tmpTemplates, tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		template := fmt.Sprintf("'qlever_query' (defined in '%s')", tmpTemplates)
+		if strings.Contains(c.use, "missing") {
+			template = "'missing'"
+		}
+		expected := fmt.Sprintf("could not instantiate template %s for step 'q' (in '%s'): %s", template, tmpDef, c.err)
+		if err == nil || err.Error() != expected {
+			t.Errorf("Incorrect error, got: '%v', wanted: '%s'", err, expected)
+		}
+		os.Remove(tmpTemplates)
+		os.Remove(tmpDef)
+		os.Remove(tmpEnv)
+		os.Remove(tmpDefEnv)
+	}
+}
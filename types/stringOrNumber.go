@@ -0,0 +1,23 @@
+package types // import "github.com/ad-freiburg/gantry/types"
+
+import "encoding/json"
+
+// StringOrNumber stores a single string or the textual representation of a
+// number as string.
+type StringOrNumber string
+
+// UnmarshalJSON sets *r to a copy of data.
+func (r *StringOrNumber) UnmarshalJSON(data []byte) error {
+	var value string
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		var number json.Number
+		err := json.Unmarshal(data, &number)
+		if err != nil {
+			return err
+		}
+		value = number.String()
+	}
+	*r = StringOrNumber(value)
+	return nil
+}
@@ -0,0 +1,31 @@
+package types_test
+
+import (
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestStringOrNumberUnmarshalJSON(t *testing.T) {
+	var cases = []struct {
+		json   string
+		err    string
+		result types.StringOrNumber
+	}{
+		{"", "unexpected end of JSON input,", ""},
+		{"\"512m\"", "", "512m"},
+		{"0.5", "", "0.5"},
+		{"1073741824", "", "1073741824"},
+		{"[\"A\"]", "json: cannot unmarshal array into Go value of type json.Number", ""},
+	}
+	for _, c := range cases {
+		var s types.StringOrNumber
+		err := s.UnmarshalJSON([]byte(c.json))
+		if (err != nil && c.err == "") || (err == nil && c.err != "") {
+			t.Errorf("Incorrect error for '%s', got '%s', wanted '%s'", c.json, err, c.err)
+		}
+		if s != c.result {
+			t.Errorf("Incorrect result for '%s', got: '%s', wanted '%s'", c.json, s, c.result)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ValidationError describes a value of a file which does not match the
+// schema of the file.
+type ValidationError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+// Error returns the position and description of e.
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// ValidateDefinition validates the definition at path, preprocessed using
+// env, against DefinitionSchema.
+func ValidateDefinition(path string, env *PipelineEnvironment) ([]ValidationError, error) {
+	loader, err := newDefinitionLoader(env)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := loader.read(path); err != nil {
+		return nil, err
+	}
+	return loader.problems, nil
+}
+
+// reportProblems logs problems. They are fatal unless IgnoreSchemaProblems is
+// set.
+func reportProblems(problems []ValidationError) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	if IgnoreSchemaProblems {
+		for _, problem := range problems {
+			log.Printf("Warning: %s", problem)
+		}
+		return nil
+	}
+	for _, problem := range problems {
+		log.Printf("Error: %s", problem)
+	}
+	return fmt.Errorf("found %d schema problem(s)", len(problems))
+}
+
+// validateYAML validates the yaml document data of file against schema.
+// lines maps the lines of data to the lines of file, if data was
+// preprocessed.
+func validateYAML(data []byte, lines []int, file string, schema Schema) ([]ValidationError, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	v := &validator{file: file, lines: lines, problems: []ValidationError{}}
+	if doc.Kind == yamlv3.DocumentNode && len(doc.Content) > 0 {
+		v.validate(doc.Content[0], schema, []string{})
+	}
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		if v.problems[i].Line != v.problems[j].Line {
+			return v.problems[i].Line < v.problems[j].Line
+		}
+		return v.problems[i].Column < v.problems[j].Column
+	})
+	return v.problems, nil
+}
+
+type validator struct {
+	file     string
+	lines    []int
+	problems []ValidationError
+}
+
+// report stores a problem found at node.
+func (v *validator) report(node *yamlv3.Node, format string, a ...interface{}) {
+	line := node.Line
+	if line > 0 && line <= len(v.lines) {
+		line = v.lines[line-1]
+	}
+	v.problems = append(v.problems, ValidationError{
+		File:    v.file,
+		Line:    line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+// validate checks node located at path against schema.
+func (v *validator) validate(node *yamlv3.Node, schema Schema, path []string) {
+	if node.Kind == yamlv3.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	if allowed := schemaTypes(schema); len(allowed) > 0 {
+		matched := false
+		for _, t := range allowed {
+			matched = matched || nodeHasType(node, t)
+		}
+		if !matched {
+			v.report(node, "invalid type for '%s': expected %s, got %s", displayPath(path), strings.Join(allowed, " or "), nodeKind(node))
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok && node.Kind == yamlv3.ScalarNode {
+		values := make([]string, len(enum))
+		found := false
+		for i, e := range enum {
+			values[i] = fmt.Sprint(e)
+			found = found || strings.EqualFold(values[i], node.Value)
+		}
+		if !found {
+			v.report(node, "invalid value '%s' for '%s', expected one of: %s%s", node.Value, displayPath(path), strings.Join(values, ", "), suggestion(node.Value, values))
+		}
+	}
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		v.validateMapping(node, schema, path)
+	case yamlv3.SequenceNode:
+		items := subSchema(schema["items"])
+		if items == nil {
+			return
+		}
+		for i, item := range node.Content {
+			v.validate(item, items, append(path[:len(path):len(path)], fmt.Sprint(i)))
+		}
+	}
+}
+
+// validateMapping checks all keys of the mapping node against the
+// properties of schema.
+func (v *validator) validateMapping(node *yamlv3.Node, schema Schema, path []string) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	patterns, _ := schema["patternProperties"].(map[string]interface{})
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value == "<<" {
+			// Merge keys insert mappings validated by the same schema
+			v.validate(value, Schema{"type": []interface{}{"object", "array"}, "items": schema}, path)
+			if value.Kind == yamlv3.MappingNode || value.Kind == yamlv3.AliasNode {
+				v.validate(value, schema, path)
+			}
+			continue
+		}
+		childPath := append(path[:len(path):len(path)], key.Value)
+		if property, found := properties[key.Value]; found {
+			v.validate(value, subSchema(property), childPath)
+			continue
+		}
+		matched := false
+		for pattern, property := range patterns {
+			if ok, _ := regexp.MatchString(pattern, key.Value); ok {
+				v.validate(value, subSchema(property), childPath)
+				matched = true
+			}
+		}
+		if matched {
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				keys := make([]string, 0, len(properties))
+				for k := range properties {
+					keys = append(keys, k)
+				}
+				if len(path) == 0 {
+					v.report(key, "unknown top-level key '%s'%s", key.Value, suggestion(key.Value, keys))
+				} else {
+					v.report(key, "unknown key '%s' in '%s'%s", key.Value, displayPath(path), suggestion(key.Value, keys))
+				}
+			}
+		case Schema, map[string]interface{}:
+			v.validate(value, subSchema(additional), childPath)
+		}
+	}
+}
+
+// subSchema converts a value of a schema into a Schema, nil if not possible.
+func subSchema(value interface{}) Schema {
+	switch s := value.(type) {
+	case Schema:
+		return s
+	case map[string]interface{}:
+		return Schema(s)
+	}
+	return nil
+}
+
+// schemaTypes returns the allowed types of schema.
+func schemaTypes(schema Schema) []string {
+	switch t := schema["type"].(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		result := make([]string, len(t))
+		for i, v := range t {
+			result[i] = fmt.Sprint(v)
+		}
+		return result
+	}
+	return nil
+}
+
+// yamlBooleans are plain scalars handled as booleans by the yaml 1.1 parser
+// used to load files.
+var yamlBooleans = []string{"y", "yes", "n", "no", "on", "off", "true", "false"}
+
+// nodeHasType returns whether node is of the JSON Schema type t.
+func nodeHasType(node *yamlv3.Node, t string) bool {
+	switch t {
+	case "object":
+		return node.Kind == yamlv3.MappingNode
+	case "array":
+		return node.Kind == yamlv3.SequenceNode
+	case "null":
+		return node.Kind == yamlv3.ScalarNode && node.Tag == "!!null"
+	}
+	if node.Kind != yamlv3.ScalarNode || node.Tag == "!!null" {
+		return false
+	}
+	switch t {
+	case "string":
+		return node.Tag == "!!str" && !isYAMLBoolean(node)
+	case "number":
+		return node.Tag == "!!int" || node.Tag == "!!float"
+	case "integer":
+		return node.Tag == "!!int"
+	case "boolean":
+		return node.Tag == "!!bool" || isYAMLBoolean(node)
+	}
+	return false
+}
+
+// isYAMLBoolean returns whether node is a plain scalar which is loaded as
+// boolean.
+func isYAMLBoolean(node *yamlv3.Node) bool {
+	return node.Style&(yamlv3.SingleQuotedStyle|yamlv3.DoubleQuotedStyle) == 0 && containsString(yamlBooleans, strings.ToLower(node.Value))
+}
+
+// nodeKind returns the JSON Schema type name of node.
+func nodeKind(node *yamlv3.Node) string {
+	switch node.Kind {
+	case yamlv3.MappingNode:
+		return "object"
+	case yamlv3.SequenceNode:
+		return "array"
+	}
+	switch node.Tag {
+	case "!!null":
+		return "null"
+	case "!!int", "!!float":
+		return "number"
+	case "!!bool":
+		return "boolean"
+	}
+	if isYAMLBoolean(node) {
+		return "boolean"
+	}
+	return "string"
+}
+
+func displayPath(path []string) string {
+	return strings.Join(path, ".")
+}
+
+// suggestion returns a hint for the candidate closest to value, an empty
+// string if no candidate is close enough.
+func suggestion(value string, candidates []string) string {
+	sort.Strings(candidates)
+	best := ""
+	bestDistance := -1
+	for _, candidate := range candidates {
+		d := levenshtein(strings.ToLower(value), strings.ToLower(candidate))
+		if bestDistance < 0 || d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if bestDistance < 0 || (bestDistance > 2 && bestDistance*3 > len(value)) {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean '%s'?", best)
+}
+
+// levenshtein returns the edit distance between a and b.
+func levenshtein(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,227 @@
+package gantry
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestValidateYAMLDefinition(t *testing.T) {
+	cases := []struct {
+		in       string
+		messages []string
+	}{
+		{
+			`version: "2.0"
+x-anchors: &anchor
+  image: alpine
+steps:
+  a:
+    <<: *anchor
+    depends_on: [b]
+  b:
+services:
+  c:
+    image: alpine
+    ports: ["80:80"]
+    x-custom: 1
+`,
+			[]string{},
+		},
+		{
+			`version: "3.8"
+services:
+  web:
+    image: nginx
+    container_name: web
+    user: "1000"
+    working_dir: /srv
+    healthcheck:
+      test: ["CMD", "true"]
+    networks: [front]
+networks:
+  front: {}
+volumes:
+  data:
+`,
+			[]string{},
+		},
+		{
+			`version: "2.0"
+steps:
+  a:
+    image: alpine
+    depend_on: [b]
+`,
+			[]string{"5:5: unknown key 'depend_on' in 'steps.a', did you mean 'depends_on'?"},
+		},
+		{
+			`version: 2.0
+servics: {}
+`,
+			[]string{
+				"1:10: invalid type for 'version': expected string, got number",
+				"2:1: unknown top-level key 'servics', did you mean 'services'?",
+			},
+		},
+		{
+			`steps:
+  a:
+    environment:
+      A: 1
+    ports: 80
+    build:
+      context: .
+      dockerfil: Dockerfile
+`,
+			[]string{
+				"4:10: invalid type for 'steps.a.environment.A': expected string or null, got number",
+				"5:12: invalid type for 'steps.a.ports': expected array, got number",
+				"8:7: unknown key 'dockerfil' in 'steps.a.build', did you mean 'dockerfile'?",
+			},
+		},
+		{
+			`steps:
+  a:
+    matrix:
+      model: [x, y]
+      size: [1, 2]
+`,
+			[]string{"4:18: invalid type for 'steps.a.matrix.model.1': expected string or number, got boolean"},
+		},
+	}
+
+	for _, c := range cases {
+		problems, err := validateYAML([]byte(c.in), nil, "file", DefinitionSchema())
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': '%s'", c.in, err)
+		}
+		messages := make([]string, len(problems))
+		for i, p := range problems {
+			messages[i] = p.Error()[len("file:"):]
+		}
+		if !reflect.DeepEqual(messages, c.messages) {
+			t.Errorf("Incorrect problems for '%s', got: '%#v', wanted: '%#v'", c.in, messages, c.messages)
+		}
+	}
+}
+
+func TestValidateYAMLEnvironment(t *testing.T) {
+	cases := []struct {
+		in       string
+		messages []string
+	}{
+		{
+			`substitutions:
+  A: "1"
+steps:
+  a:
+    keep_alive: replace
+    stdout:
+      handler: file
+profiles:
+  ci:
+    substitutions:
+      B: x
+`,
+			[]string{},
+		},
+		{
+			`steps:
+  a:
+    ignore: yes
+    keep_alvie: no
+    stdout:
+      handler: fiel
+profiles:
+  ci:
+    project_name: x
+`,
+			[]string{
+				"4:5: unknown key 'keep_alvie' in 'steps.a', did you mean 'keep_alive'?",
+				"6:16: invalid value 'fiel' for 'steps.a.stdout.handler', expected one of: stdout, file, both, discard, did you mean 'file'?",
+				"9:5: unknown key 'project_name' in 'profiles.ci'",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		problems, err := validateYAML([]byte(c.in), nil, "file", EnvironmentSchema())
+		if err != nil {
+			t.Fatalf("unexpected error for '%s': '%s'", c.in, err)
+		}
+		messages := make([]string, len(problems))
+		for i, p := range problems {
+			messages[i] = p.Error()[len("file:"):]
+		}
+		if !reflect.DeepEqual(messages, c.messages) {
+			t.Errorf("Incorrect problems for '%s', got: '%#v', wanted: '%#v'", c.in, messages, c.messages)
+		}
+	}
+}
+
+func TestValidateDefinition(t *testing.T) {
+	tmpDef, err := ioutil.TempFile("", "def")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.Remove(tmpDef.Name())
+	if err := ioutil.WriteFile(tmpDef.Name(), []byte(`#! SET_IF_EMPTY ${IMAGE} alpine
+# Comments are removed by the preprocessor
+version: "2.0"
+steps:
+  a:
+    image: ${IMAGE}
+    keep_alive: yes
+`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	env, err := NewPipelineEnvironment([]string{""}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+
+	problems, err := ValidateDefinition(tmpDef.Name(), env)
+	if err != nil {
+		t.Fatalf("unexpected error: '%s'", err)
+	}
+	expected := []ValidationError{{
+		File:    tmpDef.Name(),
+		Line:    7,
+		Column:  5,
+		Message: "unknown key 'keep_alive' in 'steps.a'",
+	}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Incorrect problems, got: '%#v', wanted: '%#v'", problems, expected)
+	}
+}
+
+func TestNewPipelineSchemaProblems(t *testing.T) {
+	cases := []struct {
+		def string
+		env string
+		err string
+	}{
+		{"version: \"2.0\"\nsteps:\n  a:\n    image: alpine\n    keep_alive: yes\n", "", "invalid definition: found 1 schema problem(s)"},
+		{"version: \"2.0\"\nsteps:\n  a:\n    image: alpine\n", "steps:\n  a:\n    keep_alvie: no\n", "invalid environment: found 1 schema problem(s)"},
+	}
+	defer func(ignore bool) { IgnoreSchemaProblems = ignore }(IgnoreSchemaProblems)
+	for i, c := range cases {
+		tmpDef, tmpEnv := setupDefAndEnv(c.def, c.env)
+		IgnoreSchemaProblems = false
+		_, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		if err == nil || err.Error() != c.err {
+			t.Errorf("Incorrect error for case %d, got: '%v', wanted: '%s'", i, err, c.err)
+		}
+		IgnoreSchemaProblems = true
+		if _, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{}); err != nil {
+			t.Errorf("unexpected error for case %d with ignored problems: '%s'", i, err)
+		}
+		os.Remove(tmpDef)
+		os.Remove(tmpEnv)
+	}
+}
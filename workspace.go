@@ -0,0 +1,326 @@
+package gantry // import "github.com/ad-freiburg/gantry"
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WorkspaceLifecycle defines how long the data of a workspace is kept.
+type WorkspaceLifecycle string
+
+const (
+	// WorkspaceLifecycleRun workspaces are created for each run and removed
+	// after it, unless retained.
+	WorkspaceLifecycleRun WorkspaceLifecycle = "run"
+	// WorkspaceLifecycleProject workspaces are shared by all runs of a
+	// project until they are cleaned.
+	WorkspaceLifecycleProject WorkspaceLifecycle = "project"
+	// WorkspaceLifecyclePersistent workspaces are only removed if cleaned
+	// explicitly.
+	WorkspaceLifecyclePersistent WorkspaceLifecycle = "persistent"
+)
+
+// workspaceRunPrefix separates the workspace name from the creation time in
+// the names of the directories of single runs.
+const workspaceRunPrefix string = "run-"
+
+// workspaceRunTimeFormat formats the creation time of run directories, their
+// names sort by it.
+const workspaceRunTimeFormat string = "20060102-150405.000000000-"
+
+// workspaceRunTime matches the creation time of run directories.
+var workspaceRunTime = regexp.MustCompile(`^\d{8}-\d{6}\.\d{9}-`)
+
+// workspaceFailedSuffix marks run directories kept after a failure.
+const workspaceFailedSuffix string = "-failed"
+
+// workspaceReference matches references to the paths of workspaces.
+var workspaceReference = regexp.MustCompile(`\$\{workspaces\.([^}]+)\}`)
+
+// Workspace represents an entry of the top-level workspaces-keyword.
+type Workspace struct {
+	Lifecycle     WorkspaceLifecycle `json:"lifecycle"`
+	Retention     int                `json:"retention"`
+	KeepOnFailure bool               `json:"keep_on_failure"`
+	Path          string             `json:"path"`
+}
+
+// Workspaces stores workspace definitions by name.
+type Workspaces map[string]Workspace
+
+// Check validates all workspaces of w.
+func (w Workspaces) Check() error {
+	for _, name := range sortedKeys(w) {
+		workspace := w[name]
+		switch workspace.Lifecycle {
+		case "", WorkspaceLifecycleRun:
+		case WorkspaceLifecycleProject, WorkspaceLifecyclePersistent:
+			if workspace.Retention != 0 || workspace.KeepOnFailure {
+				return fmt.Errorf("retention and keep_on_failure of workspace '%s' require lifecycle '%s'", name, WorkspaceLifecycleRun)
+			}
+		default:
+			return fmt.Errorf("invalid lifecycle '%s' of workspace '%s'", workspace.Lifecycle, name)
+		}
+		if workspace.Retention < 0 {
+			return fmt.Errorf("invalid retention %d of workspace '%s'", workspace.Retention, name)
+		}
+		if workspace.Path != "" && workspace.Lifecycle != WorkspaceLifecyclePersistent {
+			return fmt.Errorf("path of workspace '%s' requires lifecycle '%s'", name, WorkspaceLifecyclePersistent)
+		}
+	}
+	return nil
+}
+
+// lifecycle returns the lifecycle of w, run if none is set.
+func (w Workspace) lifecycle() WorkspaceLifecycle {
+	if w.Lifecycle == "" {
+		return WorkspaceLifecycleRun
+	}
+	return w.Lifecycle
+}
+
+// workspaceManager creates the directories of workspaces and removes them
+// according to their lifecycle.
+type workspaceManager struct {
+	workspaces Workspaces
+	env        *PipelineEnvironment
+	paths      map[string]string
+	failed     bool
+	mutex      sync.Mutex
+}
+
+// newWorkspaceManager returns a workspaceManager for the workspaces of d.
+func newWorkspaceManager(d *PipelineDefinition, env *PipelineEnvironment) *workspaceManager {
+	return &workspaceManager{
+		workspaces: d.Workspaces,
+		env:        env,
+		paths:      map[string]string{},
+	}
+}
+
+// root returns the directory storing the project and persistent workspaces
+// of the project. They are kept in the cache directory of the user, as they
+// outlive temporary directories.
+func (m *workspaceManager) root() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "gantry", "workspaces", ProjectName)
+}
+
+// dir returns the directory storing the data of the project or persistent
+// workspace name.
+func (m *workspaceManager) dir(name string) string {
+	workspace := m.workspaces[name]
+	if workspace.lifecycle() == WorkspaceLifecyclePersistent && workspace.Path != "" {
+		path, _ := filepath.Abs(workspace.Path)
+		return path
+	}
+	return filepath.Join(m.root(), name, string(workspace.lifecycle()))
+}
+
+// runPrefix returns the prefix of the names of the temporary directories of
+// the run workspace name.
+func (m *workspaceManager) runPrefix(name string) string {
+	return "gantry-" + ProjectName + "-" + name + "-" + workspaceRunPrefix
+}
+
+// runDirs returns the directories of all runs of the run workspace name,
+// ordered by their creation time.
+func (m *workspaceManager) runDirs(name string) ([]string, error) {
+	prefix := filepath.Join(m.env.tempDirBase(), m.runPrefix(name))
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	// Skip directories of workspaces whose names start with name
+	dirs := []string{}
+	for _, match := range matches {
+		if workspaceRunTime.MatchString(strings.TrimPrefix(match, prefix)) {
+			dirs = append(dirs, match)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// Path returns the directory of the workspace name for the current run, it
+// is created if needed. Directories of run workspaces are temporary
+// directories of the environment.
+func (m *workspaceManager) Path(name string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if path, found := m.paths[name]; found {
+		return path, nil
+	}
+	workspace, found := m.workspaces[name]
+	if !found {
+		return "", fmt.Errorf("no such workspace '%s'", name)
+	}
+	var path string
+	if workspace.lifecycle() == WorkspaceLifecycleRun {
+		var err error
+		path, err = m.env.GetOrCreateTempDir(m.runPrefix(name) + time.Now().Format(workspaceRunTimeFormat))
+		if err != nil {
+			return "", err
+		}
+	} else {
+		path = m.dir(name)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return "", err
+		}
+		// Allow writes by any user inside of containers
+		if err := os.Chmod(path, 0777); err != nil {
+			return "", err
+		}
+	}
+	m.paths[name] = path
+	return path, nil
+}
+
+// Dirs returns all existing directories of the workspace name.
+func (m *workspaceManager) Dirs(name string) ([]string, error) {
+	if m.workspaces[name].lifecycle() == WorkspaceLifecycleRun {
+		return m.runDirs(name)
+	}
+	dir := m.dir(name)
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	return []string{dir}, nil
+}
+
+// Resolve returns a copy of step using the workspaces of the current run.
+// Volumes with the name of a workspace as source and references to
+// workspaces are replaced by their paths.
+func (m *workspaceManager) Resolve(step Step) (Step, error) {
+	if m == nil || len(m.workspaces) == 0 {
+		return step, nil
+	}
+	volumes := make([]string, len(step.Volumes))
+	for i, volume := range step.Volumes {
+		volumes[i] = volume
+		parts := strings.SplitN(volume, ":", 2)
+		if _, found := m.workspaces[parts[0]]; !found || len(parts) != 2 {
+			continue
+		}
+		path, err := m.Path(parts[0])
+		if err != nil {
+			return step, err
+		}
+		volumes[i] = path + ":" + parts[1]
+	}
+	step.Volumes = volumes
+	result, err := step.replaceReferences(workspaceReference, func(match []string) (string, error) {
+		return m.Path(match[1])
+	})
+	if err != nil {
+		return step, fmt.Errorf("could not resolve workspaces for '%s': %s", step.Name, err)
+	}
+	return result, nil
+}
+
+// Failed marks the current run as failed.
+func (m *workspaceManager) Failed() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failed = true
+}
+
+// CleanUp removes the directories of run workspaces which are not retained.
+// Directories of failed runs are kept if requested, retention applies to them
+// separately but the latest one is always kept. The data of directories is
+// removed by remove before they are deleted.
+func (m *workspaceManager) CleanUp(remove func(paths []string) error) error {
+	if m == nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	obsolete := []string{}
+	for _, name := range sortedKeys(m.paths) {
+		workspace := m.workspaces[name]
+		if workspace.lifecycle() != WorkspaceLifecycleRun {
+			continue
+		}
+		// Retained directories are not removed with the temporary ones
+		path := m.paths[name]
+		m.env.releaseTempDir(path)
+		if m.failed && workspace.KeepOnFailure {
+			if err := os.Rename(path, path+workspaceFailedSuffix); err != nil {
+				return err
+			}
+			pipelineLogger.Printf("Keeping workspace '%s' of failed run at %s", name, path+workspaceFailedSuffix)
+		}
+		dirs, err := m.runDirs(name)
+		if err != nil {
+			return err
+		}
+		runs := []string{}
+		failed := []string{}
+		for _, dir := range dirs {
+			if strings.HasSuffix(dir, workspaceFailedSuffix) {
+				failed = append(failed, dir)
+			} else {
+				runs = append(runs, dir)
+			}
+		}
+		if len(runs) > workspace.Retention {
+			obsolete = append(obsolete, runs[:len(runs)-workspace.Retention]...)
+		}
+		keep := workspace.Retention
+		if keep < 1 {
+			keep = 1
+		}
+		if len(failed) > keep {
+			obsolete = append(obsolete, failed[:len(failed)-keep]...)
+		}
+	}
+	m.paths = map[string]string{}
+	return removeDirs(obsolete, remove)
+}
+
+// Clean removes all directories of the workspaces names.
+func (m *workspaceManager) Clean(names []string, remove func(paths []string) error) error {
+	dirs := []string{}
+	for _, name := range names {
+		if _, found := m.workspaces[name]; !found {
+			return fmt.Errorf("no such workspace '%s'", name)
+		}
+		d, err := m.Dirs(name)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, d...)
+	}
+	return removeDirs(dirs, remove)
+}
+
+// removeDirs deletes dirs after their data was removed by remove.
+func removeDirs(dirs []string, remove func(paths []string) error) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	if err := remove(dirs); err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
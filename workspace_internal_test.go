@@ -0,0 +1,124 @@
+package gantry
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ad-freiburg/gantry/types"
+)
+
+func TestWorkspacesCheck(t *testing.T) {
+	cases := []struct {
+		workspaces Workspaces
+		err        string
+	}{
+		{Workspaces{"a": {}, "b": {Lifecycle: WorkspaceLifecycleRun, Retention: 2, KeepOnFailure: true}}, ""},
+		{Workspaces{"a": {Lifecycle: WorkspaceLifecyclePersistent, Path: "/data"}}, ""},
+		{Workspaces{"a": {Lifecycle: "forever"}}, "invalid lifecycle 'forever' of workspace 'a'"},
+		{Workspaces{"a": {Retention: -1}}, "invalid retention -1 of workspace 'a'"},
+		{Workspaces{"a": {Lifecycle: WorkspaceLifecycleProject, KeepOnFailure: true}}, "retention and keep_on_failure of workspace 'a' require lifecycle 'run'"},
+		{Workspaces{"a": {Path: "/data"}}, "path of workspace 'a' requires lifecycle 'persistent'"},
+	}
+	for i, c := range cases {
+		err := c.workspaces.Check()
+		if (err == nil && c.err != "") || (err != nil && err.Error() != c.err) {
+			t.Errorf("Incorrect error for case %d, got: '%v', wanted: '%s'", i, err, c.err)
+		}
+	}
+}
+
+func TestPipelineExecuteStepsWorkspaces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("XDG_CACHE_HOME", os.Getenv("XDG_CACHE_HOME"))
+	os.Setenv("XDG_CACHE_HOME", filepath.Join(dir, "cache"))
+	tmpDef, tmpEnv := setupDefAndEnv(`version: "2.0"
+workspaces:
+  scratch:
+    retention: 1
+  debug:
+    keep_on_failure: true
+  cache:
+    lifecycle: project
+steps:
+  a:
+    image: alpine
+    volumes:
+      - scratch:/scratch
+    command: ["fill", "${workspaces.cache}"]
+  b:
+    image: alpine
+    volumes:
+      - debug:/debug
+    outputs:
+      - /debug/result
+    after:
+      - a
+`, `tempdir: `+dir+`
+`)
+	defer os.Remove(tmpDef)
+	defer os.Remove(tmpEnv)
+
+	for run := 0; run < 2; run++ {
+		p, err := NewPipeline([]string{tmpDef}, []string{tmpEnv}, types.StringMap{}, types.StringSet{}, types.StringSet{})
+		if err != nil {
+			t.Fatalf("unexpected error creating pipeline: '%#v'", err)
+		}
+		if err := p.Check(); err != nil {
+			t.Fatalf("unexpected error checking pipeline: '%#v'", err)
+		}
+		runner := &outputsRunner{NoopRunner: NewNoopRunner(true)}
+		p.localRunner = runner
+		p.noopRunner = runner
+		p.Network = Network("test")
+
+		if err := p.ExecuteSteps(); err == nil {
+			t.Errorf("Got no error for missing output")
+		}
+		command, _ := runner.commands.Load("a")
+		cache, _ := p.workspaces.Path("cache")
+		scratch := p.workspaces.paths["scratch"]
+		if r, _ := command.(string); !strings.Contains(r, "-v "+scratch+":/scratch") || !strings.HasSuffix(r, "alpine fill "+cache) {
+			t.Errorf("Incorrect command for 'a', got: '%s'", r)
+		}
+		if filepath.Dir(scratch) != dir {
+			t.Errorf("Incorrect location of workspace 'scratch', got: '%s'", scratch)
+		}
+		if !strings.HasPrefix(cache, filepath.Join(dir, "cache")) {
+			t.Errorf("Incorrect location of workspace 'cache', got: '%s'", cache)
+		}
+		if err := p.CleanUp(nil); err != nil {
+			t.Fatalf("unexpected error cleaning up: '%s'", err)
+		}
+		// Only the latest run is retained
+		if dirs, _ := p.WorkspaceDirs("scratch"); len(dirs) != 1 || dirs[0] != scratch {
+			t.Errorf("Incorrect directories of 'scratch' after run %d, got: '%v', wanted: '%s'", run, dirs, scratch)
+		}
+		// Only the latest failed run is kept
+		if dirs, _ := p.WorkspaceDirs("debug"); len(dirs) != 1 || !strings.HasSuffix(dirs[0], workspaceFailedSuffix) {
+			t.Errorf("Incorrect directories of 'debug' after run %d, got: '%v'", run, dirs)
+		}
+		if dirs, _ := p.WorkspaceDirs("cache"); len(dirs) != 1 || dirs[0] != cache {
+			t.Errorf("Incorrect directories of 'cache' after run %d, got: '%v'", run, dirs)
+		}
+		if run == 1 {
+			if err := p.CleanWorkspaces([]string{}, false); err != nil {
+				t.Fatalf("unexpected error cleaning workspaces: '%s'", err)
+			}
+			for _, name := range []string{"scratch", "debug", "cache"} {
+				if dirs, _ := p.WorkspaceDirs(name); len(dirs) != 0 {
+					t.Errorf("Incorrect directories of '%s' after clean, got: '%v'", name, dirs)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, "cache", "gantry", "workspaces")); err != nil {
+				t.Errorf("unexpected error: '%s'", err)
+			}
+		}
+	}
+}